@@ -0,0 +1,104 @@
+// Package backoff provides retry delays, so that retry loops throughout the
+// pipeline back off consistently.
+package backoff
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Strategy returns the delay before retry n, for n >= 1, without jitter or
+// limits.
+type Strategy func(base time.Duration, n int) time.Duration
+
+// Exponential doubles the delay for each retry: base, 2*base, 4*base, ...
+func Exponential(base time.Duration, n int) time.Duration {
+	if n < 1 {
+		return 0
+	}
+	d := base
+	for i := 1; i < n; i++ {
+		if d > math.MaxInt64/2 {
+			return d // Avoid overflow.
+		}
+		d *= 2
+	}
+	return d
+}
+
+// Fibonacci grows the delay along the fibonacci sequence: base, base,
+// 2*base, 3*base, 5*base, ...
+func Fibonacci(base time.Duration, n int) time.Duration {
+	if n < 1 {
+		return 0
+	}
+	prev, d := time.Duration(0), base
+	for i := 1; i < n; i++ {
+		if d > math.MaxInt64/2 {
+			return d // Avoid overflow.
+		}
+		prev, d = d, prev+d
+	}
+	return d
+}
+
+// Backoff generates the sequence of delays for a retry loop.  The zero value
+// is not useful, but only Base is required.
+// Backoff is NOT THREAD-SAFE
+type Backoff struct {
+	Base     time.Duration // Delay before the first retry.
+	Strategy Strategy      // Defaults to Exponential.
+	Max      time.Duration // If > 0, the limit for each delay.
+	// Jitter is the fraction, from 0 to 1, by which each delay may be
+	// randomly reduced, so that concurrent retries do not synchronize.
+	Jitter float64
+	// Rand returns a value in [0, 1).  Defaults to math/rand.Float64.
+	Rand func() float64
+
+	retries int
+}
+
+// Next returns the delay before the next retry.
+func (b *Backoff) Next() time.Duration {
+	b.retries++
+	strategy := b.Strategy
+	if strategy == nil {
+		strategy = Exponential
+	}
+	d := strategy(b.Base, b.retries)
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		r := b.Rand
+		if r == nil {
+			r = rand.Float64
+		}
+		d -= time.Duration(b.Jitter * r() * float64(d))
+	}
+	return d
+}
+
+// Retries returns the number of delays returned by Next since the last Reset.
+func (b *Backoff) Retries() int {
+	return b.retries
+}
+
+// Reset restarts the sequence from the first delay.
+func (b *Backoff) Reset() {
+	b.retries = 0
+}
+
+// Wait sleeps for the next delay.  It returns ctx.Err() if ctx is done first.
+func (b *Backoff) Wait(ctx context.Context) error {
+	t := time.NewTimer(b.Next())
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
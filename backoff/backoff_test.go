@@ -0,0 +1,105 @@
+package backoff_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl/backoff"
+)
+
+func sequence(b *backoff.Backoff, n int) []time.Duration {
+	d := make([]time.Duration, n)
+	for i := range d {
+		d[i] = b.Next()
+	}
+	return d
+}
+
+func TestBackoffSequences(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		b    backoff.Backoff
+		want []time.Duration
+	}{
+		{
+			name: "default-exponential",
+			b:    backoff.Backoff{Base: 16 * ms},
+			want: []time.Duration{16 * ms, 32 * ms, 64 * ms, 128 * ms, 256 * ms},
+		},
+		{
+			name: "fibonacci",
+			b:    backoff.Backoff{Base: 10 * ms, Strategy: backoff.Fibonacci},
+			want: []time.Duration{10 * ms, 10 * ms, 20 * ms, 30 * ms, 50 * ms, 80 * ms},
+		},
+		{
+			name: "max",
+			b:    backoff.Backoff{Base: 16 * ms, Max: 50 * ms},
+			want: []time.Duration{16 * ms, 32 * ms, 50 * ms, 50 * ms},
+		},
+		{
+			name: "jitter",
+			b:    backoff.Backoff{Base: 100 * ms, Jitter: 0.5, Rand: func() float64 { return 0.5 }},
+			want: []time.Duration{75 * ms, 150 * ms, 300 * ms},
+		},
+		{
+			name: "jitter-after-max",
+			b:    backoff.Backoff{Base: 100 * ms, Max: 200 * ms, Jitter: 1, Rand: func() float64 { return 0.25 }},
+			want: []time.Duration{75 * ms, 150 * ms, 150 * ms},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sequence(&tt.b, len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Next() sequence = %v, want %v", got, tt.want)
+			}
+			if tt.b.Retries() != len(tt.want) {
+				t.Errorf("Retries() = %d, want %d", tt.b.Retries(), len(tt.want))
+			}
+			tt.b.Reset()
+			if got := tt.b.Next(); got != tt.want[0] {
+				t.Errorf("Next() after Reset() = %v, want %v", got, tt.want[0])
+			}
+		})
+	}
+}
+
+func TestBackoffJitterRange(t *testing.T) {
+	b := backoff.Backoff{Base: time.Second, Strategy: func(base time.Duration, n int) time.Duration { return base }, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if d := b.Next(); d <= 800*time.Millisecond || d > time.Second {
+			t.Fatalf("Next() = %v, want in (800ms, 1s]", d)
+		}
+	}
+}
+
+func TestStrategyOverflow(t *testing.T) {
+	for _, s := range []backoff.Strategy{backoff.Exponential, backoff.Fibonacci} {
+		if d := s(time.Second, 200); d <= 0 {
+			t.Errorf("delay for retry 200 = %v, want positive", d)
+		}
+		if d := s(time.Second, 0); d != 0 {
+			t.Errorf("delay for retry 0 = %v, want 0", d)
+		}
+	}
+}
+
+func TestBackoffWait(t *testing.T) {
+	b := backoff.Backoff{Base: time.Millisecond}
+	if err := b.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b = backoff.Backoff{Base: time.Hour}
+	start := time.Now()
+	if err := b.Wait(ctx); err != context.Canceled {
+		t.Errorf("Wait() = %v, want %v", err, context.Canceled)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Wait() did not return promptly after cancel")
+	}
+}
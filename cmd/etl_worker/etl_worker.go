@@ -8,10 +8,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	gcs "cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/m-lab/go/flagx"
@@ -23,6 +26,7 @@ import (
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/factory"
 	"github.com/m-lab/etl/metrics"
+	"github.com/m-lab/etl/parser"
 	"github.com/m-lab/etl/storage"
 	"github.com/m-lab/etl/task"
 	"github.com/m-lab/etl/worker"
@@ -41,15 +45,30 @@ var (
 		Options: []string{"gcs", "local"},
 		Value:   "gcs",
 	}
+	parsableSuffixes flagx.KeyValueArray
 
 	maxActiveTasks = flag.Int64("max_active", 1, "Maximum number of active tasks")
 	gardenerAddr   = flag.String("gardener_addr", ":8080", "Use this address for the gardener jobs service")
 
 	servicePort     = flag.String("service_port", ":8080", "The main (private) service port")
 	shutdownTimeout = flag.Duration("shutdown_timeout", 1*time.Minute, "Graceful shutdown time allowance")
+	storageTimeout  = flag.Duration("storage_client_timeout", 1*time.Minute, "Maximum time to create a GCS client, so that misconfigured credentials fail fast")
 	gcloudProject   = flag.String("gcloud_project", "", "GCP Project id")
 	isBatch         = flag.Bool("batch_service", false, "Whether to run the parser in batch mode")
 	omitDeltas      = flag.Bool("ndt_omit_deltas", false, "Whether to skip ndt.web100 snapshot deltas")
+	finalSnapshot   = flag.Bool("ndt_include_final_snapshot", false, "Whether to attach the complete final ndt.web100 snapshot to each row")
+	deltaStride     = flag.Int("ndt_delta_stride", 1, "Sample every Nth ndt.web100 snapshot when computing deltas")
+	stateTrans      = flag.Bool("ndt_state_transitions", false, "Whether to attach the TCP state transitions across ndt.web100 snapshots to each row")
+	strictVersion   = flag.Bool("ndt_strict_snaplog_version", false, "Whether to drop ndt.web100 snaplogs with an unknown web100 version")
+	dropPartial     = flag.Bool("ndt_drop_partial_groups", false, "Whether to drop ndt.web100 tests missing c2s, s2c, or meta files")
+	splitGroups     = flag.Bool("ndt_split_inconsistent_groups", false, "Whether to split ndt.web100 test groups whose files have different task filenames")
+	ptForwardHops   = flag.Bool("pt_forward_hops", false, "Whether to emit paris-traceroute hops in source to destination order")
+	ptRawLines      = flag.Int("pt_raw_line_capture", 0, "Number of unparsable paris-traceroute lines to retain for /debug/pt_raw_lines")
+	ptBufferMaxAge  = flag.Duration("pt_buffer_max_age", 0, "Maximum time a paris-traceroute test may wait for the pollution check before insertion, or 0 for no limit")
+	ptBufferMaxSize = flag.Int("pt_buffer_max_bytes", 1<<20, "Maximum total size of the paris-traceroute tests waiting for the pollution check, or 0 for no limit")
+	uuidSuffixes    = flag.Bool("disambiguate_synthetic_uuids", false, "Whether to add a numeric suffix to synthetic ndt.web100 and traceroute UUIDs that collide within a task")
+	processedCache  = flag.Int("processed_task_cache_size", 0, "Number of successfully processed tasks to remember, so that redelivered tasks are skipped")
+	skippedFiles    = flag.Bool("skipped_file_manifest", false, "Whether to log a manifest of the files skipped without parsing in each task")
 	bigqueryProject = flag.String("bigquery_project", "", "Override GCLOUD_PROJECT for BigQuery operations")
 	bigqueryDataset = flag.String("bigquery_dataset", "", "Override the BigQuery dataset for output tables")
 	outputLocation  = flag.String("output_location", "", "If output type is 'gcs', write to this GCS bucket. If output type is 'local', write to this directory")
@@ -69,6 +88,7 @@ func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	flag.Var(&outputType, "output", "Output to bigquery or gcs.")
+	flag.Var(&parsableSuffixes, "parsable_suffix", "Additional test file suffixes to parse, as datatype=suffix1,suffix2, for the traceroute and sidestream datatypes.  May be repeated.")
 }
 
 // Task Queue can always submit to an admin restricted URL.
@@ -114,6 +134,15 @@ func Status(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "</body></html>\n")
 }
 
+// ptRawLinesHandler writes the most recently captured paris-traceroute lines
+// that could not be parsed, for debugging corrupt traces.
+func ptRawLinesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, l := range parser.PTRawLines() {
+		fmt.Fprintf(w, "%s: %s\n\t%q\n", l.TestName, l.Err, l.Line)
+	}
+}
+
 // handleLocalRequest is a handler for v2 parse tasks, typically for testing or debugging.
 func handleLocalRequest(rw http.ResponseWriter, req *http.Request) {
 	fn, err := etl.GetFilename(req.FormValue("filename"))
@@ -130,14 +159,29 @@ func handleLocalRequest(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	c, err := storage.GetStorageClient(false)
-	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(rw, "failed to get storage client")
-		return
+	// Local archives with local output need no storage client.
+	var c stiface.Client
+	if !dp.IsLocal() || outputType.Value == "gcs" {
+		c, err = newStorageClient(req.Context())
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(rw, "failed to get storage client")
+			return
+		}
 	}
 
 	ctx := context.Background()
+	if dp.IsLocal() {
+		// Local archives are processed directly, without object attrs.
+		if pErr := worker.ProcessGKETask(ctx, dp, newTaskFactory(c)); pErr != nil {
+			rw.WriteHeader(pErr.Code())
+			fmt.Fprintf(rw, "failed to process %s: %v", dp.LocalPath(), pErr)
+			return
+		}
+		fmt.Fprintf(rw, "no observed errors")
+		return
+	}
+
 	obj, err := c.Bucket(dp.Bucket).Object(dp.Path).Attrs(ctx)
 	if err != nil {
 		log.Println(err)
@@ -146,7 +190,7 @@ func handleLocalRequest(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	r := toRunnable(obj)
+	r := newRunnable(c, obj)
 	err = r.Run(ctx)
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -162,6 +206,38 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "ok")
 }
 
+// readyHandler reports that the worker is not ready once shutdown starts, so
+// that no new tasks are routed to it.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if worker.ShuttingDown() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "shutting down")
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// shutdownOnSignal waits for SIGTERM or SIGINT, then stops and flushes the
+// in-flight tasks before cancelling the main context.
+func shutdownOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	select {
+	case s := <-sig:
+		log.Println("Received", s, "- stopping in-flight tasks")
+	case <-mainCtx.Done():
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := worker.Shutdown(ctx); err != nil {
+		log.Println("Shutdown did not complete:", err)
+	}
+	log.Println("Stopping tasks took", time.Since(start))
+	mainCancel()
+}
+
 type runnable struct {
 	tf task.Factory
 	gcs.ObjectAttrs
@@ -195,12 +271,9 @@ func (r *runnable) Info() string {
 	return r.Name
 }
 
-func toRunnable(obj *gcs.ObjectAttrs) active.Runnable {
-	c, err := storage.GetStorageClient(false)
-	if err != nil {
-		return nil // TODO add an error?
-	}
-
+// newTaskFactory creates a task factory for the configured output type.
+// The client may be nil for local archives with local output.
+func newTaskFactory(c stiface.Client) *worker.StandardTaskFactory {
 	var sink factory.SinkFactory
 	switch outputType.Value {
 	case "gcs":
@@ -209,11 +282,23 @@ func toRunnable(obj *gcs.ObjectAttrs) active.Runnable {
 		sink = storage.NewLocalFactory(*outputLocation)
 	}
 
-	taskFactory := worker.StandardTaskFactory{
+	return &worker.StandardTaskFactory{
 		Sink:   sink,
 		Source: storage.GCSSourceFactory(c),
+		Parser: parser.NewParserFactory(),
 	}
-	return &runnable{&taskFactory, *obj}
+}
+
+func newRunnable(c stiface.Client, obj *gcs.ObjectAttrs) active.Runnable {
+	return &runnable{newTaskFactory(c), *obj}
+}
+
+// newStorageClient creates a read only storage client, giving up after
+// storage_client_timeout, e.g. if the credentials are misconfigured.
+func newStorageClient(ctx context.Context) (stiface.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, *storageTimeout)
+	defer cancel()
+	return storage.GetStorageClientContext(ctx, false)
 }
 
 func mustGardenerAPI(ctx context.Context, jobServer string) *active.GardenerAPI {
@@ -280,14 +365,38 @@ func main() {
 	// TODO: eliminate global variables in favor of config/env object.
 	etl.IsBatch = *isBatch
 	etl.OmitDeltas = *omitDeltas
+	etl.IncludeFinalSnapshot = *finalSnapshot
+	etl.NDTDeltaStride = *deltaStride
+	etl.NDTStateTransitions = *stateTrans
+	etl.StrictSnaplogVersion = *strictVersion
+	etl.DropPartialNDTGroups = *dropPartial
+	etl.SplitInconsistentNDTGroups = *splitGroups
+	etl.PTForwardHops = *ptForwardHops
+	etl.PTRawLineCapture = *ptRawLines
+	etl.PTBufferMaxAge = *ptBufferMaxAge
+	etl.PTBufferMaxBytes = *ptBufferMaxSize
+	etl.ProcessedTaskCacheSize = *processedCache
+	etl.DisambiguateSyntheticUUIDs = *uuidSuffixes
+	etl.SkippedFileManifest = *skippedFiles
 	etl.GCloudProject = *gcloudProject
 	etl.BigqueryProject = *bigqueryProject
 	etl.BigqueryDataset = *bigqueryDataset
+	for dt, suffixes := range parsableSuffixes.Get() {
+		if len(etl.DataType(dt).ParsableSuffixes()) == 0 {
+			log.Fatalf("Datatype %q does not support -parsable_suffix", dt)
+		}
+		etl.SetParsableSuffixes(etl.DataType(dt), append(etl.DataType(dt).ParsableSuffixes(), suffixes...))
+	}
 
 	if len(*gardenerAddr) > 0 {
 		log.Println("Using", *gardenerAddr)
 		minPollingInterval := 10 * time.Second
 		gardenerAPI = mustGardenerAPI(mainCtx, *gardenerAddr)
+		c, err := newStorageClient(mainCtx)
+		rtx.Must(err, "Failed to create storage client")
+		toRunnable := func(obj *gcs.ObjectAttrs) active.Runnable {
+			return newRunnable(c, obj)
+		}
 		// Note that this does not currently track duration metric.
 		go gardenerAPI.Poll(mainCtx, toRunnable, (int)(*maxActiveTasks), minPollingInterval)
 	} else {
@@ -299,10 +408,12 @@ func main() {
 	mux.HandleFunc("/status", Status)
 	mux.HandleFunc("/_ah/health", healthCheckHandler) // legacy
 	mux.HandleFunc("/alive", healthCheckHandler)
-	mux.HandleFunc("/ready", healthCheckHandler)
+	mux.HandleFunc("/ready", readyHandler)
+	mux.HandleFunc("/debug/pt_raw_lines", ptRawLinesHandler)
 
 	// Registers handler for v2 datatypes. Works with "local" output for local development.
 	mux.HandleFunc("/v2/worker", handleLocalRequest)
 
+	go shutdownOnSignal()
 	_ = startServers(mainCtx, mux)
 }
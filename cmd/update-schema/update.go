@@ -30,6 +30,7 @@ import (
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 
+	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/go/cloud/bqx"
 	"github.com/m-lab/go/flagx"
@@ -44,28 +45,20 @@ var (
 	sidecars   = flag.Bool("sidecars", false, "Create or update sidecar tables for the given experiment")
 	legacy     = flag.Bool("legacy", false, "Create or update legacy tables")
 
-	schemas = map[string]schemaGenerator{
-		"annotation2":    &schema.Annotation2Row{},
-		"hopannotation2": &schema.HopAnnotation2Row{},
-		"ndt5":           &schema.NDT5ResultRowV2{},
-		"ndt7":           &schema.NDT7ResultRow{},
-		"tcpinfo":        &schema.TCPInfoRow{},
-		"pcap":           &schema.PCAPRow{},
-		"scamper1":       &schema.Scamper1Row{},
-		"switch":         &schema.SwitchRow{},
-	}
-
-	schemasLegacy = map[string]schemaGenerator{
-		"traceroute": &schema.PTTest{},
-		"sidestream": &schema.SS{},
-		"ndt":        &schema.NDTWeb100{},
+	// Standard column datatypes supported by makeTables.  The schema,
+	// partitioning and clustering of each come from schema.TableSpec.
+	datatypes = map[string]bool{
+		"annotation2":    true,
+		"hopannotation2": true,
+		"ndt5":           true,
+		"ndt7":           true,
+		"tcpinfo":        true,
+		"pcap":           true,
+		"scamper1":       true,
+		"switch":         true,
 	}
 )
 
-type schemaGenerator interface {
-	Schema() (bigquery.Schema, error)
-}
-
 // listLegacyTemplateTables finds all template tables for the given project, datatype, and base table name.
 // Because this function must enumerate all tables in the dataset to find matching names, it may be slow.
 func listLegacyTemplateTables(client *bigquery.Client, project, dataset, table string) ([]string, error) {
@@ -90,7 +83,7 @@ func listLegacyTemplateTables(client *bigquery.Client, project, dataset, table s
 }
 
 // updateLegacyTemplateTables updates the schema on all template tables for the named dataset and table.
-func updateLegacyTemplateTables(client *bigquery.Client, schema bigquery.Schema, project, dataset, table, partField string) int {
+func updateLegacyTemplateTables(client *bigquery.Client, dt etl.DataType, project, dataset, table string) int {
 	// Find all template tables for this table.
 	errCount := 0
 	tables, err := listLegacyTemplateTables(client, project, dataset, table)
@@ -104,17 +97,24 @@ func updateLegacyTemplateTables(client *bigquery.Client, schema bigquery.Schema,
 		// table is recreated here. However, the table will be empty, and used
 		// by the next pass of the parser. So, this is expected to be
 		// unconditionally safe.
-		errCount += CreateOrUpdate(client, schema, project, dataset, tables[i], partField)
+		errCount += CreateOrUpdate(client, dt, project, dataset, tables[i])
 	}
 	return errCount
 }
 
-// CreateOrUpdate will update or create a table from the given schema.
-func CreateOrUpdate(client *bigquery.Client, schema bigquery.Schema, project, dataset, table, partField string) int {
+// CreateOrUpdate will update or create a table for the given datatype, using
+// the schema, partitioning and clustering from schema.TableSpec.
+func CreateOrUpdate(client *bigquery.Client, dt etl.DataType, project, dataset, table string) int {
 	name := project + "." + dataset + "." + table
 	pdt, err := bqx.ParsePDT(name)
 	rtx.Must(err, "ParsePDT")
 
+	sch, partitioning, clustering, err := schema.TableSpec(dt)
+	if err != nil {
+		log.Printf("failed to generate table spec for %s: %v", dt, err)
+		return 1
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
@@ -134,11 +134,7 @@ func CreateOrUpdate(client *bigquery.Client, schema bigquery.Schema, project, da
 		log.Println("Successfully created dataset for", pdt)
 	}
 
-	partitioning := &bigquery.TimePartitioning{
-		Field: partField,
-	}
-
-	err = pdt.UpdateTable(ctx, client, schema, partitioning)
+	err = pdt.UpdateTable(ctx, client, sch, partitioning)
 	if err == nil {
 		log.Println("Successfully updated", pdt)
 		return 0
@@ -151,7 +147,7 @@ func CreateOrUpdate(client *bigquery.Client, schema bigquery.Schema, project, da
 		return 1
 	}
 
-	err = pdt.CreateTable(ctx, client, schema, "", partitioning, nil)
+	err = pdt.CreateTable(ctx, client, sch, "", partitioning, clustering)
 	if err == nil {
 		log.Println("Successfully created", pdt)
 		return 0
@@ -184,31 +180,22 @@ func updateLegacyTables(client *bigquery.Client, project string) int {
 		"ndt",
 	}
 	for _, table := range tables {
-		s, ok := schemasLegacy[table]
-		if !ok {
-			log.Printf("failed to find %v", table)
-			errCount++
-			continue
-		}
-		schema, err := s.Schema()
-		rtx.Must(err, "failed to generate schema for %s", *datatype)
-		errCount += CreateOrUpdate(client, schema, project, "base_tables", table, "")
-		errCount += updateLegacyTemplateTables(client, schema, project, "batch", table, "")
-		errCount += CreateOrUpdate(client, schema, project, "batch", table, "")
+		dt := etl.DataType(table)
+		errCount += CreateOrUpdate(client, dt, project, "base_tables", table)
+		errCount += updateLegacyTemplateTables(client, dt, project, "batch", table)
+		errCount += CreateOrUpdate(client, dt, project, "batch", table)
 	}
 	return errCount
 }
 
 func makeTables(client *bigquery.Client, project, experiment, datatype string) int {
 	errCount := 0
-	if _, ok := schemas[datatype]; !ok {
+	if !datatypes[datatype] {
 		log.Fatal("unsupported datatype:", datatype)
 	}
-	s := schemas[datatype]
-	schema, err := s.Schema()
-	rtx.Must(err, "failed to generate schema for %s", datatype)
-	errCount += CreateOrUpdate(client, schema, project, "tmp_"+experiment, datatype, "date")
-	errCount += CreateOrUpdate(client, schema, project, "raw_"+experiment, datatype, "date")
+	dt := etl.DataType(datatype)
+	errCount += CreateOrUpdate(client, dt, project, "tmp_"+experiment, datatype)
+	errCount += CreateOrUpdate(client, dt, project, "raw_"+experiment, datatype)
 	return errCount
 }
 
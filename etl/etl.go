@@ -111,6 +111,11 @@ type Metadata struct {
 	Date        civil.Date
 	Start       time.Time
 	ArchiveSize int64
+
+	// ArchiveOffset and ArchiveFileSize locate the current test within the
+	// archive.  Unlike the other fields, they change for each test.
+	ArchiveOffset   int64
+	ArchiveFileSize int64
 }
 
 // ErrHighInsertionFailureRate should be returned by TaskError when there are more than 10% BQ insertion errors.
@@ -161,6 +166,15 @@ type TestSource interface {
 	Date() civil.Date // Date associated with test source
 }
 
+// TestPositioner may be implemented by a TestSource that can report where in
+// the archive the most recent test came from.
+type TestPositioner interface {
+	// Position returns the byte offset of the most recent test's data within
+	// the uncompressed archive, and its size in the archive.  Both are zero
+	// if unknown.
+	Position() (offset, size int64)
+}
+
 //========================================================================
 // Interface to allow fakes.
 //========================================================================
@@ -8,6 +8,7 @@ import (
 	"net"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // TODO: Eliminate these global variables using config or env struct.
@@ -18,6 +19,67 @@ var (
 	// OmitDeltas indicates we should NOT process all snapshots.
 	OmitDeltas bool
 
+	// IncludeFinalSnapshot indicates we should attach the complete, unmodified
+	// final snapshot to each NDT row, for validating parser correctness.
+	IncludeFinalSnapshot bool
+
+	// NDTDeltaStride indicates we should sample every Nth snapshot when
+	// generating snapshot deltas.  Values <= 1 process every snapshot.
+	NDTDeltaStride int
+
+	// NDTStateTransitions indicates we should attach the sequence of TCP
+	// state transitions across snapshots to each NDT row.
+	NDTStateTransitions bool
+
+	// StrictSnaplogVersion indicates we should drop NDT snaplogs whose web100
+	// version is not known, rather than just counting a warning.
+	StrictSnaplogVersion bool
+
+	// DropPartialNDTGroups indicates we should drop NDT test groups that are
+	// missing any of the c2s, s2c, or meta files, rather than emitting rows
+	// with anomaly flags.
+	DropPartialNDTGroups bool
+
+	// SplitInconsistentNDTGroups indicates we should start a new NDT test
+	// group when a file's task filename differs from the rest of its group,
+	// rather than attributing it to the group's first task filename.
+	SplitInconsistentNDTGroups bool
+
+	// PTForwardHops indicates we should emit legacy paris-traceroute hops in
+	// forward order, from the source to the destination, rather than in the
+	// reverse order used internally for pollution detection.
+	PTForwardHops bool
+
+	// PTRawLineCapture is the number of raw legacy paris-traceroute lines
+	// that caused parse errors to retain for debugging.  Zero disables
+	// capture.
+	PTRawLineCapture int
+
+	// PTBufferMaxAge bounds how long a legacy paris-traceroute test may wait
+	// in the parser buffer for the pollution check.  Older tests are inserted
+	// when the next test arrives.  Zero disables the limit.
+	PTBufferMaxAge time.Duration
+
+	// PTBufferMaxBytes bounds the total raw size of the legacy
+	// paris-traceroute tests held in the parser buffer.  When exceeded, the
+	// oldest tests are inserted without waiting for the pollution check.
+	// Zero disables the limit.
+	PTBufferMaxBytes = 1 << 20
+
+	// ProcessedTaskCacheSize is the number of successfully processed tasks
+	// to remember, so that tasks redelivered by the task queue can be
+	// skipped.  Zero disables the cache.
+	ProcessedTaskCacheSize int
+
+	// DisambiguateSyntheticUUIDs indicates we should add a numeric suffix to
+	// a synthetic NDT or PT UUID that collides with one already generated in
+	// the same task.  Collisions are always counted and logged.
+	DisambiguateSyntheticUUIDs bool
+
+	// SkippedFileManifest indicates we should log a manifest, for each task,
+	// of the archive files that were skipped without parsing, and why.
+	SkippedFileManifest bool
+
 	// GCloudProject contains the current operating environment.
 	GCloudProject string
 
@@ -46,6 +108,9 @@ var (
 // K8S: gs://pusher-mlab-staging/ndt/tcpinfo/2019/05/25/20190525T020001.697396Z-tcpinfo-mlab4-ord01-ndt.tgz
 //  In this case we have:
 //    start with bucket/exp/type/YYYY/MM/DD/YYYYMMDDTHHMMSS.MMMMMMZ-type-mlabN-pod0K-exp.tgz
+// Either pattern may also be a local file URL, with a root directory in place
+// of the bucket, e.g.:
+// file:///var/spool/ndt/tcpinfo/2019/05/25/20190525T020001.697396Z-tcpinfo-mlab4-ord01-ndt.tgz
 
 // YYYYMMDD is a regexp string for identifying dense dates.
 const YYYYMMDD = `\d{4}[01]\d[0123]\d`
@@ -56,6 +121,10 @@ const MlabDomain = `measurement-lab.org`
 // BucketPattern is used to extract gsutil bucket name.
 const BucketPattern = `gs://([^/]*)/`
 
+// FileRootPattern is used to extract the root directory from a local file URL.
+// The shortest root that leaves a valid experiment and date path is used.
+const FileRootPattern = `file://(.*?)/`
+
 // ExpTypePattern is used to extract the experiment or experiment/type part of the path.
 const ExpTypePattern = `(?:([a-z-]+)/)?([a-z0-9-]+)/` // experiment OR experiment/type.
 
@@ -76,7 +145,7 @@ var (
 	basicTaskPattern = regexp.MustCompile(
 		`(?P<preamble>.*)` + dateTime + `(?P<postamble>.*)`)
 
-	startPattern = regexp.MustCompile(`^` + BucketPattern + ExpTypePattern + DatePathPattern + `$`)
+	startPattern = regexp.MustCompile(`^(?:` + BucketPattern + `|` + FileRootPattern + `)` + ExpTypePattern + DatePathPattern + `$`)
 	endPattern   = regexp.MustCompile(`^` +
 		type2 + // 1
 		mlabNSiteNN + // 2,3
@@ -95,7 +164,7 @@ type DataPath struct {
 	Path string // The path portion of the complete URI (without scheme or bucket).
 
 	// These fields are from the bucket and path
-	Bucket   string // the GCS bucket name.
+	Bucket   string // the GCS bucket name, or the root directory of a file URL.
 	ExpDir   string // the experiment directory.
 	DataType string //
 	DatePath string // the YYYY/MM/DD date path.
@@ -130,9 +199,9 @@ func ValidateTestPath(uri string) (DataPath, error) {
 		URI:        uri,
 		Path:       path(uri),
 		Bucket:     preamble[1],
-		ExpDir:     preamble[2],
-		DataType:   preamble[3],
-		DatePath:   preamble[4],
+		ExpDir:     preamble[3],
+		DataType:   preamble[4],
+		DatePath:   preamble[5],
 		PackedDate: basic[2],
 		PackedTime: basic[3],
 		DataType2:  post[1],
@@ -143,6 +212,10 @@ func ValidateTestPath(uri string) (DataPath, error) {
 		Embargo:    post[6],
 		Suffix:     post[7],
 	}
+	if dp.IsLocal() {
+		dp.Bucket = preamble[2]
+		dp.Path = strings.TrimPrefix(uri, "file://"+dp.Bucket+"/")
+	}
 
 	dataType := dp.GetDataType()
 	if dataType == INVALID {
@@ -153,6 +226,20 @@ func ValidateTestPath(uri string) (DataPath, error) {
 	return dp, nil
 }
 
+// IsLocal returns true if the DataPath refers to a local file URL.
+func (dp DataPath) IsLocal() bool {
+	return strings.HasPrefix(dp.URI, "file://")
+}
+
+// LocalPath returns the local filesystem path for a file URL, or the empty
+// string for other URIs.
+func (dp DataPath) LocalPath() string {
+	if !dp.IsLocal() {
+		return ""
+	}
+	return strings.TrimPrefix(dp.URI, "file://")
+}
+
 // GetDataType finds the type of data stored in a file from its complete filename
 func (dp DataPath) GetDataType() DataType {
 	dt, ok := dirToDataType[dp.DataType]
@@ -328,6 +415,15 @@ var (
 	// It allows us process fewer archives when there is a very high volume of data.
 	// TODO - this should be loaded from a config.
 	dataTypeToSkipCount = map[DataType]int{}
+
+	// Map from data type to the test file name suffixes that its parser
+	// accepts.  Data types not listed here decide parsability in code, e.g.
+	// NDT, which parses each suffix differently.
+	// More suffixes may be enabled at startup with SetParsableSuffixes.
+	dataTypeToParsableSuffixes = map[DataType][]string{
+		SS: {".web100"},
+		PT: {".paris", ".jsonl", ".json"},
+	}
 )
 
 /*******************************************************************************
@@ -374,10 +470,34 @@ func (dt DataType) Table() string {
 	return dataTypeToTable[dt]
 }
 
+// ParsableSuffixes returns a copy of the test file name suffixes that the
+// parser for this DataType accepts.
+func (dt DataType) ParsableSuffixes() []string {
+	return append([]string(nil), dataTypeToParsableSuffixes[dt]...)
+}
+
+// HasParsableSuffix returns true if name ends with one of the suffixes that
+// the parser for this DataType accepts.
+func (dt DataType) HasParsableSuffix(name string) bool {
+	for _, suffix := range dataTypeToParsableSuffixes[dt] {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetParsableSuffixes replaces the test file name suffixes that the parser
+// for dt accepts.  It is not safe to call concurrently with parsing, so it
+// should only be called during startup.
+func SetParsableSuffixes(dt DataType, suffixes []string) {
+	dataTypeToParsableSuffixes[dt] = append([]string(nil), suffixes...)
+}
+
 // GetFilename converts request received from the queue into a filename.
 // TODO(dev) Add unit test
 func GetFilename(filename string) (string, error) {
-	if strings.HasPrefix(filename, "gs://") {
+	if strings.HasPrefix(filename, "gs://") || strings.HasPrefix(filename, "file://") {
 		return filename, nil
 	}
 
@@ -386,7 +506,7 @@ func GetFilename(filename string) (string, error) {
 		return "", errors.New("invalid file path: " + filename)
 	}
 	fn := string(decode[:])
-	if strings.HasPrefix(fn, "gs://") {
+	if strings.HasPrefix(fn, "gs://") || strings.HasPrefix(fn, "file://") {
 		return fn, nil
 	}
 
@@ -127,6 +127,26 @@ func TestValidateTestPath(t *testing.T) {
 				"archive-measurement-lab", "ndt", "pcap", "2021/07/22", "20210722", "000107.470279", "pcap", "mlab1", "dfw05", "ndt", "", "", ".tgz",
 			},
 		},
+		{
+			name:     "file-tcpinfo-tgz",
+			path:     `file:///var/spool/ndt/tcpinfo/2019/05/25/20190525T020001.697396Z-tcpinfo-mlab4-ord01-ndt-0001.tgz`,
+			wantType: etl.TCPINFO,
+			want: etl.DataPath{
+				`file:///var/spool/ndt/tcpinfo/2019/05/25/20190525T020001.697396Z-tcpinfo-mlab4-ord01-ndt-0001.tgz`,
+				`ndt/tcpinfo/2019/05/25/20190525T020001.697396Z-tcpinfo-mlab4-ord01-ndt-0001.tgz`,
+				"/var/spool", "ndt", "tcpinfo", "2019/05/25", "20190525", "020001.697396", "tcpinfo", "mlab4", "ord01", "ndt", "0001", "", ".tgz",
+			},
+		},
+		{
+			name:     "file-relative-tgz",
+			path:     `file://testdata/ndt/ndt7/2020/03/18/20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz`,
+			wantType: etl.NDT7,
+			want: etl.DataPath{
+				`file://testdata/ndt/ndt7/2020/03/18/20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz`,
+				`ndt/ndt7/2020/03/18/20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz`,
+				"testdata", "ndt", "ndt7", "2020/03/18", "20200318", "003853.425987", "ndt7", "mlab3", "syd03", "ndt", "", "", ".tgz",
+			},
+		},
 		{
 			name:     "scamper1-tgz",
 			path:     `gs://archive-measurement-lab/ndt/scamper1/2021/09/08/20210908T215656.886052Z-scamper1-mlab3-bog03-ndt.tgz`,
@@ -357,6 +377,11 @@ func TestGetFilename(t *testing.T) {
 			filename: "Z3M6Ly9taW5pbWFsLXZhbGlkLW5hbWUvdGhpbmcudGd6",
 			want:     "gs://minimal-valid-name/thing.tgz",
 		},
+		{
+			name:     "success-file-url",
+			filename: "file:///minimal/valid/thing.tgz",
+			want:     "file:///minimal/valid/thing.tgz",
+		},
 		{
 			name:     "failure-not-base64",
 			filename: "THIS-IS-NOT-BASE64-ENCODED",
@@ -421,3 +446,31 @@ func TestSkipCount(t *testing.T) {
 		})
 	}
 }
+
+func TestParsableSuffixes(t *testing.T) {
+	defer etl.SetParsableSuffixes(etl.PT, etl.PT.ParsableSuffixes())
+
+	for _, name := range []string{"a.paris", "a.json", "a.jsonl"} {
+		if !etl.PT.HasParsableSuffix(name) {
+			t.Errorf("HasParsableSuffix(%q) = false, want true", name)
+		}
+	}
+	if etl.PT.HasParsableSuffix("a.paris2") {
+		t.Error("HasParsableSuffix(a.paris2) = true, want false")
+	}
+	if etl.TCPINFO.HasParsableSuffix("a.jsonl.zst") {
+		t.Error("HasParsableSuffix() = true for a data type without suffixes")
+	}
+	// NDT routes each suffix to different code, so its suffixes are fixed.
+	if got := etl.NDT.ParsableSuffixes(); len(got) != 0 {
+		t.Errorf("NDT.ParsableSuffixes() = %v, want none", got)
+	}
+
+	etl.SetParsableSuffixes(etl.PT, append(etl.PT.ParsableSuffixes(), ".paris2"))
+	if !etl.PT.HasParsableSuffix("a.paris2") {
+		t.Error("HasParsableSuffix(a.paris2) = false after enabling .paris2")
+	}
+	if !etl.PT.HasParsableSuffix("a.paris") {
+		t.Error("HasParsableSuffix(a.paris) = false after enabling .paris2")
+	}
+}
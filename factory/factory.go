@@ -27,6 +27,12 @@ func (pe processingError) Code() int {
 	return pe.code
 }
 
+// Unwrap returns the underlying error, so that errors.Is and errors.As
+// may inspect it.
+func (pe processingError) Unwrap() error {
+	return pe.error
+}
+
 // NewError creates a new ProcessingError.
 func NewError(dt, detail string, code int, err error) etl.ProcessingError {
 	return processingError{dt, detail, code, err}
@@ -43,3 +49,9 @@ type SinkFactory interface {
 type SourceFactory interface {
 	Get(context.Context, etl.DataPath) (etl.TestSource, etl.ProcessingError)
 }
+
+// ParserFactory provides Get() which always produces a new Parser, writing
+// rows for the named table to the given Sink.
+type ParserFactory interface {
+	Get(context.Context, etl.DataPath, row.Sink, string) (etl.Parser, etl.ProcessingError)
+}
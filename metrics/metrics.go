@@ -66,6 +66,20 @@ var (
 		// GCS source prefix, e.g. gs://archive-measurement-lab/ndt/tcp-info
 		[]string{"source"})
 
+	// TestsPerSecond reports the parser throughput for the most recently
+	// flushed task, as the number of tests processed divided by the elapsed
+	// time since the task started.
+	// Provides metrics:
+	//    etl_tests_per_second{table="..."}
+	// Example usage:
+	//    metrics.TestsPerSecond.WithLabelValues("ndt7").Set(rate)
+	TestsPerSecond = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "etl_tests_per_second",
+			Help: "Tests processed per second by the most recently flushed task.",
+		},
+		[]string{"table"})
+
 	// AnnotationTimeSummary measures the latencies of requests to the Annotation Service as measured by the pipeline
 	// Provides metrics:
 	//    etl_annotator_Annotation_Time_Summary
@@ -155,6 +169,7 @@ var (
 	//   etl_worker_count{table="ndt", state="insert"}
 	// Example usage:
 	//   metrics.WorkerState.WithLabelValues("ndt", "flush").Inc() / .Dec()
+	//   defer metrics.TrackWorkerState("ndt", "flush")()
 	WorkerState = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "etl_worker_state",
@@ -312,6 +327,75 @@ var (
 		[]string{"metro"},
 	)
 
+	// PTBufferOverflowCount counts the PT tests inserted before the pollution
+	// check completed, because the parser buffer exceeded its byte limit.
+	//
+	// Provides metrics:
+	//   etl_pt_buffer_overflow_total{metro}
+	// Example usage:
+	//   metrics.PTBufferOverflowCount.WithLabelValues("sea").Inc()
+	PTBufferOverflowCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_pt_buffer_overflow_total",
+			Help: "Count how many PT tests were flushed early due to buffer size per metro.",
+		},
+		// sea
+		[]string{"metro"},
+	)
+
+	// PTBufferExpiredCount counts the PT tests inserted before the pollution
+	// check completed, because they were buffered longer than the maximum age.
+	//
+	// Provides metrics:
+	//   etl_pt_buffer_expired_total{metro}
+	// Example usage:
+	//   metrics.PTBufferExpiredCount.WithLabelValues("sea").Inc()
+	PTBufferExpiredCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_pt_buffer_expired_total",
+			Help: "Count how many PT tests were flushed early due to buffer age per metro.",
+		},
+		// sea
+		[]string{"metro"},
+	)
+
+	// PTDegenerateCount counts the PT tests whose source and destination
+	// IPs are the same, per metro.
+	//
+	// Provides metrics:
+	//   etl_pt_degenerate_total{metro}
+	// Example usage:
+	//   metrics.PTDegenerateCount.WithLabelValues("sea").Inc()
+	PTDegenerateCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_pt_degenerate_total",
+			Help: "Count how many PT tests had the same source and destination IP per metro.",
+		},
+		// sea
+		[]string{"metro"},
+	)
+
+	// PTTestStatusCount counts the final disposition of each legacy PT test
+	// per metro, so that success rates can be computed from one metric.
+	// Each test is counted once, with one of the statuses:
+	//   reached - the test reached the expected destination.
+	//   not_reached - the test did not reach the destination, and was not polluted.
+	//   polluted - the test was discarded because a later test polluted it.
+	//   degenerate - the source and destination IPs were the same.
+	//
+	// Provides metrics:
+	//   etl_pt_test_status_total{metro, status}
+	// Example usage:
+	//   metrics.PTTestStatusCount.WithLabelValues("sea", "reached").Inc()
+	PTTestStatusCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_pt_test_status_total",
+			Help: "Count of PT tests by final status per metro.",
+		},
+		// sea, reached
+		[]string{"metro", "status"},
+	)
+
 	// PTPollutedCount counts the PT polluted tests per metro.
 	//
 	// Provides metrics:
@@ -327,6 +411,66 @@ var (
 		[]string{"metro"},
 	)
 
+	// NDTInconsistentTaskFileCount counts the NDT files whose task filename
+	// differs from that of the other files in the same test group.
+	//
+	// Provides metrics:
+	//   etl_ndt_inconsistent_task_filename_total{table}
+	// Example usage:
+	//   metrics.NDTInconsistentTaskFileCount.WithLabelValues(TableName()).Inc()
+	NDTInconsistentTaskFileCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_ndt_inconsistent_task_filename_total",
+			Help: "Number of NDT files with a task filename inconsistent with their group.",
+		},
+		[]string{"table"},
+	)
+
+	// NDTInvalidTaskFileCount counts the NDT rows whose task filename is
+	// invalid, so that server metadata must be derived from other sources.
+	//
+	// Provides metrics:
+	//   etl_ndt_invalid_task_filename_total{table}
+	// Example usage:
+	//   metrics.NDTInvalidTaskFileCount.WithLabelValues(TableName()).Inc()
+	NDTInvalidTaskFileCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_ndt_invalid_task_filename_total",
+			Help: "Number of NDT rows with an invalid task filename.",
+		},
+		[]string{"table"},
+	)
+
+	// NDTTimestampCollisionCount counts the NDT snaplogs that share a
+	// timestamp with a distinct snaplog of the same type in one group.
+	//
+	// Provides metrics:
+	//   etl_ndt_timestamp_collision_total{table, direction}
+	// Example usage:
+	//   metrics.NDTTimestampCollisionCount.WithLabelValues(TableName(), "c2s").Inc()
+	NDTTimestampCollisionCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_ndt_timestamp_collision_total",
+			Help: "Number of distinct NDT snaplogs sharing a timestamp with another test.",
+		},
+		[]string{"table", "direction"},
+	)
+
+	// SyntheticUUIDCollisionCount counts the synthetic UUIDs that collide
+	// with another synthetic UUID generated within the same task.
+	//
+	// Provides metrics:
+	//   etl_synthetic_uuid_collision_total{table}
+	// Example usage:
+	//   metrics.SyntheticUUIDCollisionCount.WithLabelValues(TableName()).Inc()
+	SyntheticUUIDCollisionCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_synthetic_uuid_collision_total",
+			Help: "Number of synthetic UUID collisions within a task.",
+		},
+		[]string{"table"},
+	)
+
 	// WarningCount counts the all warnings that do NOT result in test loss.
 	//
 	// Provides metrics:
@@ -389,6 +533,22 @@ var (
 		[]string{"table", "phase", "retries", "status"},
 	)
 
+	// TruncatedArchiveCount counts the number of archives found to be
+	// truncated while reading.
+	//
+	// Provides metrics:
+	//   etl_truncated_archive_total{table, phase}
+	// Example usage:
+	// metrics.TruncatedArchiveCount.WithLabelValues(TableName(), "nextHeader").Inc()
+	TruncatedArchiveCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etl_truncated_archive_total",
+			Help: "Number of truncated archives.",
+		},
+		// ndt/traceroute, nextHeader/nextData
+		[]string{"table", "phase"},
+	)
+
 	// TODO(dev): bytes/row - generalize this metric for any file type.
 	//
 	// RowSizeHistogram provides a histogram of bq row json sizes.  It is intended primarily for
@@ -441,6 +601,28 @@ var (
 		[]string{"table"},
 	)
 
+	// TokenWaitHistogram tracks the time spent waiting to acquire the
+	// tokens that serialize access to a row sink.
+	//
+	// Provides metrics:
+	//   etl_token_wait_seconds_bucket{token="...", le="..."}
+	//   ...
+	//   etl_token_wait_seconds_sum{token="...", le="..."}
+	//   etl_token_wait_seconds_count{token="...", le="..."}
+	// Usage example:
+	//   metrics.TokenWaitHistogram.WithLabelValues(
+	//           "encoding").Observe(time.Since(start).Seconds())
+	TokenWaitHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "etl_token_wait_seconds",
+			Help: "Time spent waiting for sink tokens.",
+			Buckets: []float64{
+				0.0001, 0.001, 0.01, 0.1, 0.2, 0.5, 1, 2, 5, 10, 20, 50, 100,
+			},
+		},
+		[]string{"token"},
+	)
+
 	// TODO(dev): rows/test - generalize this metric for any file type.
 	//
 	// EntryFieldCountHistogram provides a histogram of (approximate) row field counts.  It is intended primarily for
@@ -554,6 +736,66 @@ var (
 		[]string{"table", "kind", "group"},
 	)
 
+	// DecompressionRatioHistogram provides a histogram of the ratio of
+	// decompressed to compressed size of compressed files within task
+	// archives.  Unusually large or small ratios may indicate decompression
+	// bombs or corrupt files.
+	//
+	// Example usage:
+	//   metrics.DecompressionRatioHistogram.WithLabelValues("ndt").Observe(ratio)
+	DecompressionRatioHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "etl_decompression_ratio",
+			Help: "Ratio of decompressed to compressed size of compressed test files.",
+			Buckets: []float64{
+				0, 0.5, 1, 1.5, 2, 3, 5, 7, 10, 15, 20, 30, 50, 70,
+				100, 200, 500, 1000,
+				math.Inf(+1),
+			},
+		},
+		[]string{"table"},
+	)
+
+	// TaskFileCountHistogram provides a histogram of the number of files
+	// in each task archive, observed when the task completes.
+	//
+	// Example usage:
+	//   metrics.TaskFileCountHistogram.WithLabelValues("ndt").Observe(files)
+	TaskFileCountHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "etl_task_file_count",
+			Help: "Number of files in each task archive.",
+			Buckets: []float64{
+				0, 1, 2, 5, 10, 20, 50, 100, 200, 500,
+				1000, 2000, 5000, 10000, 20000, 50000, 100000,
+				math.Inf(+1),
+			},
+		},
+		[]string{"table"},
+	)
+
+	// TaskBytesHistogram provides a histogram of the total decompressed
+	// bytes of the files in each task archive, observed when the task
+	// completes.
+	//
+	// Example usage:
+	//   metrics.TaskBytesHistogram.WithLabelValues("ndt").Observe(bytes)
+	TaskBytesHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "etl_task_bytes",
+			Help: "Total decompressed bytes of the files in each task archive.",
+			Buckets: []float64{
+				0,
+				1000, 3728, 13890, 51790,
+				100000, 372800, 1389000, 5179000,
+				10000000, 37280000, 138900000, 517900000,
+				1000000000, 3728000000, 13890000000,
+				math.Inf(+1),
+			},
+		},
+		[]string{"table"},
+	)
+
 	PcapPacketCount = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "etl_pcap_packet_count",
@@ -668,3 +910,14 @@ func PanicToErr(err error, r interface{}, tag string) error {
 	}
 	return err
 }
+
+// TrackWorkerState increments WorkerState for the table and state, and
+// returns a function that decrements it again.  It should be deferred, so
+// that the gauge is restored even if the tracked phase panics.
+// Example:
+//    defer metrics.TrackWorkerState("ndt", "ndt-parse")()
+func TrackWorkerState(table, state string) func() {
+	g := WorkerState.WithLabelValues(table, state)
+	g.Inc()
+	return g.Dec
+}
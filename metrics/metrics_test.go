@@ -9,6 +9,7 @@ import (
 
 	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func panicAndRecover() (err error) {
@@ -82,6 +83,7 @@ func TestMetrics(t *testing.T) {
 	metrics.AnnotationTimeSummary.WithLabelValues("x")
 	metrics.AnnotationWarningCount.WithLabelValues("x")
 	metrics.BackendFailureCount.WithLabelValues("x", "x")
+	metrics.DecompressionRatioHistogram.WithLabelValues("x")
 	metrics.DeltaNumFieldsHistogram.WithLabelValues("x")
 	metrics.DurationHistogram.WithLabelValues("x", "x")
 	metrics.EntryFieldCountHistogram.WithLabelValues("x")
@@ -93,14 +95,27 @@ func TestMetrics(t *testing.T) {
 	metrics.PanicCount.WithLabelValues("x")
 	metrics.PTBitsAwayFromDestV4.WithLabelValues("x")
 	metrics.PTBitsAwayFromDestV6.WithLabelValues("x")
+	metrics.PTBufferExpiredCount.WithLabelValues("x")
+	metrics.PTBufferOverflowCount.WithLabelValues("x")
+	metrics.PTDegenerateCount.WithLabelValues("x")
 	metrics.PTHopCount.WithLabelValues("x", "x", "x")
 	metrics.PTMoreHopsAfterDest.WithLabelValues("x")
 	metrics.PTNotReachDestCount.WithLabelValues("x")
 	metrics.PTPollutedCount.WithLabelValues("x")
 	metrics.PTTestCount.WithLabelValues("x")
+	metrics.PTTestStatusCount.WithLabelValues("x", "x")
 	metrics.RowSizeHistogram.WithLabelValues("x")
+	metrics.NDTInconsistentTaskFileCount.WithLabelValues("x")
+	metrics.NDTInvalidTaskFileCount.WithLabelValues("x")
+	metrics.NDTTimestampCollisionCount.WithLabelValues("x", "x")
+	metrics.SyntheticUUIDCollisionCount.WithLabelValues("x")
+	metrics.TaskBytesHistogram.WithLabelValues("x")
+	metrics.TaskFileCountHistogram.WithLabelValues("x")
 	metrics.TaskTotal.WithLabelValues("x", "x")
 	metrics.TestTotal.WithLabelValues("x", "x", "x")
+	metrics.TestsPerSecond.WithLabelValues("x")
+	metrics.TokenWaitHistogram.WithLabelValues("x")
+	metrics.TruncatedArchiveCount.WithLabelValues("x", "x")
 	metrics.WarningCount.WithLabelValues("x", "x", "x")
 	metrics.WorkerCount.WithLabelValues("x")
 	metrics.WorkerState.WithLabelValues("x", "x")
@@ -108,3 +123,27 @@ func TestMetrics(t *testing.T) {
 		t.Log("There are lint errors in the prometheus metrics.")
 	}
 }
+
+func panicInPhase() {
+	defer func() { recover() }()
+	defer metrics.TrackWorkerState("x", "panic")()
+	panic("phase failed")
+}
+
+func TestTrackWorkerState(t *testing.T) {
+	g := metrics.WorkerState.WithLabelValues("x", "panic")
+	before := testutil.ToFloat64(g)
+	done := metrics.TrackWorkerState("x", "panic")
+	if got := testutil.ToFloat64(g); got != before+1 {
+		t.Errorf("TrackWorkerState() gauge = %v, want %v", got, before+1)
+	}
+	done()
+	if got := testutil.ToFloat64(g); got != before {
+		t.Errorf("TrackWorkerState() gauge after done = %v, want %v", got, before)
+	}
+
+	panicInPhase()
+	if got := testutil.ToFloat64(g); got != before {
+		t.Errorf("TrackWorkerState() gauge after panic = %v, want %v", got, before)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"log"
 	"strings"
-	"time"
 
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
@@ -63,13 +62,15 @@ func (ap *Annotation2Parser) ParseAndInsert(meta etl.Metadata, testName string,
 
 	row := schema.Annotation2Row{
 		Parser: schema.ParseInfo{
-			Version:     meta.Version,
-			Time:        time.Now(),
-			ArchiveURL:  meta.ArchiveURL,
-			Filename:    testName,
-			GitCommit:   meta.GitCommit,
-			ArchiveSize: meta.ArchiveSize,
-			FileSize:    int64(len(test)),
+			Version:         meta.Version,
+			Time:            NormalizeTime(ap.Now()),
+			ArchiveURL:      meta.ArchiveURL,
+			Filename:        testName,
+			GitCommit:       meta.GitCommit,
+			ArchiveSize:     meta.ArchiveSize,
+			FileSize:        int64(len(test)),
+			ArchiveOffset:   meta.ArchiveOffset,
+			ArchiveFileSize: meta.ArchiveFileSize,
 		},
 	}
 
@@ -79,7 +80,7 @@ func (ap *Annotation2Parser) ParseAndInsert(meta etl.Metadata, testName string,
 	if err != nil {
 		log.Println(err)
 		metrics.TestTotal.WithLabelValues(ap.TableName(), "annotation2", "decode-location-error").Inc()
-		return err
+		return newContentError(etl.ANNOTATION2, "decode-location-error", err)
 	}
 
 	// Fill in the row.
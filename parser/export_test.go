@@ -4,6 +4,8 @@ package parser
 // to enable blackbox tests to set up environment.
 // See https://golang.org/src/net/http/export_test.go.
 
+import "github.com/m-lab/go/logx"
+
 // InitParserVersionForTest allows tests to rerun initParserVersion after initializing
 // environment variables.
 var InitParserVersionForTest = initParserVersion
@@ -14,3 +16,36 @@ var InitParserGitCommitForTest = initParserGitCommit
 
 // ThinSnaps allows exhaustive edge case testing of thinSnaps.
 var ThinSnaps = thinSnaps
+
+// GroupAnomaly allows testing the stable NDT group anomaly labels.
+var GroupAnomaly = groupAnomaly
+
+// ParseIntField allows blackbox tests of the corrupt field handling.
+var ParseIntField = parseIntField
+
+// ParseFloatField allows blackbox tests of the corrupt field handling.
+var ParseFloatField = parseFloatField
+
+// NodeIP returns the ip of a Node, for blackbox tests of ProcessOneTuple.
+func NodeIP(n Node) string { return n.ip }
+
+// NodeRTTs returns the rtts of a Node, for blackbox tests of ProcessOneTuple.
+func NodeRTTs(n Node) []float64 { return n.rtts }
+
+// SetNDTLoggersForTest replaces the rate limited NDT loggers with l, and
+// returns a function that restores them.
+func SetNDTLoggersForTest(l logx.Logger) func() {
+	loggers := []*logx.Logger{
+		&logNDTCollision, &logNDTGunzip, &logNDTSmallSnaplog,
+		&logNDTUnknownVersion, &logNDTNoSnapshots, &logNDTMissingIPs,
+	}
+	saved := make([]logx.Logger, len(loggers))
+	for i, p := range loggers {
+		saved[i], *p = *p, l
+	}
+	return func() {
+		for i, p := range loggers {
+			*p = saved[i]
+		}
+	}
+}
@@ -3,7 +3,6 @@ package parser
 import (
 	"encoding/json"
 	"strings"
-	"time"
 
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
@@ -48,13 +47,15 @@ func (p *HopAnnotation2Parser) ParseAndInsert(meta etl.Metadata, testName string
 
 	row := schema.HopAnnotation2Row{
 		Parser: schema.ParseInfo{
-			Version:     meta.Version,
-			Time:        time.Now(),
-			ArchiveURL:  meta.ArchiveURL,
-			Filename:    testName,
-			GitCommit:   meta.GitCommit,
-			ArchiveSize: meta.ArchiveSize,
-			FileSize:    int64(len(rawContent)),
+			Version:         meta.Version,
+			Time:            NormalizeTime(p.Now()),
+			ArchiveURL:      meta.ArchiveURL,
+			Filename:        testName,
+			GitCommit:       meta.GitCommit,
+			ArchiveSize:     meta.ArchiveSize,
+			FileSize:        int64(len(rawContent)),
+			ArchiveOffset:   meta.ArchiveOffset,
+			ArchiveFileSize: meta.ArchiveFileSize,
 		},
 	}
 
@@ -63,7 +64,7 @@ func (p *HopAnnotation2Parser) ParseAndInsert(meta etl.Metadata, testName string
 	err := json.Unmarshal(rawContent, &raw)
 	if err != nil {
 		metrics.TestTotal.WithLabelValues(p.TableName(), "hopannotation2", "decode-location-error").Inc()
-		return err
+		return newContentError(etl.HOPANNOTATION2, "decode-location-error", err)
 	}
 
 	// Fill in the row.
@@ -140,3 +140,28 @@ func TestHopAnnotation2_IsParsable(t *testing.T) {
 		})
 	}
 }
+
+func TestHopAnnotation2Parser_HopIDMatchesTraceroute(t *testing.T) {
+	ins := newInMemorySink()
+	n := parser.NewHopAnnotation2Parser(ins, "test", "_suffix")
+
+	data, err := ioutil.ReadFile(path.Join("testdata/HopAnnotation2/", hopAnnotation2Filename))
+	rtx.Must(err, "failed to load test file")
+
+	meta := etl.Metadata{
+		ArchiveURL: path.Join(hopAnnotation2GCSPath, hopAnnotation2Filename),
+		Date:       civil.Date{Year: 2021, Month: 07, Day: 30},
+	}
+	if err := n.ParseAndInsert(meta, hopAnnotation2Filename, data); err != nil {
+		t.Fatalf("HopAnnotation2Parser.ParseAndInsert() error = %v", err)
+	}
+	n.Flush()
+
+	// The hop ID must match the ID generated for traceroute hops, so that
+	// hop annotations can be joined with scamper1 rows.
+	row := ins.data[0].(*schema.HopAnnotation2Row)
+	want := parser.GetHopID(float64(row.Raw.Timestamp.Unix()), "1e0b318cf3c2", "91.189.88.152")
+	if row.ID != want {
+		t.Errorf("HopAnnotation2Parser.ParseAndInsert() ID = %q, want %q", row.ID, want)
+	}
+}
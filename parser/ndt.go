@@ -30,12 +30,26 @@ import (
 	"github.com/m-lab/etl/row"
 	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/etl/web100"
+	"github.com/m-lab/go/logx"
 )
 
 var (
 	// NDTEstimateBW flag indicates if we should run BW estimation code
 	// and annotate rows.
 	NDTEstimateBW, _ = strconv.ParseBool(os.Getenv("NDT_ESTIMATE_BW"))
+
+	// logInconsistentTaskFile rate limits logging of groups whose files
+	// have different task filenames.
+	logInconsistentTaskFile = logx.NewLogEvery(nil, 5*time.Second)
+
+	// These rate limit logging of high frequency warnings.  The
+	// corresponding metrics are always incremented.
+	logNDTCollision      = logx.NewLogEvery(nil, 5*time.Second)
+	logNDTGunzip         = logx.NewLogEvery(nil, 5*time.Second)
+	logNDTSmallSnaplog   = logx.NewLogEvery(nil, 5*time.Second)
+	logNDTUnknownVersion = logx.NewLogEvery(nil, 5*time.Second)
+	logNDTNoSnapshots    = logx.NewLogEvery(nil, 5*time.Second)
+	logNDTMissingIPs     = logx.NewLogEvery(nil, 5*time.Second)
 )
 
 const (
@@ -51,6 +65,11 @@ const (
 	// point.
 	minNumSnapshots = 1600 // If fewer than this, then set anomalies.num_snaps
 	maxNumSnapshots = 2800 // If more than this, truncate, and set anomolies.num_snaps
+
+	// The snaplog LogTime is written when the snaplog is opened, so it should
+	// be within a few seconds of the timestamp in the file name.  If they
+	// differ by more than this, set anomalies.time_mismatch.
+	maxLogTimeSkew = 5 * time.Minute
 )
 
 //=========================================================================
@@ -111,7 +130,7 @@ func ParseNDTFileName(path string) (*TestInfo, error) {
 		log.Println(fields[2] + "T" + fields[3] + "   " + err.Error())
 		return nil, errors.New("Invalid test path: " + path)
 	}
-	return &TestInfo{fields[1], fields[2], fields[3], fields[4], fields[5], timestamp}, nil
+	return &TestInfo{fields[1], fields[2], fields[3], fields[4], fields[5], NormalizeTime(timestamp)}, nil
 }
 
 //=========================================================================
@@ -122,6 +141,16 @@ type fileInfoAndData struct {
 	fn   string
 	info TestInfo
 	data []byte
+	// offset and size locate the file within the archive, if known.
+	offset int64
+	size   int64
+}
+
+// collidingTest is a c2s or s2c snaplog whose timestamp collides with a
+// different test of the same type in the current group.
+type collidingTest struct {
+	test     *fileInfoAndData
+	testType string
 }
 
 // NDTParser implements the Parser interface for NDT.
@@ -138,6 +167,15 @@ type NDTParser struct {
 	s2c *fileInfoAndData
 
 	metaFile *MetaFileData
+	// groupCode records the files present in the group being processed.
+	groupCode int64
+
+	// collisions holds distinct snaplogs that share the group timestamp
+	// with n.c2s or n.s2c.  collision is true while they are processed.
+	collisions []collidingTest
+	collision  bool
+
+	uuids syntheticUUIDs // Synthetic UUIDs generated in this task.
 }
 
 // NewNDTParser returns a new NDT parser.
@@ -146,6 +184,7 @@ func NewNDTParser(sink row.Sink, table, suffix string) *NDTParser {
 	return &NDTParser{
 		Base:  row.NewBase(table, sink, bufSize),
 		table: table,
+		uuids: syntheticUUIDs{},
 	}
 }
 
@@ -239,20 +278,30 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 
 		n.taskFileName = taskInfo["filename"].(string)
 		n.timestamp = info.Time
-	} else {
+	} else if fn := taskInfo["filename"].(string); n.taskFileName != fn {
 		// Within a group of tests, we expect consistent taskInfo.
-		if n.taskFileName != taskInfo["filename"].(string) {
-			metrics.TestTotal.WithLabelValues(
-				n.TableName(), "any", "inconsistent taskFileName").Inc()
+		metrics.TestTotal.WithLabelValues(
+			n.TableName(), "any", "inconsistent taskFileName").Inc()
+		metrics.NDTInconsistentTaskFileCount.WithLabelValues(n.TableName()).Inc()
+		logInconsistentTaskFile.Printf("Inconsistent taskFileName for %s: %s and %s\n",
+			testName, n.taskFileName, fn)
+		if etl.SplitInconsistentNDTGroups {
+			// Process the files seen so far as their own group, and
+			// start a new group for this task filename.
+			n.processGroup()
+			n.taskFileName = fn
+			n.timestamp = info.Time
 		}
 	}
 
 	// Because of port number, the c2s, s2c, and meta files may come in
 	// any order.  We defer processing until Flush or new test group.
+	offset, size := archivePosition(taskInfo)
+	test := &fileInfoAndData{fn: testName, info: *info, data: content, offset: offset, size: size}
 	switch info.Suffix {
 	case "c2s_snaplog":
 		if n.c2s == nil {
-			n.c2s = &fileInfoAndData{testName, *info, content}
+			n.c2s = test
 		} else {
 			// There are occasional collisions between tests that
 			// have the same timestamp.
@@ -260,20 +309,24 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 				// When rsync collects both the original file and
 				// the gzipped file, prefer the zipped file, since
 				// the unzipped file may be incomplete.
-				n.c2s = &fileInfoAndData{testName, *info, content}
+				n.c2s = test
 			} else if n.c2s.fn == (testName + ".gz") {
 				// Unzipped file follows zipped file is unexpected,
 				// but harmless. We just ignore the unzipped file.
 			} else {
-				// Unexpected name collision...
+				// Unexpected name collision.  Keep both tests.
 				metrics.WarningCount.WithLabelValues(
 					n.TableName(), "c2s", "timestamp collision").Inc()
-				log.Printf("Collision: %s and %s\n", n.c2s.fn, testName)
+				metrics.NDTTimestampCollisionCount.WithLabelValues(
+					n.TableName(), "c2s").Inc()
+				logNDTCollision.Printf("Collision: %s and %s\n", n.c2s.fn, testName)
+				n.collisions = append(n.collisions, collidingTest{
+					test, "c2s"})
 			}
 		}
 	case "s2c_snaplog":
 		if n.s2c == nil {
-			n.s2c = &fileInfoAndData{testName, *info, content}
+			n.s2c = test
 		} else {
 			// There are occasional collisions between tests that
 			// have the same timestamp.
@@ -281,24 +334,47 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 				// When rsync collects both the original file and
 				// the gzipped file, prefer the zipped file, since
 				// the unzipped file may be incomplete.
-				n.s2c = &fileInfoAndData{testName, *info, content}
+				n.s2c = test
 			} else if n.s2c.fn == (testName + ".gz") {
 				// Unzipped file follows zipped file is unexpected,
 				// but harmless. We just ignore the unzipped file.
 			} else {
-				// Unexpected name collision...
+				// Unexpected name collision.  Keep both tests.
 				metrics.WarningCount.WithLabelValues(
 					n.TableName(), "s2c", "timestamp collision").Inc()
-				log.Printf("Collision: %s and %s\n", n.s2c.fn, testName)
+				metrics.NDTTimestampCollisionCount.WithLabelValues(
+					n.TableName(), "s2c").Inc()
+				logNDTCollision.Printf("Collision: %s and %s\n", n.s2c.fn, testName)
+				n.collisions = append(n.collisions, collidingTest{
+					test, "s2c"})
 			}
 		}
 	case "meta":
-		if n.metaFile != nil {
+		if strings.HasSuffix(testName, ".gz") {
+			content, err = gunzipMeta(content)
+			if err != nil {
+				metrics.TestTotal.WithLabelValues(
+					n.TableName(), "meta", "gunzip error").Inc()
+				logNDTGunzip.Printf("Unable to gunzip %s: %v\n", testName, err)
+				return nil
+			}
+		}
+		if n.metaFile == nil {
+			n.metaFile = ProcessMetaFile(
+				n.TableName(), testName, content)
+		} else if (n.metaFile.TestName + ".gz") == testName {
+			// As with the snaplogs, prefer the zipped file, since the
+			// unzipped file may be incomplete.
+			n.metaFile = ProcessMetaFile(
+				n.TableName(), testName, content)
+		} else if n.metaFile.TestName == (testName + ".gz") {
+			// Unzipped file follows zipped file.  Ignore it.
+		} else {
 			metrics.WarningCount.WithLabelValues(
 				n.TableName(), "meta", "timestamp collision").Inc()
+			n.metaFile = ProcessMetaFile(
+				n.TableName(), testName, content)
 		}
-		n.metaFile = ProcessMetaFile(
-			n.TableName(), testName, content)
 	default:
 		metrics.TestTotal.WithLabelValues(
 			n.TableName(), "unknown", "unparsable file").Inc()
@@ -308,44 +384,91 @@ func (n *NDTParser) ParseAndInsert(taskInfo map[string]bigquery.Value, testName
 	return nil
 }
 
-func (n *NDTParser) reportAnomalies() {
-	// Report all groups that are missing files.
-	tag := ""
-	code := 0
+// Stable codes for the files present in an NDT test group.  The sum of the
+// codes for the files present is recorded in anomalies.group_files for rows
+// from incomplete groups.
+const (
+	NDTGroupHasC2S  = 1
+	NDTGroupHasS2C  = 2
+	NDTGroupHasMeta = 4
+
+	NDTGroupComplete = NDTGroupHasC2S | NDTGroupHasS2C | NDTGroupHasMeta
+)
+
+// groupAnomaly returns a stable metric label describing the files missing
+// from a group with the given code.
+func groupAnomaly(code int64) string {
+	if code == 0 {
+		return "missing all"
+	}
+	missing := []string{}
+	if code&NDTGroupHasC2S == 0 {
+		missing = append(missing, "c2s")
+	}
+	if code&NDTGroupHasS2C == 0 {
+		missing = append(missing, "s2c")
+	}
+	if code&NDTGroupHasMeta == 0 {
+		missing = append(missing, "meta")
+	}
+	return "missing " + strings.Join(missing, "+")
+}
+
+// reportAnomalies reports groups that are missing files, and returns the
+// group code.
+func (n *NDTParser) reportAnomalies() int64 {
+	code := int64(0)
 	if n.metaFile != nil {
-		tag += "meta, "
-		code += 4
+		code |= NDTGroupHasMeta
 	}
 	if n.s2c != nil {
-		tag += "s2c, "
-		code += 2
+		code |= NDTGroupHasS2C
 	}
 	if n.c2s != nil {
-		tag += "c2s"
-		code++
+		code |= NDTGroupHasC2S
 	}
-	if code != 7 {
-		if tag == "" {
-			tag = "Found no files"
-		} else {
-			tag = "Found only " + tag
-		}
+	if code != NDTGroupComplete {
 		metrics.WarningCount.WithLabelValues(
-			n.TableName(), "group", tag).Inc()
+			n.TableName(), "group", groupAnomaly(code)).Inc()
 		// Logging missing meta file is too spammy.  Should restore this when
 		// NDT is fixed.
 	}
+	return code
 }
 
 // processGroup processes tests in the current timestamp grouping.
 func (n *NDTParser) processGroup() {
-	n.reportAnomalies()
-	// Now process the tests, with or without meta file.
-	if n.s2c != nil {
-		n.processTest(n.s2c, "s2c")
-	}
-	if n.c2s != nil {
-		n.processTest(n.c2s, "c2s")
+	n.groupCode = n.reportAnomalies()
+	if n.groupCode != NDTGroupComplete && etl.DropPartialNDTGroups {
+		// Drop the tests, rather than emitting rows with anomaly flags.
+		if n.s2c != nil {
+			metrics.TestTotal.WithLabelValues(
+				n.TableName(), "s2c", "partial group dropped").Inc()
+		}
+		if n.c2s != nil {
+			metrics.TestTotal.WithLabelValues(
+				n.TableName(), "c2s", "partial group dropped").Inc()
+		}
+		for _, c := range n.collisions {
+			metrics.TestTotal.WithLabelValues(
+				n.TableName(), c.testType, "partial group dropped").Inc()
+		}
+	} else {
+		// Now process the tests, with or without meta file.
+		if n.s2c != nil {
+			n.processTest(n.s2c, "s2c")
+		}
+		if n.c2s != nil {
+			n.processTest(n.c2s, "c2s")
+		}
+		// Colliding tests get their own rows, flagged with the
+		// timestamp_collision anomaly.  Their ids are distinct, since
+		// they are derived from the full test filename.
+		n.collision = true
+		for _, c := range n.collisions {
+			n.processTest(c.test, c.testType)
+		}
+		n.collision = false
 	}
 
 	n.taskFileName = ""
@@ -353,6 +476,7 @@ func (n *NDTParser) processGroup() {
 	n.s2c = nil
 	n.c2s = nil
 	n.metaFile = nil
+	n.collisions = nil
 }
 
 // processTest digests a single s2c or c2s test, and writes a row to the Inserter.
@@ -372,7 +496,7 @@ func (n *NDTParser) processTest(test *fileInfoAndData, testType string) {
 	if len(test.data) < 16*1024 {
 		metrics.WarningCount.WithLabelValues(
 			n.TableName(), testType, "<16KB").Inc()
-		log.Printf("Note: small rawSnapLog: %d, %s\n",
+		logNDTSmallSnaplog.Printf("Note: small rawSnapLog: %d, %s\n",
 			len(test.data), test.fn)
 	}
 	if len(test.data) == 4096 {
@@ -380,12 +504,33 @@ func (n *NDTParser) processTest(test *fileInfoAndData, testType string) {
 			n.TableName(), testType, "4KB").Inc()
 	}
 
-	metrics.WorkerState.WithLabelValues(n.TableName(), "ndt").Inc()
-	defer metrics.WorkerState.WithLabelValues(n.TableName(), "ndt").Dec()
+	defer metrics.TrackWorkerState(n.TableName(), "ndt")()
 
 	n.getAndInsertValues(test, testType)
 }
 
+// deltaKeyFields are the fields whose changes are always recorded in deltas,
+// even when sampling with etl.NDTDeltaStride.
+var deltaKeyFields = []string{"State", "CongSignals", "Timeouts"}
+
+// hasKeyField returns true if the delta contains any of the deltaKeyFields.
+func hasKeyField(delta schema.Web100ValueMap) bool {
+	for _, f := range deltaKeyFields {
+		if _, ok := delta[f]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// constantSnapFields are the snapshot fields that do not change during a
+// test, so they are omitted from the deltas.
+var constantSnapFields = []string{
+	"TimeStamps", "StartTimeStamp", "StartTimeUsec",
+	"LocalAddress", "LocalAddressType", "LocalPort",
+	"RemAddress", "RemPort", "SACK",
+}
+
 func (n *NDTParser) getDeltas(snaplog *web100.SnapLog, testType string) ([]schema.Web100ValueMap, int) {
 	deltas := []schema.Web100ValueMap{}
 	deltaFieldCount := 0
@@ -394,7 +539,13 @@ func (n *NDTParser) getDeltas(snaplog *web100.SnapLog, testType string) ([]schem
 	}
 	snapshotCount := 0
 	last := &web100.Snapshot{}
-	for count := 0; count < snaplog.SnapCount() && count < maxNumSnapshots; count++ {
+	numSnaps := snaplog.SnapCount()
+	if numSnaps > maxNumSnapshots {
+		numSnaps = maxNumSnapshots
+	}
+	fields := snaplog.FieldsExcept(constantSnapFields...)
+	for count := 0; count < numSnaps; count++ {
+		sampled := etl.NDTDeltaStride <= 1 || count%etl.NDTDeltaStride == 0 || count == numSnaps-1
 		snap, err := snaplog.Snapshot(count)
 		if err != nil {
 			// TODO - refine label and maybe write a log?
@@ -404,23 +555,24 @@ func (n *NDTParser) getDeltas(snaplog *web100.SnapLog, testType string) ([]schem
 		}
 		// Proper sizing avoids evacuate, saving about 20%, excluding BQ code.
 		delta := schema.EmptySnap10()
-		snap.SnapshotDeltas(last, delta)
-		if err != nil {
+		// Only compare the fields we keep, skipping the constant fields.
+		err = snap.SnapshotFieldDeltas(last, fields, delta)
+		if err != nil && !errors.Is(err, web100.ErrRecordLengthMismatch) {
+			// A field could not be saved cleanly, but the others were, so
+			// keep the delta.
+			metrics.WarningCount.WithLabelValues(
+				n.TableName(), testType, snapFieldErrorKind(err)).Inc()
+		} else if err != nil {
 			metrics.ErrorCount.WithLabelValues(
 				n.TableName(), testType, "snapValues failure").Inc()
 			return nil, 0
 		}
 
-		// Delete the constant fields.
-		delete(delta, "TimeStamps")
-		delete(delta, "StartTimeStamp")
-		delete(delta, "StartTimeUsec")
-		delete(delta, "LocalAddress")
-		delete(delta, "LocalAddressType")
-		delete(delta, "LocalPort")
-		delete(delta, "RemAddress")
-		delete(delta, "RemPort")
-		delete(delta, "SACK")
+		// When sampling, ignore deltas between samples, unless a key field
+		// changed.
+		if !sampled && !hasKeyField(delta) {
+			continue
+		}
 		// Now ignore delta if the only field that changed is duration.
 		if len(delta) == 1 {
 			_, ok := delta["Duration"]
@@ -449,10 +601,63 @@ func (n *NDTParser) getDeltas(snaplog *web100.SnapLog, testType string) ([]schem
 	return deltas, deltaFieldCount
 }
 
+// snapFieldErrorKind returns the metric label for an error saving a single
+// snapshot field.
+func snapFieldErrorKind(err error) string {
+	if errors.Is(err, web100.ErrSuspiciousString) {
+		return "suspicious string"
+	}
+	return "snap field error"
+}
+
+// stateTransitions returns the sequence of TCP states in the snaplog, with
+// the index of the first snapshot in each state, or nil if the State field
+// cannot be read.
+func stateTransitions(snaplog *web100.SnapLog) []schema.Web100ValueMap {
+	indices, err := snaplog.ChangeIndices("State")
+	if err != nil || len(indices) == 0 {
+		return nil
+	}
+	states, err := snaplog.SliceIntField("State", indices)
+	if err != nil {
+		return nil
+	}
+	transitions := make([]schema.Web100ValueMap, len(indices))
+	for i := range indices {
+		transitions[i] = schema.Web100ValueMap{
+			"state":        states[i],
+			"snapshot_num": int64(indices[i]),
+		}
+	}
+	return transitions
+}
+
+// durationRegresses reports whether the snapshot Duration field ever
+// decreases.  Duration is the time since the connection started, so a
+// decrease indicates a corrupt snaplog.
+func durationRegresses(snaplog *web100.SnapLog) bool {
+	intervals, err := snaplog.SnapshotIntervals()
+	if err != nil {
+		return false
+	}
+	for _, d := range intervals {
+		if d < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// logTimeMismatch reports whether the snaplog LogTime, in unix seconds,
+// differs from the file name timestamp by more than maxLogTimeSkew.
+func logTimeMismatch(logTime uint32, fileTime time.Time) bool {
+	skew := time.Unix(int64(logTime), 0).Sub(fileTime)
+	return skew > maxLogTimeSkew || skew < -maxLogTimeSkew
+}
+
 func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 	// Extract the values from the last snapshot.
-	metrics.WorkerState.WithLabelValues(n.TableName(), "ndt-parse").Inc()
-	defer metrics.WorkerState.WithLabelValues(n.TableName(), "ndt-parse").Dec()
+	defer metrics.TrackWorkerState(n.TableName(), "ndt-parse")()
 
 	if !strings.HasSuffix(test.fn, ".gz") {
 		metrics.WarningCount.WithLabelValues(
@@ -461,6 +666,20 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 
 	// Large allocation here.
 	snaplog, err := web100.NewSnapLog(test.data)
+	if errors.Is(err, web100.ErrSnapLogTooLarge) {
+		metrics.ErrorCount.WithLabelValues(
+			n.TableName(), testType, "snaplog too large").Inc()
+		log.Printf("Unable to parse snaplog for %s, when processing: %s\n%s\n",
+			test.fn, n.taskFileName, err)
+		return
+	}
+	if errors.Is(err, web100.ErrRecordLengthMismatch) {
+		metrics.ErrorCount.WithLabelValues(
+			n.TableName(), testType, "record length mismatch").Inc()
+		log.Printf("Unable to parse snaplog for %s, when processing: %s\n%s\n",
+			test.fn, n.taskFileName, err)
+		return
+	}
 	if err != nil {
 		metrics.ErrorCount.WithLabelValues(
 			n.TableName(), testType, "snaplog failure").Inc()
@@ -469,6 +688,20 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 		return
 	}
 
+	if !snaplog.KnownVersion() {
+		// The field layout is read from the header, but an unexpected
+		// version may encode the fields differently.
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "unknown snaplog version").Inc()
+		logNDTUnknownVersion.Printf("Unknown snaplog version %q for %s, when processing: %s\n",
+			snaplog.Version, test.fn, n.taskFileName)
+		if etl.StrictSnaplogVersion {
+			metrics.ErrorCount.WithLabelValues(
+				n.TableName(), testType, "unknown snaplog version").Inc()
+			return
+		}
+	}
+
 	valid := true
 	err = snaplog.ValidateSnapshots()
 	if err != nil {
@@ -489,28 +722,44 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 		// There was some kind of major failure parsing snapshots.
 		return
 	}
-	final := snaplog.SnapCount() - 1
-	if final > maxNumSnapshots {
-		final = maxNumSnapshots
-	}
-	snap, err := snaplog.Snapshot(final)
-	if err != nil {
-		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, "final snapshot failure").Inc()
-		metrics.TestTotal.WithLabelValues(
-			n.TableName(), testType, "final snapshot failure").Inc()
-		return
-	}
 	snapValues := schema.EmptySnap()
-	snap.SnapshotValues(snapValues)
-	if err != nil {
-		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, "final snapValues failure").Inc()
-		metrics.TestTotal.WithLabelValues(
-			n.TableName(), testType, "final snapValues failure").Inc()
-		log.Printf("Error calling SnapshotValues() in test %s, when processing: %s\n%s\n",
-			test.fn, n.taskFileName, err)
-		return
+	suspiciousString := false
+	if snaplog.SnapCount() == 0 {
+		// A header-only snaplog has no final snapshot.  Write a minimal
+		// row, with the connection spec and metadata, but no snap values.
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "no snapshots").Inc()
+		logNDTNoSnapshots.Printf("No snapshots in %s, when processing: %s\n",
+			test.fn, n.taskFileName)
+	} else {
+		final := snaplog.SnapCount() - 1
+		if final > maxNumSnapshots {
+			final = maxNumSnapshots
+		}
+		snap, err := snaplog.Snapshot(final)
+		if err != nil {
+			metrics.ErrorCount.WithLabelValues(
+				n.TableName(), testType, "final snapshot failure").Inc()
+			metrics.TestTotal.WithLabelValues(
+				n.TableName(), testType, "final snapshot failure").Inc()
+			return
+		}
+		err = snap.SnapshotValues(snapValues)
+		if err != nil && !errors.Is(err, web100.ErrRecordLengthMismatch) {
+			// A field could not be saved cleanly, but the others were, so
+			// keep the test, but flag suspicious strings.
+			metrics.WarningCount.WithLabelValues(
+				n.TableName(), testType, snapFieldErrorKind(err)).Inc()
+			suspiciousString = errors.Is(err, web100.ErrSuspiciousString)
+		} else if err != nil {
+			metrics.ErrorCount.WithLabelValues(
+				n.TableName(), testType, "record length mismatch").Inc()
+			metrics.TestTotal.WithLabelValues(
+				n.TableName(), testType, "record length mismatch").Inc()
+			log.Printf("Error calling SnapshotValues() in test %s, when processing: %s\n%s\n",
+				test.fn, n.taskFileName, err)
+			return
+		}
 	}
 
 	// TODO(prod) Write a row with this data, even if the snapshot parsing fails?
@@ -521,8 +770,22 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 		snaplog.Version, int64(snaplog.LogTime),
 		nestedConnSpec, snapValues, deltas)
 
+	if etl.IncludeFinalSnapshot && snaplog.SnapCount() > 0 {
+		// Copy the values before fixValues modifies the snap.
+		final := make(schema.Web100ValueMap, len(snapValues))
+		for k, v := range snapValues {
+			final[k] = v
+		}
+		results.Get("web100_log_entry")["final_snapshot"] = final
+	}
+	if etl.NDTStateTransitions {
+		if transitions := stateTransitions(snaplog); transitions != nil {
+			results.Get("web100_log_entry")["state_transitions"] = transitions
+		}
+	}
+
 	// Create a synthetic UUID for joining with annotations.
-	results["id"] = ndtWeb100SyntheticUUID(test.fn)
+	results["id"] = n.uuids.check(n.TableName(), ndtWeb100SyntheticUUID(test.fn), test.fn)
 	results["test_id"] = test.fn
 	results["task_filename"] = n.taskFileName
 	if snaplog.SnapCount() > maxNumSnapshots || snaplog.SnapCount() < minNumSnapshots {
@@ -531,48 +794,65 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 	if !valid {
 		results["anomalies"].(schema.Web100ValueMap)["snaplog_error"] = true
 	}
+	if suspiciousString {
+		results["anomalies"].(schema.Web100ValueMap)["suspicious_string"] = true
+	}
+	if etl.NDTDeltaStride > 1 && !etl.OmitDeltas {
+		results["anomalies"].(schema.Web100ValueMap)["delta_stride"] = int64(etl.NDTDeltaStride)
+	}
+	if n.groupCode != NDTGroupComplete {
+		results["anomalies"].(schema.Web100ValueMap)["group_files"] = n.groupCode
+	}
 
 	if NDTEstimateBW {
 		// This is not terribly useful as is.  Intended as a place holder for code
 		// we are working on in parallel.
 		congEvents := make(schema.Web100ValueMap, 10)
 		snapNums, snapErr := snaplog.ChangeIndices("SmoothedRTT")
+		var rtts, acked []int64
+		if snapErr == nil {
+			rtts, snapErr = snaplog.SliceIntField("SmoothedRTT", snapNums)
+		}
+		if snapErr == nil {
+			acked, snapErr = snaplog.SliceIntField("HCThruOctetsAcked", snapNums)
+		}
 		if snapErr != nil {
 			log.Println(snapErr)
 		} else {
 			congEvents["indices"] = snapNums
-			congEvents["smoothedRTT"] = snaplog.SliceIntField("SmoothedRTT", snapNums)
-			congEvents["thruOctetsAcked"] = snaplog.SliceIntField("HCThruOctetsAcked", snapNums)
+			congEvents["smoothedRTT"] = rtts
+			congEvents["thruOctetsAcked"] = acked
 			results["slices"] = congEvents
 		}
 	}
 
 	// This is the timestamp parsed from the filename.
-	lt, err := test.info.Timestamp.MarshalText()
-	if err != nil {
-		log.Println(err)
-		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, "log_time marshal error").Inc()
-	} else {
-		results["log_time"] = string(lt)
+	results["log_time"] = NormalizeTime(test.info.Timestamp)
+	// Record the parse time and parser version used to calculate this row.
+	StampParseInfo(results, n.Now(), test.offset, test.size)
+
+	if n.collision {
+		results["anomalies"].(schema.Web100ValueMap)["timestamp_collision"] = true
 	}
-	now, err := time.Now().MarshalText()
-	if err != nil {
-		log.Println(err)
-		metrics.ErrorCount.WithLabelValues(
-			n.TableName(), testType, "parse_time marshal error").Inc()
-	} else {
-		results["parse_time"] = string(now)
+	if logTimeMismatch(snaplog.LogTime, test.info.Timestamp) {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "log time mismatch").Inc()
+		results["anomalies"].(schema.Web100ValueMap)["time_mismatch"] = true
+	}
+	if durationRegresses(snaplog) {
+		metrics.WarningCount.WithLabelValues(
+			n.TableName(), testType, "non-monotonic duration").Inc()
+		results["anomalies"].(schema.Web100ValueMap)["non_monotonic_duration"] = true
 	}
-	// Record the parser version used to calculate this row.
-	results["parser_version"] = Version()
 
 	connSpec := schema.EmptyConnectionSpec()
-	if n.metaFile != nil {
+	if n.metaFile != nil && !n.collision {
 		// TODO - metaFile is currently used only to populate the connection spec.
 		// Should we be using it for anything else?
 		n.metaFile.PopulateConnSpec(connSpec)
-	} else {
+	} else if !n.collision {
+		// The meta file can't be attributed to a colliding test, but
+		// that is already flagged by timestamp_collision.
 		// TODO Add a log once noise is reduced.
 		metrics.WarningCount.WithLabelValues(
 			n.TableName(), testType, "no meta").Inc()
@@ -593,6 +873,18 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 
 	n.fixValues(results)
 
+	// A row with neither client nor server IP can't be joined with anything,
+	// so drop it rather than polluting the table.
+	if missingIPs(results) {
+		metrics.ErrorCount.WithLabelValues(
+			n.TableName(), testType, "missing client and server ip").Inc()
+		metrics.TestTotal.WithLabelValues(
+			n.TableName(), testType, "missing client and server ip").Inc()
+		logNDTMissingIPs.Printf("No client or server IP for %s, when processing: %s\n",
+			test.fn, n.taskFileName)
+		return
+	}
+
 	// TODO fix InsertRow so that we can distinguish errors from prior rows.
 	metrics.EntryFieldCountHistogram.WithLabelValues(n.TableName()).
 		Observe(float64(deltaFieldCount))
@@ -601,10 +893,9 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 			deltaFieldCount, test.fn, n.taskFileName)
 	}
 
-	// ArchiveURL must already be valid, so error is safe to ignore.
-	dp, _ := etl.ValidateTestPath(results["task_filename"].(string))
-	connSpec.Get("ServerX")["Site"] = dp.Site
-	connSpec.Get("ServerX")["Machine"] = dp.Host
+	host, site, _ := n.serverHostSite(connSpec)
+	connSpec.Get("ServerX")["Site"] = site
+	connSpec.Get("ServerX")["Machine"] = host
 
 	// TODO - estimate the size of the json (or fields) to allow more rows per request,
 	// but avoid going over the 10MB limit.
@@ -623,20 +914,68 @@ func (n *NDTParser) getAndInsertValues(test *fileInfoAndData, testType string) {
 		n.TableName(), testType, "ok").Inc()
 }
 
-const (
-	// These are all caps to reflect the linux constant names.
-	WC_ADDRTYPE_IPV4 = 1
-	WC_ADDRTYPE_IPV6 = 2
-	LOCAL_AF_IPV4    = 0
-	LOCAL_AF_IPV6    = 1
+// ndtRowIPFields are the paths of the client and server IP fields that
+// identify the connection of an NDT row.
+var ndtRowIPFields = [][]string{
+	{"client_ip"},
+	{"server_ip"},
+	{"connection_spec", "client_ip"},
+	{"connection_spec", "server_ip"},
+}
+
+// missingIPs returns true if every client and server IP field, at the top
+// level and in the connection spec, is absent, empty, or the unspecified
+// address.
+func missingIPs(results schema.Web100ValueMap) bool {
+	for _, path := range ndtRowIPFields {
+		ip, ok := results.GetString(path)
+		if ok && ip != "" && web100.ValidateIP(ip) != web100.ErrIPIsZero {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	// taskHostSitePattern matches the host and site in a task filename.
+	taskHostSitePattern = regexp.MustCompile(`-(mlab\d)-([a-z]{3}\d[0-9t])-`)
+	// serverHostnamePattern matches the host and site in a server hostname.
+	serverHostnamePattern = regexp.MustCompile(`^(mlab\d)[.-]([a-z]{3}\d[0-9t])\.`)
 )
 
+// serverHostSite returns the short host name and site of the server, e.g.
+// "mlab1" and "lga03".  They normally come from the task filename.  If the
+// task filename is invalid, it falls back to any host and site embedded in
+// the task filename, and then to the server hostname from the meta file.
+func (n *NDTParser) serverHostSite(connSpec schema.Web100ValueMap) (string, string, bool) {
+	data, err := etl.ValidateTestPath(n.taskFileName)
+	if err == nil {
+		return data.Host, data.Site, true
+	}
+	if parts := taskHostSitePattern.FindStringSubmatch(n.taskFileName); parts != nil {
+		return parts[1], parts[2], true
+	}
+	if hn, ok := connSpec["server_hostname"].(string); ok {
+		if parts := serverHostnamePattern.FindStringSubmatch(hn); parts != nil {
+			return parts[1], parts[2], true
+		}
+	}
+	return "", "", false
+}
+
 // fixValues updates web100 log values that need post-processing fix-ups.
 // TODO(dev): does this only apply to NDT or is NPAD also affected?
 // TODO(dev) - consider improving test coverage.
 func (n *NDTParser) fixValues(r schema.Web100ValueMap) {
 	connSpec := r.GetMap([]string{"connection_spec"})
 	logEntry := r.GetMap([]string{"web100_log_entry"})
+
+	if _, err := etl.ValidateTestPath(n.taskFileName); err != nil {
+		// The current filename is ambiguous, but the timestamp should help.
+		metrics.NDTInvalidTaskFileCount.WithLabelValues(n.TableName()).Inc()
+		log.Printf("WARNING: taskFileName is unexpectedly invalid: %s %s: %q",
+			n.taskFileName, n.timestamp, err)
+	}
 	snap := logEntry.GetMap([]string{"snap"})
 	nestedConnSpec := logEntry.GetMap([]string{"connection_spec"})
 
@@ -647,44 +986,57 @@ func (n *NDTParser) fixValues(r schema.Web100ValueMap) {
 		delete(connSpec, "client_hostname")
 	}
 
-	data, err := etl.ValidateTestPath(n.taskFileName)
-	if err != nil {
-		// The current filename is ambiguous, but the timestamp should help.
-		log.Printf("WARNING: taskFileName is unexpectedly invalid: %s %s: %q",
-			n.taskFileName, n.timestamp, err)
-	} else {
+	host, site, ok := n.serverHostSite(connSpec)
+	if ok {
 		// TODO - this is a rather hacky place to put this.
-		connSpec.Get("server").SetString("iata_code", strings.ToUpper(data.Site[0:3]))
+		connSpec.Get("server").SetString("iata_code", strings.ToUpper(site[0:3]))
 
 		// If there is no meta file then the server hostname will not be set.
 		// We must check for presence and an empty value.
 		hn, ok := connSpec["server_hostname"]
 		if !ok || hn == "" {
 			connSpec.SetString("server_hostname", fmt.Sprintf(
-				"%s.%s.%s", data.Host, data.Site, etl.MlabDomain))
+				"%s.%s.%s", host, site, etl.MlabDomain))
 		}
 	}
 
 	// snapshot addresses are always authoritative.  Other sources don't handle
 	// ipv6 correctly.  So, always substitute, unless for some reason the snapshot
-	// value is missing.
-	logEntry.SubstituteString(true, []string{"connection_spec", "local_ip"},
-		[]string{"snap", "LocalAddress"})
-	logEntry.SubstituteString(true, []string{"connection_spec", "remote_ip"},
-		[]string{"snap", "RemAddress"})
+	// value is missing or invalid.
+	if ip, ok := snap.GetString([]string{"LocalAddress"}); ok && web100.ValidateIP(ip) == nil {
+		logEntry.SubstituteString(true, []string{"connection_spec", "local_ip"},
+			[]string{"snap", "LocalAddress"})
+	}
+	if ip, ok := snap.GetString([]string{"RemAddress"}); ok && web100.ValidateIP(ip) == nil {
+		logEntry.SubstituteString(true, []string{"connection_spec", "remote_ip"},
+			[]string{"snap", "RemAddress"})
+	}
 
 	// Handle local_af.
-	// Translate LocalAddressType values of WC_ADDRTYPE_IPV4 (1) or WC_ADDRTYPE_IPV6 (2)
-	// to legacy tables local_af values (LOCAL_AF_IPV*.)
-	localAddrType, ok := snap["LocalAddressType"]
-	if ok {
-		switch localAddrType {
-		case WC_ADDRTYPE_IPV4:
-			nestedConnSpec.SetInt64("local_af", LOCAL_AF_IPV4)
-		case WC_ADDRTYPE_IPV6:
-			nestedConnSpec.SetInt64("local_af", LOCAL_AF_IPV6)
-		default:
-			// Leave it empty.
+	if localAddrType, ok := snap.GetInt64([]string{"LocalAddressType"}); ok {
+		if af, ok := web100.LocalAF(localAddrType); ok {
+			nestedConnSpec.SetInt64("local_af", af)
+		}
+		// The binary connection spec is laid out for ipv4, so its addresses
+		// and ports are unreliable for ipv6 tests.  Use the snapshot values
+		// instead, even if the addresses failed validation above, and never
+		// the truncated connection spec addresses.
+		if localAddrType == web100.WC_ADDRTYPE_IPV6 {
+			for name, snapName := range map[string]string{"local_ip": "LocalAddress", "remote_ip": "RemAddress"} {
+				if ip, ok := snap.GetString([]string{snapName}); ok {
+					nestedConnSpec.SetString(name, ip)
+				} else {
+					r.Get("anomalies")["missing_snap_address"] = true
+				}
+			}
+			if _, ok := snap.GetInt64([]string{"LocalPort"}); ok {
+				logEntry.SubstituteInt64(true, []string{"connection_spec", "local_port"},
+					[]string{"snap", "LocalPort"})
+			}
+			if _, ok := snap.GetInt64([]string{"RemPort"}); ok {
+				logEntry.SubstituteInt64(true, []string{"connection_spec", "remote_port"},
+					[]string{"snap", "RemPort"})
+			}
 		}
 	}
 
@@ -701,6 +1053,18 @@ func (n *NDTParser) fixValues(r schema.Web100ValueMap) {
 	r.SubstituteInt64(false, []string{"connection_spec", "client_af"},
 		[]string{"web100_log_entry", "connection_spec", "local_af"})
 
+	// The top level 4-tuple columns allow queries and clustering without
+	// nested access.  They always come from the log entry, whose addresses
+	// are substituted from the authoritative snapshot values above.
+	r.SubstituteString(true, []string{"server_ip"},
+		[]string{"web100_log_entry", "connection_spec", "local_ip"})
+	r.SubstituteInt64(true, []string{"server_port"},
+		[]string{"web100_log_entry", "connection_spec", "local_port"})
+	r.SubstituteString(true, []string{"client_ip"},
+		[]string{"web100_log_entry", "connection_spec", "remote_ip"})
+	r.SubstituteInt64(true, []string{"client_port"},
+		[]string{"web100_log_entry", "connection_spec", "remote_port"})
+
 	start, ok := snap.GetInt64([]string{"StartTimeStamp"})
 	if ok {
 		start = 1000000 * start
@@ -720,3 +1084,63 @@ func (n *NDTParser) fixValues(r schema.Web100ValueMap) {
 type NDTTest struct {
 	schema.Web100ValueMap
 }
+
+// ndtClientIPFields are the paths of the client IP fields in NDT rows.
+var ndtClientIPFields = [][]string{
+	{"client_ip"},
+	{"connection_spec", "client_ip"},
+	{"web100_log_entry", "connection_spec", "remote_ip"},
+	{"web100_log_entry", "snap", "RemAddress"},
+	{"web100_log_entry", "final_snapshot", "RemAddress"},
+}
+
+// RewriteClientIPs implements row.IPRewriter.  The client hostname is removed,
+// and the client address in the test id, which is the test file name, is
+// replaced by the rewritten client IP.
+func (n NDTTest) RewriteClientIPs(f func(ip string) string) {
+	client := ""
+	for _, path := range ndtClientIPFields {
+		parent := n.GetMap(path[:len(path)-1])
+		if parent == nil {
+			continue
+		}
+		name := path[len(path)-1]
+		if ip, ok := parent[name].(string); ok && ip != "" {
+			parent[name] = f(ip)
+			if client == "" {
+				client = parent[name].(string)
+			}
+		}
+	}
+	if deltas, ok := n.GetMap([]string{"web100_log_entry"})["deltas"].([]schema.Web100ValueMap); ok {
+		for _, delta := range deltas {
+			if ip, ok := delta["RemAddress"].(string); ok && ip != "" {
+				delta["RemAddress"] = f(ip)
+			}
+		}
+	}
+	if connSpec := n.GetMap([]string{"connection_spec"}); connSpec != nil {
+		delete(connSpec, "client_hostname")
+	}
+	if testID, ok := n.Web100ValueMap["test_id"].(string); ok {
+		n.Web100ValueMap["test_id"] = replaceTestAddress(testID, client)
+	}
+}
+
+// replaceTestAddress replaces the remote host in an NDT test file name with
+// addr, keeping the port.
+func replaceTestAddress(fn, addr string) string {
+	loc := gzTestFilePattern.FindStringSubmatchIndex(fn)
+	if loc == nil {
+		loc = testFilePattern.FindStringSubmatchIndex(fn)
+	}
+	if loc == nil {
+		return fn
+	}
+	// The address group is the fourth submatch.
+	begin, end := loc[8], loc[9]
+	if i := strings.LastIndex(fn[begin:end], ":"); i >= 0 {
+		end = begin + i
+	}
+	return fn[:begin] + addr + fn[end:]
+}
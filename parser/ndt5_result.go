@@ -84,13 +84,15 @@ func (dp *NDT5ResultParser) ParseAndInsert(meta etl.Metadata, testName string, t
 	}
 
 	parser := schema.ParseInfo{
-		Version:     meta.Version,
-		Time:        time.Now(),
-		ArchiveURL:  meta.ArchiveURL,
-		Filename:    testName,
-		GitCommit:   meta.GitCommit,
-		ArchiveSize: meta.ArchiveSize,
-		FileSize:    int64(len(test)),
+		Version:         meta.Version,
+		Time:            NormalizeTime(dp.Now()),
+		ArchiveURL:      meta.ArchiveURL,
+		Filename:        testName,
+		GitCommit:       meta.GitCommit,
+		ArchiveSize:     meta.ArchiveSize,
+		FileSize:        int64(len(test)),
+		ArchiveOffset:   meta.ArchiveOffset,
+		ArchiveFileSize: meta.ArchiveFileSize,
 	}
 	date := meta.Date
 
@@ -104,7 +106,7 @@ func (dp *NDT5ResultParser) ParseAndInsert(meta etl.Metadata, testName string, t
 	result, err := dp.newResult(test, parser, date)
 	if err != nil {
 		metrics.TestTotal.WithLabelValues(dp.TableName(), "ndt5_result", "Decode").Inc()
-		return err
+		return newContentError(etl.NDT5, "Decode", err)
 	}
 	if result.Raw.S2C != nil && result.Raw.S2C.UUID != "" {
 		dp.prepareS2CRow(result)
@@ -117,7 +119,7 @@ func (dp *NDT5ResultParser) ParseAndInsert(meta etl.Metadata, testName string, t
 	result, err = dp.newResult(test, parser, date)
 	if err != nil {
 		metrics.TestTotal.WithLabelValues(dp.TableName(), "ndt5_result", "Decode").Inc()
-		return err
+		return newContentError(etl.NDT5, "Decode", err)
 	}
 	if result.Raw.C2S != nil && result.Raw.C2S.UUID != "" {
 		dp.prepareC2SRow(result)
@@ -130,7 +132,7 @@ func (dp *NDT5ResultParser) ParseAndInsert(meta etl.Metadata, testName string, t
 	result, err = dp.newResult(test, parser, date)
 	if err != nil {
 		metrics.TestTotal.WithLabelValues(dp.TableName(), "ndt5_result", "Decode").Inc()
-		return err
+		return newContentError(etl.NDT5, "Decode", err)
 	}
 	if result.Raw.C2S == nil && result.Raw.S2C == nil {
 		result.ID = result.Raw.Control.UUID
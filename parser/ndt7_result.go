@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"log"
 	"strings"
-	"time"
 
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
@@ -25,6 +24,11 @@ type NDT7ResultParser struct {
 	*row.Base
 	table  string
 	suffix string
+
+	// pending holds the most recently parsed row until a result with a
+	// different UUID is parsed, so that download and upload results for the
+	// same UUID are merged into a single row.
+	pending *schema.NDT7ResultRow
 }
 
 // NewNDT7ResultParser returns a parser for NDT7Result archives.
@@ -69,13 +73,15 @@ func (dp *NDT7ResultParser) ParseAndInsert(meta etl.Metadata, testName string, t
 
 	row := schema.NDT7ResultRow{
 		Parser: schema.ParseInfo{
-			Version:     meta.Version,
-			Time:        time.Now(),
-			ArchiveURL:  meta.ArchiveURL,
-			Filename:    testName,
-			GitCommit:   meta.GitCommit,
-			ArchiveSize: meta.ArchiveSize,
-			FileSize:    int64(len(test)),
+			Version:         meta.Version,
+			Time:            NormalizeTime(dp.Now()),
+			ArchiveURL:      meta.ArchiveURL,
+			Filename:        testName,
+			GitCommit:       meta.GitCommit,
+			ArchiveSize:     meta.ArchiveSize,
+			FileSize:        int64(len(test)),
+			ArchiveOffset:   meta.ArchiveOffset,
+			ArchiveFileSize: meta.ArchiveFileSize,
 		},
 	}
 
@@ -84,7 +90,7 @@ func (dp *NDT7ResultParser) ParseAndInsert(meta etl.Metadata, testName string, t
 	if err != nil {
 		log.Println(meta.ArchiveURL, testName, err)
 		metrics.TestTotal.WithLabelValues(dp.TableName(), "ndt7_result", "Unmarshal").Inc()
-		return err
+		return newContentError(etl.NDT7, "Unmarshal", err)
 	}
 
 	// This is a hack to deal with the ConnectionInfo fields that are not intended to be
@@ -120,8 +126,61 @@ func (dp *NDT7ResultParser) ParseAndInsert(meta etl.Metadata, testName string, t
 	metrics.RowSizeHistogram.WithLabelValues(
 		dp.TableName()).Observe(float64(len(test)))
 
+	if canMergeNDT7Results(dp.pending, &row) {
+		mergeNDT7Results(dp.pending, &row)
+		metrics.TestTotal.WithLabelValues(dp.TableName(), "ndt7_result", "merged").Inc()
+		return nil
+	}
+	// A new UUID, so the pending row is complete.
+	err = dp.putPending()
+	dp.pending = &row
+	return err
+}
+
+// canMergeNDT7Results returns true if src is a result for the same UUID as
+// dst, and contains only directions that are missing from dst.
+func canMergeNDT7Results(dst, src *schema.NDT7ResultRow) bool {
+	if dst == nil || src.ID == "" || dst.ID != src.ID {
+		return false
+	}
+	if src.Raw.Download != nil && dst.Raw.Download != nil {
+		return false
+	}
+	if src.Raw.Upload != nil && dst.Raw.Upload != nil {
+		return false
+	}
+	return true
+}
+
+// mergeNDT7Results adds the download or upload data from src that is missing
+// from dst. The summary is taken from the download, if present.
+func mergeNDT7Results(dst, src *schema.NDT7ResultRow) {
+	if dst.Raw.Download == nil && src.Raw.Download != nil {
+		dst.Raw.Download = src.Raw.Download
+		dst.A = src.A
+	}
+	if dst.Raw.Upload == nil && src.Raw.Upload != nil {
+		dst.Raw.Upload = src.Raw.Upload
+	}
+	if src.Raw.EndTime.After(dst.Raw.EndTime) {
+		dst.Raw.EndTime = src.Raw.EndTime
+	}
+	dst.Parser.FileSize += src.Parser.FileSize
+}
+
+// putPending inserts the pending row, if any.
+func (dp *NDT7ResultParser) putPending() error {
+	if dp.pending == nil {
+		return nil
+	}
+	row := dp.pending
+	dp.pending = nil
+	// Add the byte count series after merging, so that both directions
+	// are included.
+	row.A.DownloadSamples = byteSamples(row.Raw.Download)
+	row.A.UploadSamples = byteSamples(row.Raw.Upload)
 	// Insert the row.
-	err = dp.Base.Put(&row)
+	err := dp.Base.Put(row)
 	if err != nil {
 		return err
 	}
@@ -153,6 +212,36 @@ func upSummary(up *model.ArchivalData) schema.NDT7Summary {
 	}
 }
 
+// maxNDT7ByteSamples bounds the number of byte count samples in each row.
+const maxNDT7ByteSamples = 100
+
+// byteSamples returns the server AppInfo byte counts from data, evenly
+// sampled down to at most maxNDT7ByteSamples.  The first and last samples
+// are always included.
+func byteSamples(data *model.ArchivalData) []schema.NDT7ByteSample {
+	if data == nil {
+		return nil
+	}
+	var all []schema.NDT7ByteSample
+	for _, m := range data.ServerMeasurements {
+		if m.AppInfo != nil {
+			all = append(all, schema.NDT7ByteSample{
+				ElapsedTime: m.AppInfo.ElapsedTime,
+				NumBytes:    m.AppInfo.NumBytes,
+			})
+		}
+	}
+	n := len(all)
+	if n <= maxNDT7ByteSamples {
+		return all
+	}
+	out := make([]schema.NDT7ByteSample, 0, maxNDT7ByteSamples)
+	for i := 0; i < maxNDT7ByteSamples-1; i++ {
+		out = append(out, all[i*(n-1)/(maxNDT7ByteSamples-1)])
+	}
+	return append(out, all[n-1])
+}
+
 func lossRate(m []model.Measurement) float64 {
 	var loss float64
 	if len(m) > 0 {
@@ -192,6 +281,10 @@ func minRTT(m []model.Measurement) float64 {
 // For NDT7Result, we just forward the calls to the Inserter.
 
 func (dp *NDT7ResultParser) Flush() error {
+	err := dp.putPending()
+	if err != nil {
+		return err
+	}
 	return dp.Base.Flush()
 }
 
@@ -1,18 +1,27 @@
 package parser_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net/http"
 	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/civil"
 	"github.com/go-test/deep"
 
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/row"
 	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/go/pretty"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt7/model"
 )
 
 func setupNDT7InMemoryParser(t *testing.T, testName string) (*schema.NDT7ResultRow, int64, error) {
@@ -24,23 +33,54 @@ func setupNDT7InMemoryParser(t *testing.T, testName string) (*schema.NDT7ResultR
 		t.Fatalf(err.Error())
 	}
 	meta := etl.Metadata{
-		ArchiveURL: "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
-		Date:       civil.Date{Year: 2020, Month: 3, Day: 18},
-		Version:    parser.Version(),
-		GitCommit:  parser.GitCommit(),
+		ArchiveURL:      "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
+		Date:            civil.Date{Year: 2020, Month: 3, Day: 18},
+		Version:         parser.Version(),
+		GitCommit:       parser.GitCommit(),
+		ArchiveOffset:   1536,
+		ArchiveFileSize: int64(len(resultData)),
 	}
 	err = n.ParseAndInsert(meta, testName, resultData)
 	if err != nil {
 		return nil, 0, err
 	}
+	// Rows are held until Flush, to allow merging results with the same UUID.
+	n.Flush()
 	if n.Accepted() != 1 {
 		t.Fatal("Failed to insert snaplog data.", ins)
 	}
-	n.Flush()
 	row := ins.data[0].(*schema.NDT7ResultRow)
 	return row, int64(len(resultData)), err
 }
 
+func TestNDT7ResultParserClock(t *testing.T) {
+	testName := `ndt7-download-20200318T000657.568382877Z.ndt-knwp4_1583603744_000000000000590E.json`
+	resultData, err := ioutil.ReadFile(path.Join("testdata/NDT7Result/", testName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins := newInMemorySink()
+	n := parser.NewNDT7ResultParser(ins, "test", "_suffix")
+	fixed := time.Date(2020, 3, 18, 12, 0, 0, 123456789, time.UTC)
+	n.(*parser.NDT7ResultParser).SetClock(row.ClockFunc(func() time.Time { return fixed }))
+
+	meta := etl.Metadata{
+		ArchiveURL: "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
+		Date:       civil.Date{Year: 2020, Month: 3, Day: 18},
+	}
+	if err := n.ParseAndInsert(meta, testName, resultData); err != nil {
+		t.Fatal(err)
+	}
+	n.Flush()
+	if n.Accepted() != 1 {
+		t.Fatalf("Accepted() = %d, want 1", n.Accepted())
+	}
+	got := ins.data[0].(*schema.NDT7ResultRow).Parser.Time
+	if want := parser.NormalizeTime(fixed); !got.Equal(want) {
+		t.Errorf("parse time = %v, want %v", got, want)
+	}
+}
+
 func TestNDT7ResultParser_ParseAndInsert(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -76,13 +116,15 @@ func TestNDT7ResultParser_ParseAndInsert(t *testing.T) {
 				}
 
 				expPI := schema.ParseInfo{
-					Version:    "https://github.com/m-lab/etl/tree/foobar", // "local development",
-					Time:       row.Parser.Time,                            // cheat a little, since this value should be about now.
-					ArchiveURL: "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
-					Filename:   "ndt7-download-20200318T000657.568382877Z.ndt-knwp4_1583603744_000000000000590E.json",
-					Priority:   0,
-					GitCommit:  "12345678",
-					FileSize:   size,
+					Version:         "https://github.com/m-lab/etl/tree/foobar", // "local development",
+					Time:            row.Parser.Time,                            // cheat a little, since this value should be about now.
+					ArchiveURL:      "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
+					Filename:        "ndt7-download-20200318T000657.568382877Z.ndt-knwp4_1583603744_000000000000590E.json",
+					Priority:        0,
+					GitCommit:       "12345678",
+					FileSize:        size,
+					ArchiveOffset:   1536,
+					ArchiveFileSize: size,
 				}
 				if diff := deep.Equal(row.Parser, expPI); diff != nil {
 					pretty.Print(row.Parser)
@@ -116,13 +158,15 @@ func TestNDT7ResultParser_ParseAndInsert(t *testing.T) {
 					t.Errorf("NDT7ResultParser.ParseAndInsert() different summary: %s", strings.Join(diff, "\n"))
 				}
 				expPI := schema.ParseInfo{
-					Version:    "https://github.com/m-lab/etl/tree/foobar",
-					Time:       row.Parser.Time,
-					ArchiveURL: "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
-					Filename:   "ndt7-upload-20200318T001352.496224022Z.ndt-knwp4_1583603744_0000000000005CF2.json",
-					Priority:   0,
-					GitCommit:  "12345678",
-					FileSize:   size,
+					Version:         "https://github.com/m-lab/etl/tree/foobar",
+					Time:            row.Parser.Time,
+					ArchiveURL:      "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
+					Filename:        "ndt7-upload-20200318T001352.496224022Z.ndt-knwp4_1583603744_0000000000005CF2.json",
+					Priority:        0,
+					GitCommit:       "12345678",
+					FileSize:        size,
+					ArchiveOffset:   1536,
+					ArchiveFileSize: size,
 				}
 				if diff := deep.Equal(row.Parser, expPI); diff != nil {
 					t.Errorf("NDT7ResultParser.ParseAndInsert() different summary: %s", strings.Join(diff, "\n"))
@@ -204,3 +248,114 @@ func TestNDT7ResultParser_IsParsable(t *testing.T) {
 		})
 	}
 }
+
+func TestNDT7ResultParser_MergeDownloadAndUpload(t *testing.T) {
+	ins := newInMemorySink()
+	n := parser.NewNDT7ResultParser(ins, "test", "_suffix")
+	meta := etl.Metadata{
+		ArchiveURL: "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
+		Date:       civil.Date{Year: 2020, Month: 3, Day: 18},
+	}
+	down := "ndt7-download-20200318T000657.568382877Z.ndt-knwp4_1583603744_000000000000590E.json"
+	up := "ndt7-upload-20200318T001352.496224022Z.ndt-knwp4_1583603744_0000000000005CF2.json"
+	downData, err := ioutil.ReadFile(path.Join("testdata/NDT7Result/", down))
+	rtx.Must(err, "failed to load test file")
+	upData, err := ioutil.ReadFile(path.Join("testdata/NDT7Result/", up))
+	rtx.Must(err, "failed to load test file")
+	// Give the upload the same UUID as the download, as for a single test.
+	upData = bytes.ReplaceAll(upData, []byte("ndt-knwp4_1583603744_0000000000005CF2"),
+		[]byte("ndt-knwp4_1583603744_000000000000590E"))
+
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{up, upData}, {down, downData}, {up, upData}} {
+		if err := n.ParseAndInsert(meta, f.name, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n.Flush()
+
+	// The first two files merge into one row; the third starts a new row,
+	// since the upload direction is already present.
+	if len(ins.data) != 2 {
+		t.Fatalf("ParseAndInsert() inserted %d rows, want 2", len(ins.data))
+	}
+	row := ins.data[0].(*schema.NDT7ResultRow)
+	if row.Raw.Download == nil || row.Raw.Upload == nil {
+		t.Fatalf("Merged row missing a direction: download %v, upload %v",
+			row.Raw.Download != nil, row.Raw.Upload != nil)
+	}
+	if row.ID != "ndt-knwp4_1583603744_000000000000590E" {
+		t.Errorf("Merged row ID = %q", row.ID)
+	}
+	if row.A.CongestionControl != "bbr" || row.A.LossRate == 0 {
+		t.Errorf("Merged row summary not taken from download: %+v", row.A)
+	}
+	if row.Parser.FileSize != int64(len(upData)+len(downData)) {
+		t.Errorf("Merged row FileSize = %d, want %d", row.Parser.FileSize, len(upData)+len(downData))
+	}
+}
+
+func TestNDT7ResultParser_ByteSamples(t *testing.T) {
+	down := "ndt7-download-20200318T000657.568382877Z.ndt-knwp4_1583603744_000000000000590E.json"
+	downData, err := ioutil.ReadFile(path.Join("testdata/NDT7Result/", down))
+	rtx.Must(err, "failed to load test file")
+
+	// The test data has no AppInfo, so add a long series of measurements.
+	var result data.NDT7Result
+	rtx.Must(json.Unmarshal(downData, &result), "failed to unmarshal test file")
+	last := result.Download.ServerMeasurements[len(result.Download.ServerMeasurements)-1]
+	const numMeasurements = 1000
+	for i := 1; i <= numMeasurements; i++ {
+		result.Download.ServerMeasurements = append(result.Download.ServerMeasurements, model.Measurement{
+			AppInfo: &model.AppInfo{NumBytes: int64(i) * 1000, ElapsedTime: int64(i) * 10000},
+			TCPInfo: last.TCPInfo,
+		})
+	}
+	downData, err = json.Marshal(result)
+	rtx.Must(err, "failed to marshal test data")
+
+	ins := newInMemorySink()
+	n := parser.NewNDT7ResultParser(ins, "test", "_suffix")
+	meta := etl.Metadata{
+		ArchiveURL: "gs://mlab-test-bucket/ndt/ndt7/2020/03/18/ndt_ndt7_2020_03_18_20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
+		Date:       civil.Date{Year: 2020, Month: 3, Day: 18},
+	}
+	rtx.Must(n.ParseAndInsert(meta, down, downData), "failed to parse")
+	rtx.Must(n.Flush(), "failed to flush")
+	row := ins.data[0].(*schema.NDT7ResultRow)
+
+	samples := row.A.DownloadSamples
+	if len(samples) != 100 {
+		t.Fatalf("DownloadSamples has %d samples, want 100", len(samples))
+	}
+	if samples[0].NumBytes != 1000 || samples[len(samples)-1].NumBytes != numMeasurements*1000 {
+		t.Errorf("DownloadSamples should include the first and last samples: got %v and %v",
+			samples[0], samples[len(samples)-1])
+	}
+	for i := 1; i < len(samples); i++ {
+		if samples[i].ElapsedTime <= samples[i-1].ElapsedTime || samples[i].NumBytes <= samples[i-1].NumBytes {
+			t.Errorf("DownloadSamples not increasing at %d: %v, %v", i, samples[i-1], samples[i])
+		}
+	}
+	if row.A.UploadSamples != nil {
+		t.Errorf("UploadSamples = %v, want nil", row.A.UploadSamples)
+	}
+}
+
+func TestNDT7ResultParser_ContentError(t *testing.T) {
+	n := parser.NewNDT7ResultParser(newInMemorySink(), "test", "_suffix")
+	err := n.ParseAndInsert(etl.Metadata{}, "ndt7-download-corrupt.json", []byte("{not json"))
+	var pErr etl.ProcessingError
+	if !errors.As(err, &pErr) {
+		t.Fatalf("ParseAndInsert() = %v, want ProcessingError", err)
+	}
+	if pErr.Code() != http.StatusBadRequest {
+		t.Errorf("ParseAndInsert() code = %d, want %d", pErr.Code(), http.StatusBadRequest)
+	}
+	// The table is "test", but errors are labeled by datatype.
+	if pErr.DataType() != string(etl.NDT7) {
+		t.Errorf("ParseAndInsert() datatype = %q, want %q", pErr.DataType(), etl.NDT7)
+	}
+}
@@ -4,8 +4,10 @@ package parser
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"log"
 	"strconv"
 	"strings"
@@ -58,6 +60,9 @@ var fieldPairs = map[string]string{
 var logBadIP = logx.NewLogEvery(nil, 5*time.Second)
 
 func handleIP(connSpec schema.Web100ValueMap, prefix string, ipString string) {
+	// Repair malformed IPv6 addresses, e.g. 2001:::abcd, and convert
+	// IPv4-mapped IPv6 addresses before determining the address family.
+	ipString = NormalizeIP(ipString)
 	connSpec.SetString(prefix+"_ip", ipString)
 	if web100.ValidateIP(ipString) != nil {
 		logBadIP.Printf("Failed parsing connSpec IP: %s\n", ipString)
@@ -190,6 +195,21 @@ func parseMetaFile(rawContent []byte) (map[string]string, error) {
 	return result, nil
 }
 
+// gunzipMeta decompresses the content of a .meta.gz file.  GCSSource
+// already decompresses .gz files, so content without the gzip magic
+// number is returned unchanged.
+func gunzipMeta(content []byte) ([]byte, error) {
+	if len(content) < 2 || content[0] != 0x1f || content[1] != 0x8b {
+		return content, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
 // ProcessMetaFile parses the .meta file.
 // TODO(dev) - add unit tests
 // TODO(prod) - For tests that include a meta file, should respect the test filenames.
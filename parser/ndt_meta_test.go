@@ -86,3 +86,35 @@ func TestMetaParser(t *testing.T) {
 			connSpec["client_os"])
 	}
 }
+
+func TestMetaParserIPv6(t *testing.T) {
+	metaName := `20170509T13:45:13.590210000Z_ipv6.measurementlab.net:53000.meta`
+	metaData, err := ioutil.ReadFile(`testdata/NDTMeta/` + metaName)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	meta := parser.ProcessMetaFile("ndt", metaName, metaData)
+	if meta == nil {
+		t.Fatal("metaFile has not been populated.")
+	}
+	connSpec := schema.EmptyConnectionSpec()
+	meta.PopulateConnSpec(connSpec)
+
+	tests := []struct {
+		prefix string
+		ip     string
+	}{
+		{prefix: "server", ip: "2001:4c08:2003:1::dead:beef"},
+		// The triple colon is repaired.
+		{prefix: "client", ip: "2a01::1234:5678"},
+	}
+	for _, tt := range tests {
+		if connSpec[tt.prefix+"_ip"] != tt.ip {
+			t.Errorf("%s_ip = %v, want %s", tt.prefix, connSpec[tt.prefix+"_ip"], tt.ip)
+		}
+		if connSpec[tt.prefix+"_af"] != int64(syscall.AF_INET6) {
+			t.Errorf("%s_af = %v, want %d", tt.prefix, connSpec[tt.prefix+"_af"], syscall.AF_INET6)
+		}
+	}
+}
@@ -1,17 +1,29 @@
 package parser_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 
 	"github.com/kr/pretty"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/row"
 	"github.com/m-lab/etl/schema"
+	"github.com/m-lab/etl/web100"
+	"github.com/m-lab/go/logx"
 )
 
 func assertNDTTestIsValueSaver(r parser.NDTTest) {
@@ -124,6 +136,12 @@ func TestNDTParser(t *testing.T) {
 
 	// Extract the values saved to the inserter.
 	actualValues := ins.data[0].(parser.NDTTest).Web100ValueMap
+	if _, ok := actualValues["parse_time"].(time.Time); !ok {
+		t.Errorf("parse_time not populated: %v", actualValues["parse_time"])
+	}
+	if actualValues["parser_version"] != parser.Version() {
+		t.Errorf("parser_version = %v, want %q", actualValues["parser_version"], parser.Version())
+	}
 	expectedValues := schema.Web100ValueMap{
 		// echo -n 20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog.gz | openssl dgst -binary -md5 | base64  | tr '/+' '_-' | tr -d '='
 		"id": "nYjSCZhB0EfQPChl2tT8Fg",
@@ -150,6 +168,935 @@ func TestNDTParser(t *testing.T) {
 	}
 }
 
+// The NDT test fixtures used by most of the tests below, and a valid
+// archive name for them.
+const (
+	ndtTaskFile = "gs://mlab-test-bucket/ndt/2017/06/13/20170613T000000Z-mlab3-vie01-ndt-0186.tgz"
+	ndtS2CFile  = `20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`
+	ndtC2SFile  = `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	ndtMetaFile = `20170509T13:45:13.590210000Z_eb.measurementlab.net:53000.meta`
+)
+
+// readNDTFile returns the content of a file in testdata/web100.
+func readNDTFile(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(`testdata/web100/` + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// ndtFile is a test file name and content, as passed to ParseAndInsert.
+type ndtFile struct {
+	name string
+	data []byte
+}
+
+// parseNDTTask parses the files from the taskFile archive with a new NDT
+// parser, and returns the inserted rows.
+func parseNDTTask(t *testing.T, taskFile string, files ...ndtFile) []schema.Web100ValueMap {
+	ins := newInMemoryInserter()
+	n := parser.NewNDTParser(ins, "web100", "")
+	meta := map[string]bigquery.Value{"filename": taskFile}
+	for _, f := range files {
+		if err := n.ParseAndInsert(meta, f.name, f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]schema.Web100ValueMap, len(ins.data))
+	for i := range ins.data {
+		rows[i] = ins.data[i].(parser.NDTTest).Web100ValueMap
+	}
+	return rows
+}
+
+// parseNDT parses the files from the ndtTaskFile archive.
+func parseNDT(t *testing.T, files ...ndtFile) []schema.Web100ValueMap {
+	return parseNDTTask(t, ndtTaskFile, files...)
+}
+
+// parseS2C parses s2c snaplog data, named as the s2c fixture, and returns
+// the single row.
+func parseS2C(t *testing.T, data []byte) schema.Web100ValueMap {
+	rows := parseNDT(t, ndtFile{ndtS2CFile + ".gz", data})
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(rows))
+	}
+	return rows[0]
+}
+
+func TestNDTParserTopLevelTuple(t *testing.T) {
+	rows := parseNDT(t,
+		ndtFile{ndtS2CFile, readNDTFile(t, ndtS2CFile)},
+		ndtFile{ndtMetaFile, readNDTFile(t, ndtMetaFile)})
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(rows))
+	}
+	r := rows[0]
+	snap := r.GetMap([]string{"web100_log_entry", "snap"})
+	want := schema.Web100ValueMap{
+		"server_ip":   snap["LocalAddress"],
+		"server_port": snap["LocalPort"],
+		"client_ip":   snap["RemAddress"],
+		"client_port": snap["RemPort"],
+	}
+	for k, v := range want {
+		if r[k] != v {
+			t.Errorf("%s = %v, want %v", k, r[k], v)
+		}
+	}
+	if r["client_ip"] != "45.56.98.222" || r["client_port"] != int64(44160) {
+		t.Errorf("client tuple = %v:%v, want 45.56.98.222:44160", r["client_ip"], r["client_port"])
+	}
+}
+
+func TestNDTParserTimestamps(t *testing.T) {
+	r := parseS2C(t, readNDTFile(t, ndtS2CFile))
+	// log_time and parse_time have the same canonical representation.
+	logTime, ok := r["log_time"].(time.Time)
+	if !ok {
+		t.Fatalf("log_time = %T, want time.Time", r["log_time"])
+	}
+	parseTime, ok := r["parse_time"].(time.Time)
+	if !ok {
+		t.Fatalf("parse_time = %T, want time.Time", r["parse_time"])
+	}
+	want := time.Date(2017, 5, 9, 13, 45, 13, 590210000, time.UTC)
+	if !logTime.Equal(want) || logTime.Location() != time.UTC {
+		t.Errorf("log_time = %v, want %v", logTime, want)
+	}
+	if parseTime.Location() != time.UTC {
+		t.Errorf("parse_time = %v, want UTC", parseTime)
+	}
+}
+
+func TestNDTParserPartialGroups(t *testing.T) {
+	defer func(drop bool) { etl.DropPartialNDTGroups = drop }(etl.DropPartialNDTGroups)
+	s2cData := readNDTFile(t, ndtS2CFile)
+
+	tests := []struct {
+		name string
+		drop bool
+		want int
+	}{
+		{name: "emit", drop: false, want: 1},
+		{name: "drop", drop: true, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etl.DropPartialNDTGroups = tt.drop
+			// The group has only the s2c file, with no c2s or meta.
+			rows := parseNDT(t, ndtFile{ndtS2CFile + ".gz", s2cData})
+			if len(rows) != tt.want {
+				t.Fatalf("got %d rows, want %d", len(rows), tt.want)
+			}
+			if tt.want == 0 {
+				return
+			}
+			anomalies := rows[0].Get("anomalies")
+			if anomalies["no_meta"] != true {
+				t.Errorf("Partial group row missing no_meta anomaly: %v", anomalies)
+			}
+		})
+	}
+}
+
+func TestNDTParserDeltaStride(t *testing.T) {
+	defer func(stride int) { etl.NDTDeltaStride = stride }(etl.NDTDeltaStride)
+	s2cData := readNDTFile(t, ndtS2CFile)
+
+	etl.NDTDeltaStride = 1
+	all := parseS2C(t, s2cData)
+	allDeltas := all["web100_log_entry"].(schema.Web100ValueMap)["deltas"].([]schema.Web100ValueMap)
+	if _, ok := all.Get("anomalies")["delta_stride"]; ok {
+		t.Error("delta_stride anomaly should not be set without sampling")
+	}
+
+	etl.NDTDeltaStride = 200
+	sampled := parseS2C(t, s2cData)
+	deltas := sampled["web100_log_entry"].(schema.Web100ValueMap)["deltas"].([]schema.Web100ValueMap)
+	if len(deltas) == 0 || len(deltas) >= len(allDeltas) {
+		t.Fatalf("sampled deltas = %d, want fewer than %d", len(deltas), len(allDeltas))
+	}
+	last := deltas[len(deltas)-1]
+	if last["is_last"] != true {
+		t.Errorf("last delta is_last = %v, want true", last["is_last"])
+	}
+	if last["snapshot_num"] != allDeltas[len(allDeltas)-1]["snapshot_num"] {
+		t.Errorf("last snapshot_num = %v, want %v",
+			last["snapshot_num"], allDeltas[len(allDeltas)-1]["snapshot_num"])
+	}
+	if got := sampled.Get("anomalies")["delta_stride"]; got != int64(200) {
+		t.Errorf("delta_stride = %v, want 200", got)
+	}
+}
+
+func TestNDTParserIncludeFinalSnapshot(t *testing.T) {
+	defer func(include bool) { etl.IncludeFinalSnapshot = include }(etl.IncludeFinalSnapshot)
+	s2cData := readNDTFile(t, ndtS2CFile)
+
+	etl.IncludeFinalSnapshot = false
+	if _, ok := parseS2C(t, s2cData).Get("web100_log_entry")["final_snapshot"]; ok {
+		t.Error("final_snapshot should be omitted by default")
+	}
+
+	etl.IncludeFinalSnapshot = true
+	logEntry := parseS2C(t, s2cData).Get("web100_log_entry")
+	final, ok := logEntry["final_snapshot"].(schema.Web100ValueMap)
+	if !ok {
+		t.Fatal("final_snapshot missing")
+	}
+	snap := logEntry.Get("snap")
+	if len(final) != len(snap) {
+		t.Errorf("final_snapshot has %d fields, want %d", len(final), len(snap))
+	}
+	// The final snapshot is not modified by the fix ups applied to snap.
+	if final["StartTimeStamp"] == snap["StartTimeStamp"] {
+		t.Errorf("final_snapshot StartTimeStamp = %v, should be unmodified", final["StartTimeStamp"])
+	}
+	if final["HCThruOctetsAcked"] != snap["HCThruOctetsAcked"] {
+		t.Errorf("final_snapshot HCThruOctetsAcked = %v, want %v",
+			final["HCThruOctetsAcked"], snap["HCThruOctetsAcked"])
+	}
+}
+
+func TestNDTParserGzippedMeta(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(readNDTFile(t, ndtMetaFile))
+	zw.Close()
+
+	rows := parseNDT(t,
+		ndtFile{ndtS2CFile + ".gz", readNDTFile(t, ndtS2CFile)},
+		ndtFile{ndtMetaFile + ".gz", gz.Bytes()})
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(rows))
+	}
+	connSpec := rows[0].Get("connection_spec")
+	if connSpec["server_hostname"] != "mlab3.vie01.measurement-lab.org" {
+		t.Errorf("server_hostname = %v, want mlab3.vie01.measurement-lab.org", connSpec["server_hostname"])
+	}
+}
+
+func TestNDTParserTimestampCollision(t *testing.T) {
+	c2sData := readNDTFile(t, ndtC2SFile)
+	// A distinct test with the same timestamp, but a different port.
+	otherName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48800.c2s_snaplog`
+
+	before := testutil.ToFloat64(metrics.NDTTimestampCollisionCount.WithLabelValues("web100", "c2s"))
+	rows := parseNDT(t,
+		ndtFile{ndtC2SFile + ".gz", c2sData},
+		ndtFile{otherName + ".gz", c2sData})
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	after := testutil.ToFloat64(metrics.NDTTimestampCollisionCount.WithLabelValues("web100", "c2s"))
+	if after-before != 1 {
+		t.Errorf("timestamp collision count = %v, want 1", after-before)
+	}
+
+	first, second := rows[0], rows[1]
+	if first["id"] == second["id"] {
+		t.Errorf("colliding tests share id %v", first["id"])
+	}
+	if _, ok := first.Get("anomalies")["timestamp_collision"]; ok {
+		t.Error("first test should not be flagged as a collision")
+	}
+	if second.Get("anomalies")["timestamp_collision"] != true {
+		t.Error("second test should be flagged as a collision")
+	}
+	if second["test_id"] != otherName+".gz" {
+		t.Errorf("second test_id = %v, want %s", second["test_id"], otherName+".gz")
+	}
+}
+
+func TestNDTParserStateTransitions(t *testing.T) {
+	defer func(orig bool) { etl.NDTStateTransitions = orig }(etl.NDTStateTransitions)
+	etl.NDTStateTransitions = true
+
+	data := readNDTFile(t, ndtS2CFile)
+	snaplog, err := web100.NewSnapLog(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fixture is ESTABLISHED (5) throughout.  Change the state to
+	// CLOSE_WAIT (8) from snapshot 100, and LAST_ACK (9) in the last snapshot.
+	last := snaplog.SnapCount() - 1
+	first, _ := snapFieldRange(t, data, "State", 100)
+	for i := 100; i <= last; i++ {
+		data[first+(i-100)*snaplog.SnapshotNumBytes()] = 8
+	}
+	begin, _ := snapFieldRange(t, data, "State", last)
+	data[begin] = 9
+
+	got := parseS2C(t, data).Get("web100_log_entry")["state_transitions"]
+	want := []schema.Web100ValueMap{
+		{"state": int64(5), "snapshot_num": int64(0)},
+		{"state": int64(8), "snapshot_num": int64(100)},
+		{"state": int64(9), "snapshot_num": int64(last)},
+	}
+	if diff := pretty.Diff(got, want); len(diff) != 0 {
+		t.Errorf("state_transitions = %v, want %v", got, want)
+	}
+}
+
+func TestNDTParserClientIPTransform(t *testing.T) {
+	defer func(f func(string) string) { row.ClientIPTransform = f }(row.ClientIPTransform)
+	row.ClientIPTransform = func(ip string) string { return "0.0.0.0" }
+
+	r := parseS2C(t, readNDTFile(t, ndtS2CFile))
+	for _, path := range [][]string{
+		{"client_ip"},
+		{"connection_spec", "client_ip"},
+		{"web100_log_entry", "connection_spec", "remote_ip"},
+		{"web100_log_entry", "snap", "RemAddress"},
+	} {
+		if got, _ := r.GetString(path); got != "0.0.0.0" {
+			t.Errorf("%v = %q, want %q", path, got, "0.0.0.0")
+		}
+	}
+	if got, _ := r.GetString([]string{"server_ip"}); got == "0.0.0.0" || got == "" {
+		t.Errorf("server_ip = %q, want unchanged", got)
+	}
+	// The test id is the file name, which contains the client hostname.
+	if got, _ := r.GetString([]string{"test_id"}); strings.Contains(got, "eb.measurementlab.net") ||
+		!strings.Contains(got, "Z_0.0.0.0:44160.s2c_snaplog") {
+		t.Errorf("test_id = %q, want client address rewritten", got)
+	}
+}
+
+func TestNDTTestRewriteClientIPs(t *testing.T) {
+	delta := schema.Web100ValueMap{"RemAddress": "1.2.3.4", "Duration": int64(10)}
+	r := parser.NDTTest{Web100ValueMap: schema.Web100ValueMap{
+		"test_id":   "2017/05/09/20170509T13:45:13.590210000Z_client.example.com:44160.s2c_snaplog.gz",
+		"client_ip": "1.2.3.4",
+		"connection_spec": schema.Web100ValueMap{
+			"client_ip":       "1.2.3.4",
+			"client_hostname": "client.example.com",
+		},
+		"web100_log_entry": schema.Web100ValueMap{
+			"deltas": []schema.Web100ValueMap{delta},
+		},
+	}}
+	r.RewriteClientIPs(func(ip string) string { return "0.0.0.0" })
+	if got, _ := r.GetString([]string{"test_id"}); got != "2017/05/09/20170509T13:45:13.590210000Z_0.0.0.0:44160.s2c_snaplog.gz" {
+		t.Errorf("test_id = %q, want client address rewritten", got)
+	}
+	if _, ok := r.GetString([]string{"connection_spec", "client_hostname"}); ok {
+		t.Error("client_hostname was not removed")
+	}
+	if delta["RemAddress"] != "0.0.0.0" {
+		t.Errorf("delta RemAddress = %v, want 0.0.0.0", delta["RemAddress"])
+	}
+}
+
+// snapFieldRange returns the byte range of a field in snapshot n of a raw
+// snaplog.
+func snapFieldRange(t *testing.T, raw []byte, name string, n int) (int, int) {
+	snaplog, err := web100.NewSnapLog(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var field *web100.Variable
+	for _, v := range snaplog.FieldsExcept() {
+		if v.Name == name {
+			field = &v
+			break
+		}
+	}
+	if field == nil {
+		t.Fatalf("%s field not found", name)
+	}
+	bodyOffset := len(raw) - snaplog.SnapCount()*snaplog.SnapshotNumBytes()
+	if string(raw[bodyOffset:bodyOffset+len(web100.BEGIN_SNAP_DATA)]) != web100.BEGIN_SNAP_DATA {
+		t.Fatal("snaplog has a partial final snapshot")
+	}
+	begin := bodyOffset + n*snaplog.SnapshotNumBytes() + len(web100.BEGIN_SNAP_DATA) + field.Offset
+	return begin, begin + field.Size
+}
+
+// setSnapField overwrites a field in every snapshot of a raw snaplog.
+func setSnapField(t *testing.T, raw []byte, name string, value []byte) {
+	snaplog, err := web100.NewSnapLog(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin, end := snapFieldRange(t, raw, name, 0)
+	if len(value) != end-begin {
+		t.Fatalf("%s value has %d bytes, want %d", name, len(value), end-begin)
+	}
+	for i := 0; i < snaplog.SnapCount(); i++ {
+		copy(raw[begin+i*snaplog.SnapshotNumBytes():], value)
+	}
+}
+
+// buildSnapLog returns a synthetic snaplog with the given fields, and three
+// snapshots with increasing Duration and the given values.
+func buildSnapLog(t *testing.T, fields []web100.FieldSpec, values map[string]interface{}, local, remote net.IP) []byte {
+	spec := web100.SnapLogSpec{
+		LogTime: 1494337513,
+		Read: append([]web100.FieldSpec{
+			{Name: "Duration", Type: web100.WEB100_TYPE_COUNTER32},
+			{Name: "State", Type: web100.WEB100_TYPE_INTEGER},
+		}, fields...),
+		LocalIP:  local,
+		RemoteIP: remote,
+	}
+	for i := 1; i <= 3; i++ {
+		snap := map[string]interface{}{"Duration": int64(5000 * i), "State": int64(1)}
+		for k, v := range values {
+			snap[k] = v
+		}
+		spec.Snapshots = append(spec.Snapshots, snap)
+	}
+	raw, err := web100.BuildSnapLog(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestNDTParserIPv6(t *testing.T) {
+	s2cData := readNDTFile(t, ndtS2CFile)
+	port := func(p uint16) []byte {
+		b := make([]byte, 2)
+		binary.LittleEndian.PutUint16(b, p)
+		return b
+	}
+	addr := func(ip string) []byte {
+		return append([]byte(net.ParseIP(ip).To16()), web100.WC_ADDRTYPE_IPV6)
+	}
+	ipv6Type := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ipv6Type, web100.WC_ADDRTYPE_IPV6)
+
+	tests := []struct {
+		name    string
+		fields  map[string][]byte // Snapshot fields to overwrite.
+		strings map[string]string
+		ints    map[string]int64
+	}{
+		{
+			// For ipv4 tests, the ports come from the connection spec.
+			name: "ipv4-ports",
+			fields: map[string][]byte{
+				"LocalPort": port(3010),
+				"RemPort":   port(43210),
+			},
+			ints: map[string]int64{
+				"web100_log_entry.connection_spec.local_port":  40105,
+				"web100_log_entry.connection_spec.remote_port": 44160,
+			},
+		},
+		{
+			// For ipv6 tests, the ports come from the snapshot.
+			name: "ipv6-ports",
+			fields: map[string][]byte{
+				"LocalPort":        port(3010),
+				"RemPort":          port(43210),
+				"LocalAddress":     addr("2001:4860::1"),
+				"RemAddress":       addr("2600:3c03::2"),
+				"LocalAddressType": ipv6Type,
+			},
+			strings: map[string]string{
+				"client_ip": "2600:3c03::2",
+			},
+			ints: map[string]int64{
+				"web100_log_entry.connection_spec.local_port":  3010,
+				"web100_log_entry.connection_spec.remote_port": 43210,
+				"server_port": 3010,
+				"client_port": 43210,
+			},
+		},
+		{
+			// Documentation addresses fail web100.ValidateIP, but for ipv6
+			// tests they are still better than the truncated binary
+			// connection spec.
+			name: "ipv6-addresses",
+			fields: map[string][]byte{
+				"LocalAddress":     addr("2001:db8::1"),
+				"RemAddress":       addr("2001:db8::2"),
+				"LocalAddressType": ipv6Type,
+			},
+			strings: map[string]string{
+				"web100_log_entry.connection_spec.local_ip":  "2001:db8::1",
+				"web100_log_entry.connection_spec.remote_ip": "2001:db8::2",
+				"server_ip": "2001:db8::1",
+				"client_ip": "2001:db8::2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), s2cData...)
+			for name, value := range tt.fields {
+				setSnapField(t, data, name, value)
+			}
+			r := parseS2C(t, data)
+			for path, want := range tt.strings {
+				if got, _ := r.GetString(strings.Split(path, ".")); got != want {
+					t.Errorf("%s = %q, want %q", path, got, want)
+				}
+			}
+			for path, want := range tt.ints {
+				if got, _ := r.GetInt64(strings.Split(path, ".")); got != want {
+					t.Errorf("%s = %d, want %d", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNDTParserAnomalies(t *testing.T) {
+	s2cData := readNDTFile(t, ndtS2CFile)
+	snaplog, err := web100.NewSnapLog(s2cData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncate the snaplog before the first snapshot, leaving only the header.
+	end := bytes.Index(s2cData, []byte(web100.BEGIN_SNAP_DATA))
+	if end < 0 {
+		t.Fatal("no snapshots in test data")
+	}
+	headerOnly := s2cData[:end]
+
+	// Zero the Duration of a snapshot in the middle of the snaplog, so that
+	// Duration decreases.
+	regressed := append([]byte(nil), s2cData...)
+	begin, end := snapFieldRange(t, regressed, "Duration", snaplog.SnapCount()/2)
+	copy(regressed[begin:end], make([]byte, end-begin))
+
+	// Zero the snapshot addresses, and the addresses in the binary
+	// connection spec, which immediately precedes the snapshots.
+	noIPs := append([]byte(nil), s2cData...)
+	for _, name := range []string{"LocalAddress", "RemAddress"} {
+		begin, end := snapFieldRange(t, noIPs, name, 0)
+		setSnapField(t, noIPs, name, make([]byte, end-begin))
+	}
+	connSpec := len(noIPs) - snaplog.SnapCount()*snaplog.SnapshotNumBytes() - 16
+	copy(noIPs[connSpec+4:connSpec+8], make([]byte, 4))
+	copy(noIPs[connSpec+12:connSpec+16], make([]byte, 4))
+
+	// Add trailing bytes to the first record, as if the kernel wrote fields
+	// that the header does not describe.
+	second := len(s2cData) - (snaplog.SnapCount()-1)*snaplog.SnapshotNumBytes()
+	longRecord := append(append(append([]byte(nil), s2cData[:second]...), 0, 0, 0, 0), s2cData[second:]...)
+
+	suspicious := buildSnapLog(t,
+		[]web100.FieldSpec{
+			{Name: "Name", Type: web100.WEB100_TYPE_STR32},
+			{Name: "LocalAddress", Type: web100.WEB100_TYPE_INET_ADDRESS},
+			{Name: "RemAddress", Type: web100.WEB100_TYPE_INET_ADDRESS},
+		},
+		map[string]interface{}{
+			"Name":         "re\001no",
+			"LocalAddress": net.ParseIP("192.0.2.1"),
+			"RemAddress":   net.ParseIP("198.51.100.1"),
+		},
+		net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"))
+
+	// The snapshots have no RemAddress field.
+	missingRemAddress := buildSnapLog(t,
+		[]web100.FieldSpec{
+			{Name: "LocalAddressType", Type: web100.WEB100_TYPE_INTEGER},
+			{Name: "LocalAddress", Type: web100.WEB100_TYPE_INET_ADDRESS_IPV6},
+		},
+		map[string]interface{}{
+			"LocalAddressType": int64(web100.WC_ADDRTYPE_IPV6),
+			"LocalAddress":     net.ParseIP("2001:db8::1"),
+		},
+		net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"))
+
+	unknownVersion := bytes.Replace(s2cData, []byte("2.5.27 201001301335"), []byte("9.9.99 202001301335"), 1)
+
+	tests := []struct {
+		name     string
+		testName string // Defaults to the s2c fixture name.
+		data     []byte
+		withMeta bool // Parse the meta fixture before the snaplog.
+		strict   bool // Value of etl.StrictSnaplogVersion.
+		counter  prometheus.Counter
+		anomaly  string
+		want     bool // Whether the anomaly is set, and the counter incremented.
+		rows     int
+		check    func(t *testing.T, r schema.Web100ValueMap)
+	}{
+		{
+			name:    "consistent-log-time",
+			data:    s2cData,
+			counter: metrics.WarningCount.WithLabelValues("web100", "s2c", "log time mismatch"),
+			anomaly: "time_mismatch",
+			rows:    1,
+		},
+		{
+			name:     "mislabeled-log-time",
+			testName: `20170509T12:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog`,
+			data:     s2cData,
+			counter:  metrics.WarningCount.WithLabelValues("web100", "s2c", "log time mismatch"),
+			anomaly:  "time_mismatch",
+			want:     true,
+			rows:     1,
+		},
+		{
+			name:    "monotonic-duration",
+			data:    s2cData,
+			counter: metrics.WarningCount.WithLabelValues("web100", "s2c", "non-monotonic duration"),
+			anomaly: "non_monotonic_duration",
+			rows:    1,
+		},
+		{
+			name:    "regressed-duration",
+			data:    regressed,
+			counter: metrics.WarningCount.WithLabelValues("web100", "s2c", "non-monotonic duration"),
+			anomaly: "non_monotonic_duration",
+			want:    true,
+			rows:    1,
+		},
+		{
+			name:    "no-snapshots",
+			data:    headerOnly,
+			counter: metrics.WarningCount.WithLabelValues("web100", "s2c", "no snapshots"),
+			want:    true,
+			rows:    1,
+			check: func(t *testing.T, r schema.Web100ValueMap) {
+				if got := r.Get("anomalies")["num_snaps"]; got != 0 {
+					t.Errorf("num_snaps = %v, want 0", got)
+				}
+				logEntry := r.Get("web100_log_entry")
+				if deltas := logEntry["deltas"].([]schema.Web100ValueMap); len(deltas) != 0 {
+					t.Errorf("deltas = %d, want 0", len(deltas))
+				}
+				if ip := logEntry.Get("connection_spec")["remote_ip"]; ip == nil || ip == "" {
+					t.Error("remote_ip should be populated from the snaplog header")
+				}
+			},
+		},
+		{
+			// Counted for the final snapshot, and for each delta.
+			name:    "suspicious-string",
+			data:    suspicious,
+			counter: metrics.WarningCount.WithLabelValues("web100", "s2c", "suspicious string"),
+			anomaly: "suspicious_string",
+			want:    true,
+			rows:    1,
+			check: func(t *testing.T, r schema.Web100ValueMap) {
+				// The value is flagged, but not changed.
+				if got, _ := r.GetString([]string{"web100_log_entry", "snap", "Name"}); got != "re\001no" {
+					t.Errorf("snap.Name = %q, want %q", got, "re\001no")
+				}
+			},
+		},
+		{
+			name:    "ipv6-missing-snap-address",
+			data:    missingRemAddress,
+			anomaly: "missing_snap_address",
+			want:    true,
+			rows:    1,
+			check: func(t *testing.T, r schema.Web100ValueMap) {
+				if got, _ := r.GetString([]string{"web100_log_entry", "connection_spec", "local_ip"}); got != "2001:db8::1" {
+					t.Errorf("local_ip = %q, want %q", got, "2001:db8::1")
+				}
+				// The missing address is not overwritten with an empty string.
+				if got, _ := r.GetString([]string{"web100_log_entry", "connection_spec", "remote_ip"}); got == "" {
+					t.Error("remote_ip is empty")
+				}
+			},
+		},
+		{
+			name:    "unknown-snaplog-version",
+			data:    unknownVersion,
+			counter: metrics.WarningCount.WithLabelValues("web100", "s2c", "unknown snaplog version"),
+			want:    true,
+			rows:    1,
+		},
+		{
+			name:    "unknown-snaplog-version-strict",
+			data:    unknownVersion,
+			strict:  true,
+			counter: metrics.WarningCount.WithLabelValues("web100", "s2c", "unknown snaplog version"),
+			want:    true,
+		},
+		{
+			name:    "record-length-mismatch",
+			data:    longRecord,
+			counter: metrics.ErrorCount.WithLabelValues("web100", "s2c", "record length mismatch"),
+			want:    true,
+		},
+		{
+			name:    "missing-ips",
+			data:    noIPs,
+			counter: metrics.ErrorCount.WithLabelValues("web100", "s2c", "missing client and server ip"),
+			want:    true,
+		},
+		{
+			// The meta file provides the connection spec client IP, so the
+			// row is kept, even though the top level IPs are still missing.
+			name:     "missing-ips-with-meta",
+			data:     noIPs,
+			withMeta: true,
+			counter:  metrics.ErrorCount.WithLabelValues("web100", "s2c", "missing client and server ip"),
+			rows:     1,
+			check: func(t *testing.T, r schema.Web100ValueMap) {
+				if got, _ := r.GetString([]string{"connection_spec", "client_ip"}); got != "45.56.98.222" {
+					t.Errorf("connection_spec.client_ip = %q, want 45.56.98.222", got)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(orig bool) { etl.StrictSnaplogVersion = orig }(etl.StrictSnaplogVersion)
+			etl.StrictSnaplogVersion = tt.strict
+
+			testName := tt.testName
+			if testName == "" {
+				testName = ndtS2CFile
+			}
+			var files []ndtFile
+			if tt.withMeta {
+				files = append(files, ndtFile{ndtMetaFile, readNDTFile(t, ndtMetaFile)})
+			}
+			files = append(files, ndtFile{testName + ".gz", tt.data})
+
+			var before float64
+			if tt.counter != nil {
+				before = testutil.ToFloat64(tt.counter)
+			}
+			rows := parseNDT(t, files...)
+			if len(rows) != tt.rows {
+				t.Fatalf("got %d rows, want %d", len(rows), tt.rows)
+			}
+			if tt.counter != nil {
+				if got := testutil.ToFloat64(tt.counter) - before; (got > 0) != tt.want {
+					t.Errorf("count increased by %v, want increase %t", got, tt.want)
+				}
+			}
+			if len(rows) == 0 {
+				return
+			}
+			if tt.anomaly != "" {
+				if got := rows[0].Get("anomalies")[tt.anomaly] == true; got != tt.want {
+					t.Errorf("anomalies.%s = %t, want %t", tt.anomaly, got, tt.want)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, rows[0])
+			}
+		})
+	}
+}
+
+// recordingLogger is a logx.Logger that records messages instead of logging them.
+type recordingLogger struct {
+	msgs []string
+}
+
+func (rl *recordingLogger) Println(v ...interface{}) {
+	rl.msgs = append(rl.msgs, fmt.Sprintln(v...))
+}
+
+func (rl *recordingLogger) Printf(format string, v ...interface{}) {
+	rl.msgs = append(rl.msgs, fmt.Sprintf(format, v...))
+}
+
+func TestNDTParserRateLimitedLogs(t *testing.T) {
+	tests := []struct {
+		name string
+		file ndtFile
+		want string
+	}{
+		{
+			name: "gunzip",
+			file: ndtFile{ndtMetaFile + ".gz", []byte("\x1f\x8bnot gzip")},
+			want: "Unable to gunzip",
+		},
+		{
+			name: "no-snapshots",
+			file: ndtFile{ndtS2CFile + ".gz", func() []byte {
+				raw := buildSnapLog(t, nil, nil, net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"))
+				return raw[:bytes.Index(raw, []byte(web100.BEGIN_SNAP_DATA))]
+			}()},
+			want: "No snapshots in",
+		},
+		{
+			name: "missing-ips",
+			file: ndtFile{ndtS2CFile + ".gz", buildSnapLog(t, nil, nil, nil, nil)},
+			want: "No client or server IP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &recordingLogger{}
+			defer parser.SetNDTLoggersForTest(rl)()
+			// Nothing should be logged except through the rate limited
+			// loggers.  Repeated warnings are all passed to the rate limiter.
+			out, err := logx.CaptureLog(nil, func() {
+				parseNDT(t, tt.file, tt.file)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(out, tt.want) {
+				t.Errorf("%q logged without rate limiting: %s", tt.want, out)
+			}
+			count := 0
+			for _, msg := range rl.msgs {
+				if strings.Contains(msg, tt.want) {
+					count++
+				}
+			}
+			if count != 2 {
+				t.Errorf("rate limited %q messages = %d, want 2: %q", tt.want, count, rl.msgs)
+			}
+		})
+	}
+}
+
+func TestNDTParserInvalidTaskFileName(t *testing.T) {
+	s2c := ndtFile{ndtS2CFile + ".gz", readNDTFile(t, ndtS2CFile)}
+	meta := ndtFile{ndtMetaFile, readNDTFile(t, ndtMetaFile)}
+
+	tests := []struct {
+		name     string
+		taskFile string
+		files    []ndtFile
+	}{
+		{
+			name:     "host-and-site-in-filename",
+			taskFile: "gs://mlab-test-bucket/ndt/20170613T000000Z-mlab3-vie01-ndt-0186.tgz",
+			files:    []ndtFile{s2c},
+		},
+		{
+			name:     "hostname-from-meta",
+			taskFile: "gs://mlab-test-bucket/not-a-task-file.tgz",
+			files:    []ndtFile{s2c, meta},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(metrics.NDTInvalidTaskFileCount.WithLabelValues("web100"))
+			rows := parseNDTTask(t, tt.taskFile, tt.files...)
+			if len(rows) != 1 {
+				t.Fatalf("got %d rows, want 1", len(rows))
+			}
+			after := testutil.ToFloat64(metrics.NDTInvalidTaskFileCount.WithLabelValues("web100"))
+			if after-before != 1 {
+				t.Errorf("invalid task filename count = %v, want 1", after-before)
+			}
+
+			connSpec := rows[0].Get("connection_spec")
+			if got := connSpec.Get("server")["iata_code"]; got != "VIE" {
+				t.Errorf("iata_code = %v, want VIE", got)
+			}
+			if got := connSpec["server_hostname"]; got != "mlab3.vie01.measurement-lab.org" {
+				t.Errorf("server_hostname = %v, want mlab3.vie01.measurement-lab.org", got)
+			}
+			if got := connSpec.Get("ServerX")["Site"]; got != "vie01" {
+				t.Errorf("ServerX.Site = %v, want vie01", got)
+			}
+		})
+	}
+}
+
+func TestNDTParserInconsistentTaskFileName(t *testing.T) {
+	defer func(split bool) { etl.SplitInconsistentNDTGroups = split }(etl.SplitInconsistentNDTGroups)
+
+	s2cData := readNDTFile(t, ndtS2CFile)
+	c2sData := readNDTFile(t, ndtC2SFile)
+	first := ndtTaskFile
+	second := "gs://mlab-test-bucket/ndt/2017/06/13/20170613T000000Z-mlab3-vie01-ndt-0187.tgz"
+
+	tests := []struct {
+		name  string
+		split bool
+		want  []string // task_filename of the s2c and c2s rows.
+	}{
+		{name: "merge", split: false, want: []string{first, first}},
+		{name: "split", split: true, want: []string{first, second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etl.SplitInconsistentNDTGroups = tt.split
+			before := testutil.ToFloat64(metrics.NDTInconsistentTaskFileCount.WithLabelValues("web100"))
+			ins := newInMemoryInserter()
+			n := parser.NewNDTParser(ins, "web100", "")
+			if err := n.ParseAndInsert(map[string]bigquery.Value{"filename": first}, ndtS2CFile+".gz", s2cData); err != nil {
+				t.Fatal(err)
+			}
+			if err := n.ParseAndInsert(map[string]bigquery.Value{"filename": second}, ndtC2SFile+".gz", c2sData); err != nil {
+				t.Fatal(err)
+			}
+			if err := n.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			after := testutil.ToFloat64(metrics.NDTInconsistentTaskFileCount.WithLabelValues("web100"))
+			if after-before != 1 {
+				t.Errorf("NDTInconsistentTaskFileCount increased by %v, want 1", after-before)
+			}
+			if len(ins.data) != len(tt.want) {
+				t.Fatalf("got %d rows, want %d", len(ins.data), len(tt.want))
+			}
+			for i, r := range ins.data {
+				if got := r.(parser.NDTTest).Web100ValueMap["task_filename"]; got != tt.want[i] {
+					t.Errorf("row %d task_filename = %v, want %s", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNDTGroupAnomalies(t *testing.T) {
+	labels := map[int64]string{
+		0:                      "missing all",
+		parser.NDTGroupHasC2S:  "missing s2c+meta",
+		parser.NDTGroupHasS2C:  "missing c2s+meta",
+		parser.NDTGroupHasMeta: "missing c2s+s2c",
+		parser.NDTGroupHasC2S | parser.NDTGroupHasS2C:  "missing meta",
+		parser.NDTGroupHasC2S | parser.NDTGroupHasMeta: "missing s2c",
+		parser.NDTGroupHasS2C | parser.NDTGroupHasMeta: "missing c2s",
+	}
+	for code, want := range labels {
+		if got := parser.GroupAnomaly(code); got != want {
+			t.Errorf("GroupAnomaly(%d) = %q, want %q", code, got, want)
+		}
+	}
+
+	files := map[int64]ndtFile{
+		parser.NDTGroupHasC2S:  {ndtC2SFile, readNDTFile(t, ndtC2SFile)},
+		parser.NDTGroupHasS2C:  {ndtS2CFile, readNDTFile(t, ndtS2CFile)},
+		parser.NDTGroupHasMeta: {ndtMetaFile, readNDTFile(t, ndtMetaFile)},
+	}
+	// Every combination that produces at least one row.
+	for code := int64(1); code <= parser.NDTGroupComplete; code++ {
+		if code == parser.NDTGroupHasMeta {
+			continue
+		}
+		var group []ndtFile
+		for bit, f := range files {
+			if code&bit != 0 {
+				group = append(group, f)
+			}
+		}
+		rows := parseNDT(t, group...)
+		if len(rows) == 0 {
+			t.Fatalf("code %d: no rows inserted", code)
+		}
+		for _, r := range rows {
+			got, ok := r.Get("anomalies")["group_files"]
+			if code == parser.NDTGroupComplete {
+				if ok {
+					t.Errorf("code %d: complete group has group_files %v", code, got)
+				}
+			} else if got != code {
+				t.Errorf("code %d: group_files = %v", code, got)
+			}
+		}
+	}
+}
+
 // compare recursively checks whether actual values equal values in the expected values.
 // The expected values may be a subset of the actual values, but not a superset.
 func compare(t *testing.T, actual schema.Web100ValueMap, expected schema.Web100ValueMap) bool {
@@ -3,18 +3,25 @@
 package parser
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 
 	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/factory"
 	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/row"
+	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/etl/web100"
+	"github.com/m-lab/go/logx"
 )
 
 func init() {
@@ -59,6 +66,50 @@ func GitCommit() string {
 	return gParserGitCommit
 }
 
+// NewParseInfoV0 returns a legacy ParseInfoV0 stamped with the given parse
+// time and the parser version.
+func NewParseInfoV0(taskFileName, filename string, now time.Time) schema.ParseInfoV0 {
+	return schema.ParseInfoV0{
+		TaskFileName:  taskFileName,
+		ParseTime:     NormalizeTime(now),
+		ParserVersion: Version(),
+		Filename:      filename,
+	}
+}
+
+// StampParseInfo records the given parse time, the parser version, and the
+// test's position within the archive in a map-based row, using the same
+// representation as NewParseInfoV0.
+func StampParseInfo(r schema.Web100ValueMap, now time.Time, offset, size int64) {
+	r["parse_time"] = NormalizeTime(now)
+	r["parser_version"] = Version()
+	r["archive_offset"] = offset
+	r["archive_file_size"] = size
+}
+
+// Legacy metadata keys for the test's position within the archive, from
+// etl.Metadata ArchiveOffset and ArchiveFileSize.
+const (
+	archiveOffsetKey   = "archive_offset"
+	archiveFileSizeKey = "archive_file_size"
+)
+
+// archivePosition returns the test's offset and size within the archive
+// from legacy metadata, or zeros if they are unknown.
+func archivePosition(meta map[string]bigquery.Value) (offset, size int64) {
+	offset, _ = meta[archiveOffsetKey].(int64)
+	size, _ = meta[archiveFileSizeKey].(int64)
+	return offset, size
+}
+
+// NormalizeTime returns the canonical form of a timestamp for a row: UTC,
+// truncated to the microsecond resolution of BigQuery TIMESTAMP columns.
+// Use it wherever a timestamp enters a row, whether from a filename, the test
+// data, or the current time, so that equal instants compare equal.
+func NormalizeTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
 // NormalizeIP accepts an IPv4 or IPv6 address and returns a normalized version
 // of that string. This should be used to fix malformed IPv6 addresses in web100
 // datasets (e.g. 2001:::abcd:2) as well as IPv4-mapped IPv6 addresses (e.g. ::ffff:1.2.3.4).
@@ -74,6 +125,31 @@ func NormalizeIP(ip string) string {
 	return n.String()
 }
 
+// parseIntField parses value as a base 10 int64.  If value is not a valid
+// integer, it counts a warning for field, and returns def, so that a single
+// corrupt number need not discard the whole test.
+func parseIntField(tableName, fileType, field, value string, def int64) int64 {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		metrics.WarningCount.WithLabelValues(
+			tableName, fileType, "corrupt field "+field).Inc()
+		return def
+	}
+	return v
+}
+
+// parseFloatField parses value as a float64, like parseIntField.  If value is
+// not a valid, finite number, it counts a warning for field, and returns def.
+func parseFloatField(tableName, fileType, field, value string, def float64) float64 {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		metrics.WarningCount.WithLabelValues(
+			tableName, fileType, "corrupt field "+field).Inc()
+		return def
+	}
+	return v
+}
+
 // GetHopID creates a unique identifier to join Hop Annotations
 // with traceroute datasets.
 // The same logic exists in traceroute-caller.
@@ -111,6 +187,100 @@ func NewSinkParser(dt etl.DataType, sink row.Sink, table string) etl.Parser {
 	}
 }
 
+// newContentError returns a ProcessingError for test content that cannot be
+// parsed.  Such failures are permanent, so retrying the task will not help.
+func newContentError(dt etl.DataType, detail string, err error) etl.ProcessingError {
+	return factory.NewError(string(dt), detail, http.StatusBadRequest, err)
+}
+
+// legacyParser is implemented by the parsers that take map based metadata.
+type legacyParser interface {
+	IsParsable(testName string, test []byte) (string, bool)
+	ParseAndInsert(meta map[string]bigquery.Value, testName string, test []byte) error
+	Flush() error
+	TableName() string
+	TaskError() error
+	GetStats() row.Stats
+	SetSink(sink row.Sink) row.Sink
+}
+
+// legacyAdapter adapts a legacy parser to the etl.Parser interface.
+type legacyAdapter struct {
+	legacyParser
+}
+
+// ParseAndInsert converts meta to the map based metadata of the legacy parser.
+func (la *legacyAdapter) ParseAndInsert(meta etl.Metadata, testName string, test []byte) error {
+	return la.legacyParser.ParseAndInsert(
+		map[string]bigquery.Value{
+			"filename":         meta.ArchiveURL,
+			archiveOffsetKey:   meta.ArchiveOffset,
+			archiveFileSizeKey: meta.ArchiveFileSize,
+		}, testName, test)
+}
+
+// FullTableName returns the table name, as legacy parsers have no suffix.
+func (la *legacyAdapter) FullTableName() string {
+	return la.TableName()
+}
+
+// RowsInBuffer returns the count of rows currently in the buffer.
+func (la *legacyAdapter) RowsInBuffer() int {
+	return la.GetStats().Pending
+}
+
+// Committed returns the count of rows successfully committed to BQ.
+func (la *legacyAdapter) Committed() int {
+	return la.GetStats().Committed
+}
+
+// Accepted returns the count of all rows received through InsertRow(s)
+func (la *legacyAdapter) Accepted() int {
+	return la.GetStats().Total()
+}
+
+// Failed returns the count of all rows that could not be committed.
+func (la *legacyAdapter) Failed() int {
+	return la.GetStats().Failed
+}
+
+// newLegacyParser creates an etl.Parser for the legacy data types, whose
+// parsers take map based metadata.
+func newLegacyParser(dt etl.DataType, sink row.Sink, table string) etl.Parser {
+	switch dt {
+	case etl.NDT:
+		return &legacyAdapter{NewNDTParser(sink, table, "")}
+	case etl.PT:
+		return &legacyAdapter{NewPTParser(sink, table, "")}
+	case etl.SS:
+		return &legacyAdapter{NewSSParser(sink, table, "")}
+	default:
+		return nil
+	}
+}
+
+type sinkParserFactory struct{}
+
+// Get implements factory.ParserFactory.Get
+func (pf *sinkParserFactory) Get(ctx context.Context, dp etl.DataPath, sink row.Sink, table string) (etl.Parser, etl.ProcessingError) {
+	p := NewSinkParser(dp.GetDataType(), sink, table)
+	if p == nil {
+		p = newLegacyParser(dp.GetDataType(), sink, table)
+	}
+	if p == nil {
+		return nil, factory.NewError(dp.DataType, "InvalidParser",
+			http.StatusBadRequest, etl.ErrBadDataType)
+	}
+	return p, nil
+}
+
+// NewParserFactory returns the default ParserFactory, which creates parsers
+// using NewSinkParser, or for the legacy ndt, traceroute and sidestream data
+// types, by adapting their map based parsers to etl.Parser.
+func NewParserFactory() factory.ParserFactory {
+	return &sinkParserFactory{}
+}
+
 //=====================================================================================
 //                       Parser implementations
 //=====================================================================================
@@ -174,3 +344,26 @@ func ndtWeb100SyntheticUUID(fn string) string {
 func ssSyntheticUUID(id string, start int64, srcIP string, srcPort int64, dstIP string, dstPort int64) string {
 	return base64hash(fmt.Sprintf("%s-%d-%s-%d-%s-%d", id, start, srcIP, srcPort, dstIP, dstPort))
 }
+
+var logUUIDCollision = logx.NewLogEvery(nil, 5*time.Second)
+
+// syntheticUUIDs tracks the synthetic UUIDs generated by a parser within a
+// single task, to detect collisions between distinct tests.
+type syntheticUUIDs map[string]int
+
+// check records id, and returns the id to use for the row.  If id was already
+// seen, the collision is counted, and if etl.DisambiguateSyntheticUUIDs is set,
+// the returned id has a suffix indicating the number of prior collisions.
+func (s syntheticUUIDs) check(table, id, testName string) string {
+	n, seen := s[id]
+	s[id] = n + 1
+	if !seen {
+		return id
+	}
+	metrics.SyntheticUUIDCollisionCount.WithLabelValues(table).Inc()
+	logUUIDCollision.Printf("Synthetic UUID collision: %s for %s\n", id, testName)
+	if etl.DisambiguateSyntheticUUIDs {
+		return fmt.Sprintf("%s-%d", id, n)
+	}
+	return id
+}
@@ -2,15 +2,22 @@
 package parser_test
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/schema"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	pipe "gopkg.in/m-lab/pipe.v3"
 )
 
@@ -79,7 +86,27 @@ func TestNormalizeIP(t *testing.T) {
 		},
 		{
 			name: "success-ipv6-mapped-ipv4",
-			ip:   "::ffff:1.2.3.4", // quad-colon format error, not normalized.
+			ip:   "::ffff:1.2.3.4",
+			want: "1.2.3.4",
+		},
+		{
+			name: "success-ipv6-mapped-ipv4-uppercase",
+			ip:   "::FFFF:1.2.3.4",
+			want: "1.2.3.4",
+		},
+		{
+			name: "success-ipv6-mapped-ipv4-expanded",
+			ip:   "0:0:0:0:0:ffff:1.2.3.4",
+			want: "1.2.3.4",
+		},
+		{
+			name: "success-ipv6-mapped-ipv4-hex",
+			ip:   "::ffff:102:304",
+			want: "1.2.3.4",
+		},
+		{
+			name: "success-ipv6-mapped-ipv4-triple-colon",
+			ip:   ":::ffff:1.2.3.4", // web100 triple-colon format.
 			want: "1.2.3.4",
 		},
 	}
@@ -92,6 +119,113 @@ func TestNormalizeIP(t *testing.T) {
 	}
 }
 
+func TestNormalizeTime(t *testing.T) {
+	want := time.Date(2017, 5, 9, 13, 45, 13, 0, time.UTC)
+	tests := []struct {
+		name string
+		get  func() (time.Time, error)
+	}{
+		{
+			name: "ndt-filename",
+			get: func() (time.Time, error) {
+				info, err := parser.ParseNDTFileName("20170509T13:45:13.000000400Z_eb.measurementlab.net:44160.s2c_snaplog.gz")
+				if err != nil {
+					return time.Time{}, err
+				}
+				return info.Timestamp, nil
+			},
+		},
+		{
+			name: "pt-filename",
+			get: func() (time.Time, error) {
+				return parser.GetLogtime(parser.PTFileName{Name: "20170509T13:45:13Z-98.162.212.214-53849-64.86.132.75-42677.paris"})
+			},
+		},
+		{
+			name: "ss-filename",
+			get: func() (time.Time, error) {
+				return parser.ExtractLogtimeFromFilename("20170509T13:45:13Z_ALL0.web100")
+			},
+		},
+		{
+			name: "local-time-with-nanos",
+			get: func() (time.Time, error) {
+				cest := time.FixedZone("CEST", 2*60*60)
+				return parser.NormalizeTime(time.Date(2017, 5, 9, 15, 45, 13, 999, cest)), nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("time = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseIntField(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		want        int64
+		wantCorrupt float64
+	}{
+		{name: "valid", value: "1234", want: 1234},
+		{name: "negative", value: "-5", want: -5},
+		{name: "empty", value: "", want: 99, wantCorrupt: 1},
+		{name: "float", value: "1.5", want: 99, wantCorrupt: 1},
+		{name: "garbage", value: "abc", want: 99, wantCorrupt: 1},
+		{name: "overflow", value: "99999999999999999999", want: 99, wantCorrupt: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := metrics.WarningCount.WithLabelValues("table", "ss", "corrupt field Foo")
+			before := testutil.ToFloat64(counter)
+			if got := parser.ParseIntField("table", "ss", "Foo", tt.value, 99); got != tt.want {
+				t.Errorf("ParseIntField() = %d, want %d", got, tt.want)
+			}
+			if n := testutil.ToFloat64(counter) - before; n != tt.wantCorrupt {
+				t.Errorf("corrupt field count = %v, want %v", n, tt.wantCorrupt)
+			}
+		})
+	}
+}
+
+func TestParseFloatField(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		want        float64
+		wantCorrupt float64
+	}{
+		{name: "valid", value: "0.298", want: 0.298},
+		{name: "integer", value: "12", want: 12},
+		{name: "empty", value: "", want: -1, wantCorrupt: 1},
+		{name: "garbage", value: "1.2.3", want: -1, wantCorrupt: 1},
+		{name: "overflow", value: "1e999", want: -1, wantCorrupt: 1},
+		{name: "inf", value: "Inf", want: -1, wantCorrupt: 1},
+		{name: "negative-inf", value: "-Inf", want: -1, wantCorrupt: 1},
+		{name: "nan", value: "NaN", want: -1, wantCorrupt: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := metrics.WarningCount.WithLabelValues("table", "pt", "corrupt field rtt")
+			before := testutil.ToFloat64(counter)
+			if got := parser.ParseFloatField("table", "pt", "rtt", tt.value, -1); got != tt.want {
+				t.Errorf("ParseFloatField() = %v, want %v", got, tt.want)
+			}
+			if n := testutil.ToFloat64(counter) - before; n != tt.wantCorrupt {
+				t.Errorf("corrupt field count = %v, want %v", n, tt.wantCorrupt)
+			}
+		})
+	}
+}
+
 func TestGetHopID(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -183,6 +317,162 @@ func TestPlumbing(t *testing.T) {
 	}
 }
 
+func TestParserFactory(t *testing.T) {
+	tests := []struct {
+		name      string
+		uri       string
+		wantType  string
+		wantTable string
+		wantErr   bool
+	}{
+		{
+			name:     "ndt7",
+			uri:      "gs://fake-bucket/ndt/ndt7/2020/03/18/20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz",
+			wantType: "*parser.NDT7ResultParser",
+		},
+		{
+			name:     "scamper1",
+			uri:      "gs://fake-bucket/ndt/scamper1/2021/09/14/20210914T000000.000000Z-scamper1-mlab1-lga03-ndt.tgz",
+			wantType: "*parser.Scamper1Parser",
+		},
+		{
+			name:      "legacy-ndt",
+			uri:       "gs://fake-bucket/ndt/2017/06/13/20170613T000000Z-mlab3-vie01-ndt-0186.tgz",
+			wantType:  "*parser.legacyAdapter",
+			wantTable: "ndt",
+		},
+		{
+			name:      "legacy-pt",
+			uri:       "gs://fake-bucket/paris-traceroute/2017/03/20/20170320T000000Z-mlab1-lax05-paris-traceroute-0000.tgz",
+			wantType:  "*parser.legacyAdapter",
+			wantTable: "traceroute",
+		},
+		{
+			name:      "legacy-sidestream",
+			uri:       "gs://fake-bucket/sidestream/2019/11/20/20191120T010010Z-mlab1-ord03-sidestream-0000.tgz",
+			wantType:  "*parser.legacyAdapter",
+			wantTable: "sidestream",
+		},
+	}
+	pf := parser.NewParserFactory()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dp, err := etl.ValidateTestPath(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, pErr := pf.Get(context.Background(), dp, newInMemorySink(), dp.TableBase())
+			if (pErr != nil) != tt.wantErr {
+				t.Fatalf("ParserFactory.Get() error = %v, wantErr %t", pErr, tt.wantErr)
+			}
+			if tt.wantErr {
+				if pErr.Code() != http.StatusBadRequest {
+					t.Errorf("ParserFactory.Get() code = %d, want %d", pErr.Code(), http.StatusBadRequest)
+				}
+				return
+			}
+			if got := fmt.Sprintf("%T", p); got != tt.wantType {
+				t.Errorf("ParserFactory.Get() = %s, want %s", got, tt.wantType)
+			}
+			if tt.wantTable != "" && p.FullTableName() != tt.wantTable {
+				t.Errorf("FullTableName() = %q, want %q", p.FullTableName(), tt.wantTable)
+			}
+		})
+	}
+
+	// ValidateTestPath rejects unknown data types, so use a DataPath directly.
+	_, pErr := pf.Get(context.Background(), etl.DataPath{DataType: "foobar"}, newInMemorySink(), "table")
+	if pErr == nil || pErr.Code() != http.StatusBadRequest {
+		t.Errorf("ParserFactory.Get() error = %v, want %d", pErr, http.StatusBadRequest)
+	}
+}
+
+func TestParseSingle(t *testing.T) {
+	tests := []struct {
+		name       string
+		archiveURL string
+		file       string
+		wantType   string
+	}{
+		{
+			name:       "ndt",
+			archiveURL: "gs://mlab-test-bucket/ndt/2017/06/13/20170613T000000Z-mlab3-vie01-ndt-0186.tgz",
+			file:       "testdata/web100/20170509T13:45:13.590210000Z_eb.measurementlab.net:44160.s2c_snaplog",
+			wantType:   "parser.NDTTest",
+		},
+		{
+			name:       "pt",
+			archiveURL: "gs://mlab-test-bucket/paris-traceroute/2019/08/25/20190825T000138Z-mlab1-lga03-paris-traceroute-0000.tgz",
+			file:       "testdata/PT/20190825T000138Z_ndt-plh7v_1566050090_000000000004D64D.jsonl",
+			wantType:   "*schema.PTTest",
+		},
+	}
+	pf := parser.NewParserFactory()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := ioutil.ReadFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dp, err := etl.ValidateTestPath(tt.archiveURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ins := newInMemorySink()
+			p, pErr := pf.Get(context.Background(), dp, ins, dp.TableBase())
+			if pErr != nil {
+				t.Fatal(pErr)
+			}
+			rows, err := parser.ParseSingle(p, filepath.Base(tt.file), content)
+			if err != nil {
+				t.Fatalf("ParseSingle() error = %v", err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("ParseSingle() returned %d rows, want 1", len(rows))
+			}
+			if got := fmt.Sprintf("%T", rows[0]); got != tt.wantType {
+				t.Errorf("ParseSingle() row type = %s, want %s", got, tt.wantType)
+			}
+			if len(ins.data) != 0 {
+				t.Errorf("ParseSingle() wrote %d rows to the parser's sink, want 0", len(ins.data))
+			}
+		})
+	}
+}
+
+func TestParserFactoryLegacyParse(t *testing.T) {
+	archive := "gs://fake-bucket/paris-traceroute/2017/03/20/20170320T000000Z-mlab1-lax05-paris-traceroute-0000.tgz"
+	dp, err := etl.ValidateTestPath(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := newInMemorySink()
+	p, pErr := parser.NewParserFactory().Get(context.Background(), dp, sink, dp.TableBase())
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	fn := "testdata/PT/20171208T00:00:14Z-76.227.226.149-37156-173.205.3.37-52156.paris"
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.IsParsable(fn, data); !ok {
+		t.Fatalf("IsParsable(%q) = false, want true", fn)
+	}
+	if err := p.ParseAndInsert(etl.Metadata{ArchiveURL: archive}, fn, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Committed() != 1 || len(sink.data) != 1 {
+		t.Fatalf("Committed() = %d, want 1", p.Committed())
+	}
+	if got := sink.data[0].(*schema.PTTest).Parseinfo.TaskFileName; got != archive {
+		t.Errorf("TaskFileName = %q, want %q", got, archive)
+	}
+}
+
 func TestMain(m *testing.M) {
 	p := pipe.Script(
 		"unpacking testdata files",
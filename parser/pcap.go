@@ -148,13 +148,15 @@ func (p *PCAPParser) ParseAndInsert(meta etl.Metadata, testName string, rawConte
 
 	row := schema.PCAPRow{
 		Parser: schema.ParseInfo{
-			Version:     meta.Version,
-			Time:        time.Now(),
-			ArchiveURL:  meta.ArchiveURL,
-			Filename:    testName,
-			GitCommit:   meta.GitCommit,
-			ArchiveSize: meta.ArchiveSize,
-			FileSize:    int64(len(rawContent)),
+			Version:         meta.Version,
+			Time:            NormalizeTime(p.Now()),
+			ArchiveURL:      meta.ArchiveURL,
+			Filename:        testName,
+			GitCommit:       meta.GitCommit,
+			ArchiveSize:     meta.ArchiveSize,
+			FileSize:        int64(len(rawContent)),
+			ArchiveOffset:   meta.ArchiveOffset,
+			ArchiveFileSize: meta.ArchiveFileSize,
 		},
 	}
 
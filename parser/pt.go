@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +22,7 @@ import (
 	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/row"
 	"github.com/m-lab/etl/schema"
+	"github.com/m-lab/go/logx"
 	"github.com/m-lab/traceroute-caller/hopannotation"
 )
 
@@ -47,7 +49,11 @@ func GetLogtime(filename PTFileName) (time.Time, error) {
 		return time.Time{}, errors.New("no date in filename")
 	}
 
-	return time.Parse("20060102T150405Z", date)
+	t, err := time.Parse("20060102T150405Z", date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return NormalizeTime(t), nil
 }
 
 // -------------------------------------------------
@@ -133,6 +139,10 @@ type TracelbLine struct {
 	Nodec        float64       `json:"nodec"`
 	Linkc        float64       `json:"linkc"`
 	Nodes        []ScamperNode `json:"nodes"`
+	// Only present in scamper output for traces that record why they
+	// ended, e.g. "COMPLETED" or "HALTED".
+	Stop_reason string  `json:"stop_reason"`
+	Stop_data   float64 `json:"stop_data"`
 }
 
 type CyclestopLine struct {
@@ -144,9 +154,9 @@ type CyclestopLine struct {
 }
 
 // ParsonPT the json test file into schema.PTTest
+// The caller sets Parseinfo.ParseTime, from the parser's clock.
 func ParsePT(testName string, rawContent []byte, tableName string, taskFilename string) (schema.PTTest, error) {
-	metrics.WorkerState.WithLabelValues(tableName, "pt-json-parse").Inc()
-	defer metrics.WorkerState.WithLabelValues(tableName, "pt-json-parse").Dec()
+	defer metrics.TrackWorkerState(tableName, "pt-json-parse")()
 
 	// Get the logtime
 	logTime, err := GetLogtime(PTFileName{Name: filepath.Base(testName)})
@@ -165,12 +175,7 @@ func ParsePT(testName string, rawContent []byte, tableName string, taskFilename
 		return schema.PTTest{}, errors.New("corrupted json content")
 	}
 
-	parseInfo := schema.ParseInfoV0{
-		TaskFileName:  taskFilename,
-		ParseTime:     time.Now(),
-		ParserVersion: Version(),
-		Filename:      testName,
-	}
+	parseInfo := NewParseInfoV0(taskFilename, testName, time.Time{})
 
 	ptTest.Parseinfo = parseInfo
 	ptTest.TestTime = logTime
@@ -178,10 +183,36 @@ func ParsePT(testName string, rawContent []byte, tableName string, taskFilename
 	return ptTest, nil
 }
 
+// Bounds for scamper values that are converted to int64 columns.  Values
+// outside these ranges come from corrupt input, and are clamped.
+const (
+	maxTTL       = 255
+	maxFlowid    = 65535
+	maxProbeSize = 65535
+	maxProbec    = 1 << 20
+)
+
+// clampRange returns v limited to [0, max], and counts a warning for field
+// when v is out of range.
+func clampRange(v float64, max int64, tableName, field string) int64 {
+	switch {
+	case v < 0:
+		metrics.WarningCount.WithLabelValues(tableName, "pt", "out of range "+field).Inc()
+		return 0
+	case v > float64(max):
+		metrics.WarningCount.WithLabelValues(tableName, "pt", "out of range "+field).Inc()
+		return max
+	}
+	return int64(v)
+}
+
+// logEmptyTrace rate limits logging of scamper traces without nodes.
+var logEmptyTrace = logx.NewLogEvery(nil, 5*time.Second)
+
 // ParseJSONL the raw jsonl test file into schema.PTTest.
+// The caller sets Parseinfo.ParseTime, from the parser's clock.
 func ParseJSONL(testName string, rawContent []byte, tableName string, taskFilename string) (schema.PTTest, error) {
-	metrics.WorkerState.WithLabelValues(tableName, "pt-json-parse").Inc()
-	defer metrics.WorkerState.WithLabelValues(tableName, "pt-json-parse").Dec()
+	defer metrics.TrackWorkerState(tableName, "pt-json-parse")()
 
 	// Get the logtime
 	logTime, err := GetLogtime(PTFileName{Name: filepath.Base(testName)})
@@ -206,20 +237,33 @@ func ParseJSONL(testName string, rawContent []byte, tableName string, taskFilena
 		return schema.PTTest{}, errors.New("Invalid test")
 	}
 
-	// Parse the first line for meta info.
+	// Parse the first line for meta info.  Some early stage tests only have
+	// the UUID field in this meta line, so if the full meta line does not
+	// unmarshal, fall back to just the UUID before declaring it corrupt.
 	err = json.Unmarshal([]byte(jsonStrings[0]), &meta)
 	if err != nil {
+		meta = Metadata{}
+		var minimal struct{ UUID string }
+		if json.Unmarshal([]byte(jsonStrings[0]), &minimal) != nil {
+			metrics.ErrorCount.WithLabelValues(
+				tableName, "pt", "corrupted json content").Inc()
+			metrics.TestTotal.WithLabelValues(
+				tableName, "pt", "corrupted json content").Inc()
+			return schema.PTTest{}, errors.New("corrupted meta line")
+		}
+		meta.UUID = minimal.UUID
+	}
+	if meta.UUID == "" {
 		metrics.ErrorCount.WithLabelValues(
-			tableName, "pt", "corrupted json content").Inc()
+			tableName, "pt", "empty UUID").Inc()
 		metrics.TestTotal.WithLabelValues(
-			tableName, "pt", "corrupted json content").Inc()
+			tableName, "pt", "empty UUID").Inc()
 		return schema.PTTest{}, errors.New("empty UUID")
 	}
 	uuid = meta.UUID
 	version = meta.TracerouteCallerVersion
 	resultFromCache = meta.CachedResult
 
-	// Some early stage tests only has UUID field in this meta line.
 	err = json.Unmarshal([]byte(jsonStrings[1]), &cycleStart)
 	if err != nil {
 		metrics.ErrorCount.WithLabelValues(
@@ -247,12 +291,22 @@ func ParseJSONL(testName string, rawContent []byte, tableName string, taskFilena
 			return schema.PTTest{}, err
 		}
 	}
+	// A trace with no nodes is valid, but should be distinguishable from a
+	// parse failure.
+	emptyTrace := len(tracelb.Nodes) == 0
+	if emptyTrace {
+		metrics.WarningCount.WithLabelValues(
+			tableName, "pt", "empty trace").Inc()
+		logEmptyTrace.Printf("No nodes in tracelb for %s in %s", testName, taskFilename)
+	}
 	for i, _ := range tracelb.Nodes {
 		oneNode := &tracelb.Nodes[i]
+		qTTL := clampRange(float64(oneNode.Q_ttl), maxTTL, tableName, "q_ttl")
+		addr := NormalizeIP(oneNode.Addr)
 		var links []schema.HopLink
 		if len(oneNode.Links) == 0 {
 			hops = append(hops, schema.ScamperHop{
-				Source: schema.HopIP{IP: oneNode.Addr, Hostname: oneNode.Hostname},
+				Source: schema.HopIP{IP: addr, Hostname: oneNode.Hostname, QTTL: qTTL},
 				Linkc:  oneNode.Linkc,
 			})
 			continue
@@ -266,20 +320,30 @@ func ParseJSONL(testName string, rawContent []byte, tableName string, taskFilena
 			var ttl int64
 			for _, oneProbe := range oneLink.Probes {
 				var rtt []float64
+				var replies []schema.HopReply
 				for _, oneReply := range oneProbe.Replies {
 					rtt = append(rtt, oneReply.Rtt)
+					replies = append(replies, schema.HopReply{
+						ICMPType: int64(oneReply.Icmp_type),
+						ICMPCode: int64(oneReply.Icmp_code),
+						ICMPQTOS: int64(oneReply.Icmp_q_tos),
+						ICMPQTTL: int64(oneReply.Icmp_q_ttl),
+					})
 				}
-				probes = append(probes, schema.HopProbe{Flowid: int64(oneProbe.Flowid), Rtt: rtt})
-				ttl = int64(oneProbe.Ttl)
+				flowid := clampRange(float64(oneProbe.Flowid), maxFlowid, tableName, "flowid")
+				probes = append(probes, schema.HopProbe{Flowid: flowid, Rtt: rtt, Replies: replies})
+				ttl = clampRange(float64(oneProbe.Ttl), maxTTL, tableName, "ttl")
 			}
-			links = append(links, schema.HopLink{HopDstIP: oneLink.Addr, TTL: ttl, Probes: probes})
+			links = append(links, schema.HopLink{HopDstIP: NormalizeIP(oneLink.Addr), TTL: ttl, Probes: probes})
 		}
 
+		// The hop ID must match the one traceroute-caller generates from the
+		// raw scamper address, so it is not normalized.
 		hopID := GetHopID(cycleStart.Start_time, cycleStart.Hostname, oneNode.Addr)
 		hopAnn := &hopannotation.HopAnnotation1{ID: hopID, Timestamp: time.Unix(int64(cycleStart.Start_time), 0).UTC()}
 		hops = append(hops, schema.ScamperHop{
-			Source: schema.HopIP{IP: oneNode.Addr, Hostname: oneNode.Hostname,
-				HopAnnotation1: hopAnn},
+			Source: schema.HopIP{IP: addr, Hostname: oneNode.Hostname,
+				QTTL: qTTL, HopAnnotation1: hopAnn},
 			Linkc: oneNode.Linkc,
 			Links: links,
 		})
@@ -294,27 +358,38 @@ func ParseJSONL(testName string, rawContent []byte, tableName string, taskFilena
 		return schema.PTTest{}, err
 	}
 
-	parseInfo := schema.ParseInfoV0{
-		TaskFileName:  taskFilename,
-		ParseTime:     time.Now(),
-		ParserVersion: Version(),
-		Filename:      testName,
+	// The cycle id ties together traces from the same scamper cycle, which
+	// may be split across files.  The start and stop lines should agree.
+	cycleID := int64(cycleStart.ID)
+	if cycleID == 0 {
+		cycleID = int64(cycleStop.ID)
+	} else if cycleStop.ID != 0 && int64(cycleStop.ID) != cycleID {
+		metrics.WarningCount.WithLabelValues(
+			tableName, "pt", "cycle id mismatch").Inc()
 	}
 
+	parseInfo := NewParseInfoV0(taskFilename, testName, time.Time{})
+
 	return schema.PTTest{
 		UUID:           uuid,
 		TestTime:       logTime,
 		Parseinfo:      parseInfo,
 		StartTime:      int64(cycleStart.Start_time),
 		StopTime:       int64(cycleStop.Stop_time),
+		StopReason:     tracelb.Stop_reason,
+		StopData:       int64(tracelb.Stop_data),
 		ScamperVersion: tracelb.Version,
 		Source:         schema.ServerInfo{IP: NormalizeIP(tracelb.Src)},
 		Destination:    schema.ClientInfo{IP: NormalizeIP(tracelb.Dst)},
-		ProbeSize:      int64(tracelb.Probe_size),
-		ProbeC:         int64(tracelb.Probec),
+		ProbeSize:      clampRange(tracelb.Probe_size, maxProbeSize, tableName, "probe_size"),
+		ProbeC:         clampRange(tracelb.Probec, maxProbec, tableName, "probec"),
 		Hop:            hops,
 		ExpVersion:     version,
 		CachedResult:   resultFromCache,
+		EmptyTrace:     emptyTrace,
+		ListName:       cycleStart.List_name,
+		UserID:         int64(tracelb.Userid),
+		CycleID:        cycleID,
 	}, nil
 }
 
@@ -333,6 +408,16 @@ type cachedPTData struct {
 	LastValidHopLine string
 	MetroName        string
 	UUID             string
+	// Size is the raw content size of the test, used to bound the memory
+	// held by previousTests.
+	Size int
+	// Degenerate is true when the source and destination IPs are the same.
+	Degenerate bool
+	// Buffered is when the test was added to previousTests.
+	Buffered time.Time
+	// ArchiveOffset and ArchiveFileSize locate the test within the archive.
+	ArchiveOffset   int64
+	ArchiveFileSize int64
 }
 
 type PTParser struct {
@@ -341,7 +426,10 @@ type PTParser struct {
 	// Care should be taken to ensure this does not accumulate many rows and
 	// lead to OOM problems.
 	previousTests []cachedPTData
+	bufferedBytes int    // Total Size of all tests in previousTests.
 	taskFileName  string // The tar file containing these tests.
+
+	uuids syntheticUUIDs // Synthetic UUIDs generated in this task.
 }
 
 type Node struct {
@@ -368,6 +456,7 @@ func NewPTParser(sink row.Sink, table, suffix string) *PTParser {
 	return &PTParser{
 		Base:  row.NewBase(table, sink, bufSize),
 		table: table,
+		uuids: syntheticUUIDs{},
 	}
 }
 
@@ -388,8 +477,9 @@ func ProcessAllNodes(allNodes []Node, server_IP, protocol string, tableName stri
 		probes := make([]schema.HopProbe, 0, 1)
 		probes = append(probes, oneProbe)
 		hopLink := schema.HopLink{
-			HopDstIP: allNodes[i].ip,
-			Probes:   probes,
+			HopDstIP:       allNodes[i].ip,
+			HopDstHostname: allNodes[i].hostname,
+			Probes:         probes,
 		}
 		links := make([]schema.HopLink, 0, 1)
 		links = append(links, hopLink)
@@ -442,6 +532,38 @@ func Unique(oneNode Node, list []Node) bool {
 	return true
 }
 
+// PTProtocols are the paris-traceroute protocols accepted in the first line.
+// Lines with any other protocol are rejected.
+var PTProtocols = map[string]bool{
+	"icmp": true,
+	"udp":  true,
+	"tcp":  true,
+}
+
+// PTAlgorithms are the paris-traceroute algorithms accepted in the first line.
+// Lines with any other algorithm are rejected.
+var PTAlgorithms = map[string]bool{
+	"exhaustive": true,
+	"hopbyhop":   true,
+	"mda":        true,
+	"mda-lite":   true,
+}
+
+// unmapIPv4 returns the plain IPv4 form of an IPv4-mapped IPv6 address (e.g.
+// ::ffff:1.2.3.4 becomes 1.2.3.4), and returns all other strings unchanged.
+// Unlike NormalizeIP, IPv6 addresses keep their original spelling, so callers
+// that search raw test lines for the address still find it.
+func unmapIPv4(ip string) string {
+	if !strings.Contains(ip, ":") {
+		return ip
+	}
+	n := net.ParseIP(ip)
+	if n == nil || n.To4() == nil {
+		return ip
+	}
+	return n.String()
+}
+
 // Handle the first line, like
 // "traceroute [(64.86.132.76:33461) -> (98.162.212.214:53849)], protocol icmp, algo exhaustive, duration 19 s"
 func ParseFirstLine(oneLine string) (protocol string, destIP string, serverIP string, err error) {
@@ -467,22 +589,24 @@ func ParseFirstLine(oneLine string) (protocol string, destIP string, serverIP st
 			if net.ParseIP(serverIP) == nil || net.ParseIP(destIP) == nil {
 				return "", "", "", errors.New("Invalid IP address in the first line.")
 			}
+			serverIP = unmapIPv4(serverIP)
+			destIP = unmapIPv4(destIP)
 			continue
 		}
 		mm := strings.Split(strings.TrimSpace(part), " ")
 		if len(mm) > 1 {
 			if mm[0] == "algo" {
-				if mm[1] != "exhaustive" {
-					log.Printf("Unexpected algorithm")
+				if !PTAlgorithms[mm[1]] {
+					log.Printf("Unknown algorithm")
+					return "", "", "", errors.New("Unknown algorithm")
 				}
 			}
 			if mm[0] == "protocol" {
-				if mm[1] != "icmp" && mm[1] != "udp" && mm[1] != "tcp" {
+				if !PTProtocols[mm[1]] {
 					log.Printf("Unknown protocol")
 					return "", "", "", errors.New("Unknown protocol")
-				} else {
-					protocol = mm[1]
 				}
+				protocol = mm[1]
 			}
 		}
 	}
@@ -498,12 +622,9 @@ func (pt *PTParser) TableName() string {
 }
 
 func (pt *PTParser) InsertOneTest(oneTest cachedPTData) {
-	parseInfo := schema.ParseInfoV0{
-		TaskFileName:  pt.taskFileName,
-		ParseTime:     time.Now(),
-		ParserVersion: Version(),
-		Filename:      oneTest.TestID,
-	}
+	parseInfo := NewParseInfoV0(pt.taskFileName, oneTest.TestID, pt.Now())
+	parseInfo.ArchiveOffset = oneTest.ArchiveOffset
+	parseInfo.ArchiveFileSize = oneTest.ArchiveFileSize
 
 	ptTest := schema.PTTest{
 		UUID:        oneTest.UUID,
@@ -512,6 +633,10 @@ func (pt *PTParser) InsertOneTest(oneTest cachedPTData) {
 		Source:      oneTest.Source,
 		Destination: oneTest.Destination,
 		Hop:         oneTest.Hops,
+		Degenerate:  oneTest.Degenerate,
+	}
+	if etl.PTForwardHops {
+		ptTest.Hop = forwardHops(oneTest.Hops)
 	}
 	// ArchiveURL must already be valid, so error is safe to ignore.
 	dp, _ := etl.ValidateTestPath(pt.taskFileName)
@@ -525,13 +650,27 @@ func (pt *PTParser) InsertOneTest(oneTest cachedPTData) {
 	}
 }
 
+// forwardHops returns a copy of hops in forward order.  ProcessAllNodes
+// builds hops from the destination back to the source, and the pollution
+// check relies on Hops[0] being the final hop, so only the emitted row is
+// reordered.
+func forwardHops(hops []schema.ScamperHop) []schema.ScamperHop {
+	forward := make([]schema.ScamperHop, len(hops))
+	for i, hop := range hops {
+		forward[len(hops)-1-i] = hop
+	}
+	return forward
+}
+
 // Insert last several tests in previousTests
 func (pt *PTParser) ProcessLastTests() error {
 	for _, oneTest := range pt.previousTests {
+		metrics.PTTestStatusCount.WithLabelValues(oneTest.MetroName, "not_reached").Inc()
 		pt.InsertOneTest(oneTest)
 	}
 
 	pt.previousTests = []cachedPTData{}
+	pt.bufferedBytes = 0
 	return nil
 }
 
@@ -558,8 +697,7 @@ func (pt *PTParser) NumBufferedTests() int {
 
 // IsParsable returns the canonical test type and whether to parse data.
 func (pt *PTParser) IsParsable(testName string, data []byte) (string, bool) {
-	if strings.HasSuffix(testName, ".paris") || strings.HasSuffix(testName, ".jsonl") ||
-		strings.HasSuffix(testName, ".json") {
+	if etl.PT.HasParsableSuffix(testName) {
 		return "paris", true
 	}
 	return "unknown", false
@@ -567,8 +705,7 @@ func (pt *PTParser) IsParsable(testName string, data []byte) (string, bool) {
 
 // ParseAndInsert parses a paris-traceroute log file and inserts results into a single row.
 func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName string, rawContent []byte) error {
-	metrics.WorkerState.WithLabelValues(pt.TableName(), "pt").Inc()
-	defer metrics.WorkerState.WithLabelValues(pt.TableName(), "pt").Dec()
+	defer metrics.TrackWorkerState(pt.TableName(), "pt")()
 	testId := filepath.Base(testName)
 	if meta["filename"] != nil {
 		testId = CreateTestId(meta["filename"].(string), filepath.Base(testName))
@@ -576,11 +713,15 @@ func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 	} else {
 		return errors.New("empty filename")
 	}
+	offset, size := archivePosition(meta)
 
 	// Process json output from traceroute-caller
 	if strings.HasSuffix(testName, ".json") {
 		ptTest, err := ParsePT(testName, rawContent, pt.TableName(), pt.taskFileName)
 		if err == nil {
+			ptTest.Parseinfo.ParseTime = NormalizeTime(pt.Now())
+			ptTest.Parseinfo.ArchiveOffset = offset
+			ptTest.Parseinfo.ArchiveFileSize = size
 			err = pt.Put(&ptTest)
 		} else {
 			// Modify metrics
@@ -597,6 +738,9 @@ func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 		if err == nil {
 			ptTest.ServerX.Site = dp.Site
 			ptTest.ServerX.Machine = dp.Host
+			ptTest.Parseinfo.ParseTime = NormalizeTime(pt.Now())
+			ptTest.Parseinfo.ArchiveOffset = offset
+			ptTest.Parseinfo.ArchiveFileSize = size
 
 			err = pt.Put(&ptTest)
 		} else {
@@ -622,9 +766,20 @@ func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 		// Empty test, no further action.
 		return nil
 	}
+	cachedTest.ArchiveOffset = offset
+	cachedTest.ArchiveFileSize = size
 
 	// Since this is a .paris file, we create a synthetic UUID for joining with annotations.
-	cachedTest.UUID = ptSyntheticUUID(cachedTest.LogTime, cachedTest.Source.IP, cachedTest.Destination.IP)
+	cachedTest.UUID = pt.uuids.check(pt.TableName(),
+		ptSyntheticUUID(cachedTest.LogTime, cachedTest.Source.IP, cachedTest.Destination.IP), testName)
+
+	// A test whose source and destination are the same can neither detect
+	// nor suffer pollution, so insert it without checking the buffer.
+	if cachedTest.Degenerate {
+		metrics.PTTestStatusCount.WithLabelValues(cachedTest.MetroName, "degenerate").Inc()
+		pt.InsertOneTest(cachedTest)
+		return nil
+	}
 
 	// Check all buffered PT tests whether Client_ip in connSpec appear in
 	// the last hop of the buffered test.
@@ -640,6 +795,8 @@ func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 			(finalHop.Links[0].HopDstIP == destIP || strings.Contains(PTTest.LastValidHopLine, destIP)) {
 			// Discard pt.previousTests[index]
 			metrics.PTPollutedCount.WithLabelValues(pt.previousTests[index].MetroName).Inc()
+			metrics.PTTestStatusCount.WithLabelValues(pt.previousTests[index].MetroName, "polluted").Inc()
+			pt.bufferedBytes -= pt.previousTests[index].Size
 			pt.previousTests = append(pt.previousTests[:index], pt.previousTests[index+1:]...)
 			break
 		}
@@ -654,72 +811,124 @@ func (pt *PTParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 	// Also we don't care about test LogTime order, since there are other
 	// workers inserting other blocks of hops concurrently.
 	if cachedTest.LastValidHopLine == "ExpectedDestIP" {
+		metrics.PTTestStatusCount.WithLabelValues(cachedTest.MetroName, "reached").Inc()
 		pt.InsertOneTest(cachedTest)
 		return nil
 	}
 
 	// If buffer is full, remove the oldest test and insert it into BigQuery table.
 	if len(pt.previousTests) >= PTBufferSize {
-		// Insert the oldest test pt.previousTests[0] into BigQuery
-		pt.InsertOneTest(pt.previousTests[0])
-		pt.previousTests = pt.previousTests[1:]
+		pt.insertOldestTest()
 	}
 	// Insert current test into pt.previousTests
+	cachedTest.Size = len(rawContent)
+	cachedTest.Buffered = pt.Now()
 	pt.previousTests = append(pt.previousTests, cachedTest)
+	pt.bufferedBytes += cachedTest.Size
+
+	// If the buffer holds too many bytes, insert the oldest tests even though
+	// they have not been checked for pollution, regardless of PTBufferSize.
+	if etl.PTBufferMaxBytes > 0 {
+		for len(pt.previousTests) > 1 && pt.bufferedBytes > etl.PTBufferMaxBytes {
+			metrics.PTBufferOverflowCount.WithLabelValues(pt.previousTests[0].MetroName).Inc()
+			pt.insertOldestTest()
+		}
+	}
+
+	// Likewise, insert tests that have waited longer than the maximum age, so
+	// that a slow trickle of tests is not held for the whole task.
+	if etl.PTBufferMaxAge > 0 {
+		for len(pt.previousTests) > 0 && pt.Now().Sub(pt.previousTests[0].Buffered) > etl.PTBufferMaxAge {
+			metrics.PTBufferExpiredCount.WithLabelValues(pt.previousTests[0].MetroName).Inc()
+			pt.insertOldestTest()
+		}
+	}
 	return nil
 }
 
+// insertOldestTest inserts pt.previousTests[0] into BigQuery and removes it
+// from the buffer.
+func (pt *PTParser) insertOldestTest() {
+	metrics.PTTestStatusCount.WithLabelValues(pt.previousTests[0].MetroName, "not_reached").Inc()
+	pt.InsertOneTest(pt.previousTests[0])
+	pt.bufferedBytes -= pt.previousTests[0].Size
+	pt.previousTests = pt.previousTests[1:]
+}
+
+// ErrMalformedTuple is returned by ProcessOneTuple when a hop tuple cannot be
+// parsed.
+var ErrMalformedTuple = errors.New("malformed tuple")
+
+var (
+	// rttNum matches a single rtt value, like "0.298".
+	rttNum = `(\d+(?:\.\d*)?)`
+	// singleRTT matches the tcp and udp rtt format, like "0.298".
+	singleRTT = regexp.MustCompile(`^` + rttNum + `$`)
+	// quadRTT matches the icmp rtt format, like "0.298/0.318/0.340/0.016".
+	quadRTT = regexp.MustCompile(`^` + rttNum + `/` + rttNum + `/` + rttNum + `/` + rttNum + `$`)
+	// hopAddr matches a single flow address like "(66.110.57.41)", or a
+	// multiple flow address like "(72.14.218.190):0,2,3,4,6,8,10".
+	hopAddr = regexp.MustCompile(`^\(([0-9A-Fa-f.:]+)\)(?::(\d+(?:,\d+)*))?$`)
+)
+
+// logMalformedTuple rate limits logging of malformed tuples.
+var logMalformedTuple = logx.NewLogEvery(nil, 5*time.Second)
+
+// parseRTTs returns the rtts in field, which may be in either the single
+// number format used by tcp and udp, or the 4 number format used by icmp.
+func parseRTTs(field string) ([]float64, bool) {
+	var nums []string
+	if m := singleRTT.FindStringSubmatch(field); m != nil {
+		nums = m[1:]
+	} else if m := quadRTT.FindStringSubmatch(field); m != nil {
+		nums = m[1:]
+	} else {
+		return nil, false
+	}
+	rtt := make([]float64, 0, len(nums))
+	for _, num := range nums {
+		oneRtt, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, false
+		}
+		rtt = append(rtt, oneRtt)
+	}
+	return rtt, true
+}
+
 // For each 4 tuples, it is like:
 // parts[0] is the hostname, like "if-ae-10-3.tcore2.DT8-Dallas.as6453.net".
 // parts[1] is IP address like "(66.110.57.41)" or "(72.14.218.190):0,2,3,4,6,8,10"
 // parts[2] are rtt in numbers like "0.298/0.318/0.340/0.016"
 // parts[3] should always be "ms"
+// The rtt format is detected from parts[2], so that tcp and udp (single
+// number) and icmp (4 numbers) are both handled, regardless of protocol.
+// Returns an error wrapping ErrMalformedTuple if the tuple cannot be parsed.
 func ProcessOneTuple(parts []string, protocol string, currentLeaves []Node, allNodes, newLeaves *[]Node) error {
 	if len(parts) != 4 {
-		return errors.New("corrupted input")
+		return fmt.Errorf("%w: %q: expected 4 fields", ErrMalformedTuple, strings.Join(parts, " "))
 	}
 	if parts[3] != "ms" {
-		return errors.New("Malformed line. Expected 'ms'")
+		return fmt.Errorf("%w: %q: expected 'ms'", ErrMalformedTuple, strings.Join(parts, " "))
 	}
-	var rtt []float64
-	//TODO: to use regexp here.
-	switch {
-	// Handle tcp or udp, parts[2] is a single number.
-	case protocol == "tcp" || protocol == "udp":
-		oneRtt, err := strconv.ParseFloat(parts[2], 64)
-		if err == nil {
-			rtt = append(rtt, oneRtt)
-		} else {
-			fmt.Printf("Failed to conver rtt to number with error %v", err)
-			return err
-		}
-
-	// Handle icmp, parts[2] has 4 numbers separated by "/"
-	case protocol == "icmp":
-		nums := strings.Split(parts[2], "/")
-		if len(nums) != 4 {
-			return errors.New("Failed to parse rtts for icmp test. 4 numbers expected")
-		}
-		for _, num := range nums {
-			oneRtt, err := strconv.ParseFloat(num, 64)
-			if err == nil {
-				rtt = append(rtt, oneRtt)
-			} else {
-				fmt.Printf("Failed to conver rtt to number with error %v", err)
-				return err
-			}
-		}
+	rtt, ok := parseRTTs(parts[2])
+	if !ok {
+		return fmt.Errorf("%w: %q: bad rtt for %s", ErrMalformedTuple, strings.Join(parts, " "), protocol)
 	}
 	// check whether it is single flow or mulitple flows
 	// sample of multiple flows: (72.14.218.190):0,2,3,4,6,8,10
 	// sample of single flows: (172.25.252.166)
-	ips := strings.Split(parts[1], ":")
+	addr := hopAddr.FindStringSubmatch(parts[1])
+	if addr == nil {
+		return fmt.Errorf("%w: %q: bad IP address", ErrMalformedTuple, strings.Join(parts, " "))
+	}
+	ip := unmapIPv4(addr[1])
 
 	// Check whether it is root node.
 	if len(*allNodes) == 0 {
 		oneNode := &Node{
 			hostname:  parts[0],
-			ip:        ips[0][1 : len(ips[0])-1],
+			ip:        ip,
 			rtts:      rtt,
 			parent_ip: "",
 			flow:      -1,
@@ -731,13 +940,12 @@ func ProcessOneTuple(parts []string, protocol string, currentLeaves []Node, allN
 	}
 	// There are duplicates in allNodes, but not in newLeaves.
 	// TODO(dev): consider consolidating these with a repeat count.
-	switch len(ips) {
-	case 1:
+	if addr[2] == "" {
 		// For single flow, the new node will be son of all current leaves
 		for _, leaf := range currentLeaves {
 			oneNode := &Node{
 				hostname:        parts[0],
-				ip:              ips[0][1 : len(ips[0])-1],
+				ip:              ip,
 				rtts:            rtt,
 				parent_ip:       leaf.ip,
 				parent_hostname: leaf.hostname,
@@ -748,34 +956,32 @@ func ProcessOneTuple(parts []string, protocol string, currentLeaves []Node, allN
 				*newLeaves = append(*newLeaves, *oneNode)
 			}
 		}
-	case 2:
-		// Create a leave for each flow.
-		flows := strings.Split(ips[1], ",")
-		for _, flow := range flows {
-			flow_int, err := strconv.Atoi(flow)
-			if err != nil {
-				return err
-			}
+		return nil
+	}
+	// Create a leave for each flow.
+	flows := strings.Split(addr[2], ",")
+	for _, flow := range flows {
+		flow_int, err := strconv.Atoi(flow)
+		if err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrMalformedTuple, strings.Join(parts, " "), err)
+		}
 
-			for _, leaf := range currentLeaves {
-				if leaf.flow == -1 || leaf.flow == flow_int {
-					oneNode := &Node{
-						hostname:        parts[0],
-						ip:              ips[0][1 : len(ips[0])-1],
-						rtts:            rtt,
-						parent_ip:       leaf.ip,
-						parent_hostname: leaf.hostname,
-						flow:            flow_int,
-					}
-					*allNodes = append(*allNodes, *oneNode)
-					if Unique(*oneNode, *newLeaves) {
-						*newLeaves = append(*newLeaves, *oneNode)
-					}
+		for _, leaf := range currentLeaves {
+			if leaf.flow == -1 || leaf.flow == flow_int {
+				oneNode := &Node{
+					hostname:        parts[0],
+					ip:              ip,
+					rtts:            rtt,
+					parent_ip:       leaf.ip,
+					parent_hostname: leaf.hostname,
+					flow:            flow_int,
+				}
+				*allNodes = append(*allNodes, *oneNode)
+				if Unique(*oneNode, *newLeaves) {
+					*newLeaves = append(*newLeaves, *oneNode)
 				}
 			}
 		}
-	default:
-		return errors.New("Wrong format for IP address.")
 	}
 	return nil
 }
@@ -785,8 +991,7 @@ func ProcessOneTuple(parts []string, protocol string, currentLeaves []Node, allN
 func Parse(meta map[string]bigquery.Value, testName string, testId string, rawContent []byte,
 	tableName string, dp etl.DataPath) (cachedPTData, error) {
 	//log.Printf("%s", testName)
-	metrics.WorkerState.WithLabelValues(tableName, "pt-parse").Inc()
-	defer metrics.WorkerState.WithLabelValues(tableName, "pt-parse").Dec()
+	defer metrics.TrackWorkerState(tableName, "pt-parse")()
 
 	// Get the logtime
 	fn := PTFileName{Name: filepath.Base(testName)}
@@ -828,13 +1033,13 @@ func Parse(meta map[string]bigquery.Value, testName string, testId string, rawCo
 			protocol, destIP, serverIP, err = ParseFirstLine(oneLine)
 			if err != nil {
 				log.Printf("%s %s", oneLine, testName)
+				capturePTRawLine(testName, oneLine, err)
 				metrics.ErrorCount.WithLabelValues(tableName, "pt", "corrupted first line").Inc()
 				metrics.TestTotal.WithLabelValues(tableName, "pt", "corrupted first line").Inc()
 				return cachedPTData{}, err
 			}
 		} else {
 			// Handle each line of test file after the first line.
-			// TODO(dev): use regexp here
 			parts := strings.Fields(oneLine)
 			// Skip line start with "MPLS"
 			if len(parts) < 4 || parts[0] == "MPLS" {
@@ -851,8 +1056,10 @@ func Parse(meta map[string]bigquery.Value, testName string, testId string, rawCo
 				tupleStr := []string{parts[i], parts[i+1], parts[i+2], parts[i+3]}
 				err := ProcessOneTuple(tupleStr, protocol, currentLeaves, &allNodes, &newLeaves)
 				if err != nil {
-					metrics.PTHopCount.WithLabelValues(tableName, "pt", "discarded").Add(float64(len(allNodes)))
-					return cachedPTData{}, err
+					// Skip the malformed tuple, and continue with the rest of the test.
+					logMalformedTuple.Printf("%v in %s", err, testName)
+					capturePTRawLine(testName, oneLine, err)
+					metrics.WarningCount.WithLabelValues(tableName, "pt", "malformed tuple").Inc()
 				}
 				// Skip over any error codes for now. These are after the "ms" and start with '!'.
 				for ; i+4 < len(parts) && parts[i+4] != "" && parts[i+4][0] == '!'; i += 1 {
@@ -865,7 +1072,11 @@ func Parse(meta map[string]bigquery.Value, testName string, testId string, rawCo
 			// lastValidHopLine is the last line from raw test file that contains valid hop information.
 			lastValidHopLine = oneLine
 		} // Done with one line
-		currentLeaves = newLeaves
+		// If every tuple on a hop line was malformed, keep the previous
+		// leaves, so that later hops are still attached to the trace.
+		if len(newLeaves) > 0 {
+			currentLeaves = newLeaves
+		}
 	} // Done with a test file
 
 	if len(allNodes) == 0 {
@@ -879,6 +1090,24 @@ func Parse(meta map[string]bigquery.Value, testName string, testId string, rawCo
 	}
 	iataCode := etl.GetIATACode(fileName)
 	metrics.PTTestCount.WithLabelValues(iataCode).Inc()
+
+	machine := fmt.Sprintf("%s-%s", dp.Host, dp.Site)
+	if net.ParseIP(serverIP).Equal(net.ParseIP(destIP)) {
+		// The source and destination are the same, so the distance to the
+		// destination is meaningless.
+		metrics.PTDegenerateCount.WithLabelValues(iataCode).Inc()
+		return cachedPTData{
+			TestID:           testId,
+			Hops:             ProcessAllNodes(allNodes, serverIP, protocol, tableName, logTime, machine),
+			LogTime:          logTime,
+			Source:           schema.ServerInfo{IP: serverIP},
+			Destination:      schema.ClientInfo{IP: destIP},
+			LastValidHopLine: lastValidHopLine,
+			MetroName:        iataCode,
+			Degenerate:       true,
+		}, nil
+	}
+
 	// lastHop is a close estimation for where the test reached at the end.
 	// It is possible that the last line contains destIP and other IP at the same time
 	// if the previous hop contains multiple paths.
@@ -908,7 +1137,6 @@ func Parse(meta map[string]bigquery.Value, testName string, testId string, rawCo
 		metrics.PTBitsAwayFromDestV6.WithLabelValues(iataCode).Observe(float64(bitsDiff))
 	}
 
-	machine := fmt.Sprintf("%s-%s", dp.Host, dp.Site)
 	// Generate Hops from allNodes
 	PTHops := ProcessAllNodes(allNodes, serverIP, protocol, tableName, logTime, machine)
 
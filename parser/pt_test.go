@@ -1,17 +1,25 @@
 package parser_test
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
+	"net"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/row"
 	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/traceroute-caller/hopannotation"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestParsePT(t *testing.T) {
@@ -122,6 +130,335 @@ func TestParseJSONLSimple(t *testing.T) {
 	}
 }
 
+func TestParseJSONLMetaLine(t *testing.T) {
+	fileName := "20190825T000138Z_ndt-plh7v_1566050090_000000000004D64D.jsonl"
+	content, err := ioutil.ReadFile(filepath.Join("testdata/PT", fileName))
+	if err != nil {
+		t.Fatalf("failed to read file (error: %v)", err)
+	}
+	lines := bytes.Split(content, []byte("\n"))
+
+	tests := []struct {
+		name     string
+		meta     string
+		wantUUID string
+		wantErr  string
+	}{
+		{
+			name:     "full",
+			meta:     `{"UUID":"abc","TracerouteCallerVersion":"v1","CachedResult":true,"CachedUUID":"def"}`,
+			wantUUID: "abc",
+		},
+		{
+			name:     "uuid-only",
+			meta:     `{"UUID":"abc"}`,
+			wantUUID: "abc",
+		},
+		{
+			name:     "uuid-with-unexpected-fields",
+			meta:     `{"UUID":"abc","CachedResult":"yes"}`,
+			wantUUID: "abc",
+		},
+		{
+			name:    "empty-uuid",
+			meta:    `{"TracerouteCallerVersion":"v1"}`,
+			wantErr: "empty UUID",
+		},
+		{
+			name:    "corrupt",
+			meta:    `{"UUID":"ab`,
+			wantErr: "corrupted meta line",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines[0] = []byte(tt.meta)
+			got, err := parser.ParseJSONL(fileName, bytes.Join(lines, []byte("\n")), "pt", "")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("ParseJSONL() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseJSONL() error = %v", err)
+			}
+			if got.UUID != tt.wantUUID {
+				t.Errorf("ParseJSONL() UUID = %q, want %q", got.UUID, tt.wantUUID)
+			}
+		})
+	}
+}
+
+// complexJSONL is a scamper fixture with many hops, links and probes.
+const complexJSONL = "20190825T000138Z_ndt-plh7v_1566050090_000000000004D64C.jsonl"
+
+// parseJSONLFixture reads a JSONL fixture from testdata/PT, replaces the first
+// occurrence of each patch[0] with patch[1], and returns the patched content
+// and the result of parsing it.
+func parseJSONLFixture(t *testing.T, fileName string, patches ...[2]string) ([]byte, schema.PTTest, error) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata/PT", fileName))
+	if err != nil {
+		t.Fatalf("failed to read file (error: %v)", err)
+	}
+	for _, p := range patches {
+		if !bytes.Contains(content, []byte(p[0])) {
+			t.Fatalf("fixture %s does not contain %q", fileName, p[0])
+		}
+		content = bytes.Replace(content, []byte(p[0]), []byte(p[1]), 1)
+	}
+	got, err := parser.ParseJSONL(fileName, content, "pt", "")
+	return content, got, err
+}
+
+func TestParseJSONLPatched(t *testing.T) {
+	cycleStart := `"type":"cycle-start", "list_name":"/tmp/scamperctrl:51803", "id":`
+	cycleStop := `"type":"cycle-stop", "list_name":"/tmp/scamperctrl:51803", "id":`
+	cycleIDs := func(start, stop string) [][2]string {
+		return [][2]string{{cycleStart + "1", cycleStart + start}, {cycleStop + "1", cycleStop + stop}}
+	}
+	cycleID := func(want int64) func(t *testing.T, got schema.PTTest) {
+		return func(t *testing.T, got schema.PTTest) {
+			if got.CycleID != want {
+				t.Errorf("CycleID = %d, want %d", got.CycleID, want)
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		fileName string // Defaults to complexJSONL.
+		patches  [][2]string
+		warnings map[string]float64 // Expected increase of pt WarningCount, by label.
+		check    func(t *testing.T, got schema.PTTest)
+	}{
+		{
+			name:     "no-stop-reason",
+			fileName: "20190825T000138Z_ndt-plh7v_1566050090_000000000004D64D.jsonl",
+			check: func(t *testing.T, got schema.PTTest) {
+				if got.StopReason != "" || got.StopData != 0 {
+					t.Errorf("stop reason = %q, %d, want empty", got.StopReason, got.StopData)
+				}
+			},
+		},
+		{
+			name:     "stop-reason",
+			fileName: "20190825T000138Z_ndt-plh7v_1566050090_000000000004D64D.jsonl",
+			patches: [][2]string{{`"type":"tracelb", `,
+				`"type":"tracelb", "stop_reason":"HALTED", "stop_data":7, `}},
+			check: func(t *testing.T, got schema.PTTest) {
+				if got.StopReason != "HALTED" || got.StopData != 7 {
+					t.Errorf("stop reason = %q, %d, want HALTED, 7", got.StopReason, got.StopData)
+				}
+			},
+		},
+		{
+			// Every node in the fixture has "q_ttl":1.  Change the first to 3.
+			name:    "qttl",
+			patches: [][2]string{{`"q_ttl":1`, `"q_ttl":3`}},
+			check: func(t *testing.T, got schema.PTTest) {
+				if len(got.Hop) == 0 {
+					t.Fatal("ParseJSONL() returned no hops")
+				}
+				if got.Hop[0].Source.QTTL != 3 {
+					t.Errorf("Hop[0].Source.QTTL = %d, want 3", got.Hop[0].Source.QTTL)
+				}
+				for i, hop := range got.Hop[1:] {
+					if hop.Source.QTTL != 1 {
+						t.Errorf("Hop[%d].Source.QTTL = %d, want 1", i+1, hop.Source.QTTL)
+					}
+				}
+			},
+		},
+		{
+			// Replace the fixture's IPv6 source, destination, and first hop
+			// addresses with IPv4-mapped IPv6 addresses.
+			name: "ipv4-mapped",
+			patches: [][2]string{
+				{`"2001:550:1b01:1:e41d:2d00:151:f6c0"`, `"::ffff:10.0.0.1"`},
+				{`"2600:1009:b013:1a59:c369:b528:98fd:ab43"`, `"::ffff:10.0.0.2"`},
+				{`"2001:550:1b01:1::1"`, `"::ffff:10.0.0.3"`},
+				{`"2001:550:3::1ca"`, `"::ffff:10.0.0.4"`},
+				{`"2001:550:3::1ca"`, `"::ffff:10.0.0.4"`},
+			},
+			check: func(t *testing.T, got schema.PTTest) {
+				if len(got.Hop) == 0 || len(got.Hop[0].Links) == 0 {
+					t.Fatal("ParseJSONL() returned no hop links")
+				}
+				if got.Source.IP != "10.0.0.1" {
+					t.Errorf("Source.IP = %q, want 10.0.0.1", got.Source.IP)
+				}
+				if got.Destination.IP != "10.0.0.2" {
+					t.Errorf("Destination.IP = %q, want 10.0.0.2", got.Destination.IP)
+				}
+				if got.Hop[0].Source.IP != "10.0.0.3" {
+					t.Errorf("Hop[0].Source.IP = %q, want 10.0.0.3", got.Hop[0].Source.IP)
+				}
+				if got.Hop[0].Links[0].HopDstIP != "10.0.0.4" {
+					t.Errorf("Hop[0].Links[0].HopDstIP = %q, want 10.0.0.4", got.Hop[0].Links[0].HopDstIP)
+				}
+			},
+		},
+		{
+			// Every reply in the fixture is an ICMPv6 time exceeded (type 3,
+			// code 0).  Change the first to a port unreachable (type 1, code 4).
+			name:    "icmp-replies",
+			patches: [][2]string{{`"icmp_type":3, "icmp_code":0`, `"icmp_type":1, "icmp_code":4`}},
+			check: func(t *testing.T, got schema.PTTest) {
+				if len(got.Hop) == 0 || len(got.Hop[0].Links) == 0 || len(got.Hop[0].Links[0].Probes) < 2 {
+					t.Fatal("ParseJSONL() returned too few probes")
+				}
+				probes := got.Hop[0].Links[0].Probes
+				want := []schema.HopReply{{ICMPType: 1, ICMPCode: 4, ICMPQTOS: 0, ICMPQTTL: 1}}
+				if !reflect.DeepEqual(probes[0].Replies, want) {
+					t.Errorf("Probes[0].Replies = %+v, want %+v", probes[0].Replies, want)
+				}
+				want = []schema.HopReply{{ICMPType: 3, ICMPCode: 0, ICMPQTOS: 0, ICMPQTTL: 1}}
+				if !reflect.DeepEqual(probes[1].Replies, want) {
+					t.Errorf("Probes[1].Replies = %+v, want %+v", probes[1].Replies, want)
+				}
+				if len(probes[0].Replies) != len(probes[0].Rtt) {
+					t.Errorf("len(Replies) = %d, want len(Rtt) = %d", len(probes[0].Replies), len(probes[0].Rtt))
+				}
+			},
+		},
+		{
+			// The fixture's tracelb line has "userid":0.  Use a non-zero value.
+			name:    "list-name-and-user-id",
+			patches: [][2]string{{`"userid":0`, `"userid":7`}},
+			check: func(t *testing.T, got schema.PTTest) {
+				if got.ListName != "/tmp/scamperctrl:51803" {
+					t.Errorf("ListName = %q, want %q", got.ListName, "/tmp/scamperctrl:51803")
+				}
+				if got.UserID != 7 {
+					t.Errorf("UserID = %d, want 7", got.UserID)
+				}
+			},
+		},
+		{
+			name:     "cycle-id-both",
+			patches:  cycleIDs("42", "42"),
+			warnings: map[string]float64{"cycle id mismatch": 0},
+			check:    cycleID(42),
+		},
+		{
+			name:     "cycle-id-start-only",
+			patches:  cycleIDs("42", "0"),
+			warnings: map[string]float64{"cycle id mismatch": 0},
+			check:    cycleID(42),
+		},
+		{
+			name:     "cycle-id-stop-only",
+			patches:  cycleIDs("0", "42"),
+			warnings: map[string]float64{"cycle id mismatch": 0},
+			check:    cycleID(42),
+		},
+		{
+			name:     "cycle-id-mismatch",
+			patches:  cycleIDs("42", "43"),
+			warnings: map[string]float64{"cycle id mismatch": 1},
+			check:    cycleID(42),
+		},
+		{
+			// Corrupt the first probe's ttl and flowid, and the probe counts.
+			name: "out-of-range",
+			patches: [][2]string{
+				{`"ttl":2, "attempt":0, "flowid":1,`, `"ttl":300, "attempt":0, "flowid":-7,`},
+				{`"probec":85`, `"probec":-85`},
+				{`"probe_size":60`, `"probe_size":1e9`},
+			},
+			warnings: map[string]float64{
+				"out of range ttl":        1,
+				"out of range flowid":     1,
+				"out of range probec":     1,
+				"out of range probe_size": 1,
+			},
+			check: func(t *testing.T, got schema.PTTest) {
+				if got.ProbeC != 0 {
+					t.Errorf("ProbeC = %d, want 0", got.ProbeC)
+				}
+				if got.ProbeSize != 65535 {
+					t.Errorf("ProbeSize = %d, want 65535", got.ProbeSize)
+				}
+				// The fixture flowids are all positive, so only the corrupt one is 0.
+				clamped := 0
+				for _, hop := range got.Hop {
+					for _, link := range hop.Links {
+						if link.TTL < 0 || link.TTL > 255 {
+							t.Errorf("TTL = %d, out of range", link.TTL)
+						}
+						for _, probe := range link.Probes {
+							if probe.Flowid == 0 {
+								clamped++
+							}
+						}
+					}
+				}
+				if clamped != 1 {
+					t.Errorf("found %d probes with clamped flowid, want 1", clamped)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := tt.fileName
+			if fileName == "" {
+				fileName = complexJSONL
+			}
+			before := map[string]float64{}
+			for label := range tt.warnings {
+				before[label] = testutil.ToFloat64(metrics.WarningCount.WithLabelValues("pt", "pt", label))
+			}
+			_, got, err := parseJSONLFixture(t, fileName, tt.patches...)
+			if err != nil {
+				t.Fatalf("failed to parse file %v (error: %v)", fileName, err)
+			}
+			for label, want := range tt.warnings {
+				if n := testutil.ToFloat64(metrics.WarningCount.WithLabelValues("pt", "pt", label)) - before[label]; n != want {
+					t.Errorf("%s count = %v, want %v", label, n, want)
+				}
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestParseJSONLEmptyNodes(t *testing.T) {
+	content, got, err := parseJSONLFixture(t, complexJSONL)
+	if err != nil {
+		t.Fatalf("failed to parse file %v (error: %v)", complexJSONL, err)
+	}
+	if got.EmptyTrace {
+		t.Error("trace with nodes should not be marked empty")
+	}
+
+	// Replace the tracelb nodes with an empty list.  The nodes are the last
+	// field in the tracelb line.
+	lines := bytes.Split(content, []byte("\n"))
+	nodes := bytes.Index(lines[2], []byte(`"nodes":[`))
+	if nodes < 0 {
+		t.Fatal("no nodes in tracelb line")
+	}
+	lines[2] = append(lines[2][:nodes:nodes], []byte(`"nodes":[]}`)...)
+	lines[2] = bytes.Replace(lines[2], []byte(`"nodec":6`), []byte(`"nodec":0`), 1)
+
+	before := testutil.ToFloat64(metrics.WarningCount.WithLabelValues("pt", "pt", "empty trace"))
+	got, err = parser.ParseJSONL(complexJSONL, bytes.Join(lines, []byte("\n")), "pt", "")
+	if err != nil {
+		t.Fatalf("failed to parse empty trace (error: %v)", err)
+	}
+	if !got.EmptyTrace {
+		t.Error("trace without nodes should be marked empty")
+	}
+	if len(got.Hop) != 0 {
+		t.Errorf("got %d hops, want 0", len(got.Hop))
+	}
+	if n := testutil.ToFloat64(metrics.WarningCount.WithLabelValues("pt", "pt", "empty trace")) - before; n != 1 {
+		t.Errorf("empty trace count = %v, want 1", n)
+	}
+}
+
 func TestParseJSONLNoLinks(t *testing.T) {
 	// Last object on the "type":"tracelb" line has "linkc":1 but no "links" set.
 	fileName := "20190825T000138Z_ndt-plh7v_1566050090_000000000004D64F.jsonl"
@@ -166,8 +503,10 @@ func TestParseJSONLComplex(t *testing.T) {
 		t.Fatalf("failed to parse probec, wanted %d, got %d", wantProbeC, got.ProbeC)
 	}
 
+	// Every reply in the fixture is an ICMPv6 time exceeded message.
+	timeExceeded := []schema.HopReply{{ICMPType: 3, ICMPCode: 0, ICMPQTOS: 0, ICMPQTTL: 1}}
 	wantHop := schema.ScamperHop{
-		Source: schema.HopIP{IP: "2001:550:1b01:1::1", ASN: 0,
+		Source: schema.HopIP{IP: "2001:550:1b01:1::1", ASN: 0, QTTL: 1,
 			HopAnnotation1: &hopannotation.HopAnnotation1{ID: "20190825_ndt-plh7v_2001:550:1b01:1::1",
 				Timestamp: time.Date(2019, time.August, 25, 00, 01, 8, 0, time.UTC)}},
 		Linkc: 1,
@@ -176,12 +515,12 @@ func TestParseJSONLComplex(t *testing.T) {
 				HopDstIP: "2001:550:3::1ca",
 				TTL:      2,
 				Probes: []schema.HopProbe{
-					schema.HopProbe{Flowid: 1, Rtt: []float64{36.803}},
-					schema.HopProbe{Flowid: 2, Rtt: []float64{0.332}},
-					schema.HopProbe{Flowid: 3, Rtt: []float64{0.329}},
-					schema.HopProbe{Flowid: 4, Rtt: []float64{0.567}},
-					schema.HopProbe{Flowid: 5, Rtt: []float64{0.329}},
-					schema.HopProbe{Flowid: 6, Rtt: []float64{1.237}},
+					schema.HopProbe{Flowid: 1, Rtt: []float64{36.803}, Replies: timeExceeded},
+					schema.HopProbe{Flowid: 2, Rtt: []float64{0.332}, Replies: timeExceeded},
+					schema.HopProbe{Flowid: 3, Rtt: []float64{0.329}, Replies: timeExceeded},
+					schema.HopProbe{Flowid: 4, Rtt: []float64{0.567}, Replies: timeExceeded},
+					schema.HopProbe{Flowid: 5, Rtt: []float64{0.329}, Replies: timeExceeded},
+					schema.HopProbe{Flowid: 6, Rtt: []float64{1.237}, Replies: timeExceeded},
 				},
 			},
 		},
@@ -206,6 +545,13 @@ func TestParseFirstLine(t *testing.T) {
 		return
 	}
 
+	line = "traceroute [(::ffff:64.86.132.76:33461) -> (::ffff:98.162.212.214:53849)], protocol icmp, algo exhaustive, duration 19 s"
+	protocol, dest_ip, server_ip, err = parser.ParseFirstLine(line)
+	if dest_ip != "98.162.212.214" || server_ip != "64.86.132.76" || protocol != "icmp" || err != nil {
+		t.Errorf("Error in parsing the first line with IPv4-mapped addresses!\n")
+		return
+	}
+
 	line = "Exception : [ERROR](Probe.cc, 109)Can't send the probe : Invalid argument"
 	protocol, dest_ip, server_ip, err = parser.ParseFirstLine(line)
 	if err == nil {
@@ -222,6 +568,67 @@ func TestParseFirstLine(t *testing.T) {
 
 }
 
+func TestParseFirstLineAlgorithms(t *testing.T) {
+	defer func() { delete(parser.PTProtocols, "sctp") }()
+	parser.PTProtocols["sctp"] = true
+	defer func() { delete(parser.PTAlgorithms, "paris-mda") }()
+	parser.PTAlgorithms["paris-mda"] = true
+
+	tests := []struct {
+		name     string
+		line     string
+		protocol string
+		wantErr  bool
+	}{
+		{
+			name:     "known-algorithm",
+			line:     "traceroute [(64.86.132.76:33461) -> (98.162.212.214:53849)], protocol udp, algo hopbyhop, duration 19 s",
+			protocol: "udp",
+		},
+		{
+			name:     "mda-lite-algorithm",
+			line:     "traceroute [(64.86.132.76:33461) -> (98.162.212.214:53849)], protocol icmp, algo mda-lite, duration 19 s",
+			protocol: "icmp",
+		},
+		{
+			name:     "added-algorithm",
+			line:     "traceroute [(64.86.132.76:33461) -> (98.162.212.214:53849)], protocol icmp, algo paris-mda, duration 19 s",
+			protocol: "icmp",
+		},
+		{
+			name:     "added-protocol",
+			line:     "traceroute [(64.86.132.76:33461) -> (98.162.212.214:53849)], protocol sctp, algo exhaustive, duration 19 s",
+			protocol: "sctp",
+		},
+		{
+			name:    "unknown-algorithm",
+			line:    "traceroute [(64.86.132.76:33461) -> (98.162.212.214:53849)], protocol icmp, algo foo, duration 19 s",
+			wantErr: true,
+		},
+		{
+			name:    "malformed-algorithm",
+			line:    "traceroute [(64.86.132.76:33461) -> (98.162.212.214:53849)], protocol icmp, algo ???, duration 19 s",
+			wantErr: true,
+		},
+		{
+			name:    "unknown-protocol",
+			line:    "traceroute [(64.86.132.76:33461) -> (98.162.212.214:53849)], protocol foo, algo exhaustive, duration 19 s",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocol, _, _, err := parser.ParseFirstLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFirstLine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if protocol != tt.protocol {
+				t.Errorf("ParseFirstLine() protocol = %q, want %q", protocol, tt.protocol)
+			}
+		})
+	}
+}
+
 func TestCreateTestId(t *testing.T) {
 	fn := "20170501T000000Z-mlab1-acc02-paris-traceroute-0000.tgz"
 	bn := "20170501T23:53:10Z-98.162.212.214-53849-64.86.132.75-42677.paris"
@@ -257,6 +664,8 @@ func TestParseLegacyFormatData(t *testing.T) {
 func TestParseJSONL(t *testing.T) {
 	ins := newInMemoryInserter()
 	pt := parser.NewPTParser(ins, "paris1", "")
+	fixed := time.Date(2019, 9, 27, 1, 2, 3, 0, time.UTC)
+	pt.SetClock(row.ClockFunc(func() time.Time { return fixed }))
 
 	filename := "testdata/PT/20190927T070859Z_ndt-qtfh8_1565996043_0000000000003B64.jsonl"
 	rawData, err := ioutil.ReadFile(filename)
@@ -286,6 +695,9 @@ func TestParseJSONL(t *testing.T) {
 	if ptTest.Parseinfo.TaskFileName != url {
 		t.Fatalf("Wrong TaskFilenName; got %q, want %q", ptTest.Parseinfo.TaskFileName, url)
 	}
+	if !ptTest.Parseinfo.ParseTime.Equal(fixed) {
+		t.Errorf("ParseTime = %v, want %v", ptTest.Parseinfo.ParseTime, fixed)
+	}
 
 	if ptTest.UUID != "ndt-qtfh8_1565996043_0000000000003B64" {
 		t.Fatalf("Wrong UUID; got %q, want %q", ptTest.UUID, "ndt-qtfh8_1565996043_0000000000003B64")
@@ -327,8 +739,9 @@ func TestParse(t *testing.T) {
 		Linkc: 0,
 		Links: []schema.HopLink{
 			schema.HopLink{
-				HopDstIP: "74.125.224.100",
-				TTL:      0,
+				HopDstIP:       "74.125.224.100",
+				HopDstHostname: "74.125.224.100",
+				TTL:            0,
 				Probes: []schema.HopProbe{
 					schema.HopProbe{
 						Flowid: 0,
@@ -377,16 +790,213 @@ func TestParseAndInsert(t *testing.T) {
 	if ins.data[0].(*schema.PTTest).Parseinfo.TaskFileName != url {
 		t.Fatalf("Task filename is wrong.")
 	}
+	if ins.data[0].(*schema.PTTest).Parseinfo.ParseTime.IsZero() {
+		t.Errorf("ParseTime not populated.")
+	}
+	if ins.data[0].(*schema.PTTest).Parseinfo.ParserVersion != parser.Version() {
+		t.Errorf("ParserVersion = %q, want %q",
+			ins.data[0].(*schema.PTTest).Parseinfo.ParserVersion, parser.Version())
+	}
 	// echo -n 2013-05-24T00:04:44Z-91.239.96.102-2.80.132.33 | openssl dgst -binary -md5 | base64  | tr '/+' '_-' | tr -d '='
 	if ins.data[0].(*schema.PTTest).UUID != "R9_wGx1-cSmqtSAt5aQtNg" {
 		t.Fatalf("UUID is wrong; got %q, want %q", ins.data[0].(*schema.PTTest).UUID, "R9_wGx1-cSmqtSAt5aQtNg")
 	}
 }
 
+// The legacy .paris fixture from mlab3.akl01, and its archive.
+const (
+	akl01Paris    = "testdata/PT/20130524T00:04:44Z_ALL5729.paris"
+	akl01TaskFile = "gs://archive-measurement-lab/paris-traceroute/2013/05/24/20130524T000000Z-mlab3-akl01-paris-traceroute-0000.tgz"
+)
+
+// parseParis inserts the akl01 .paris fixture the given number of times into
+// a new PT parser, after replacing the first occurrence of each patch[0]
+// with patch[1].  It returns the number of tests buffered before the final
+// flush, and the inserted rows.
+func parseParis(t *testing.T, inserts int, patches ...[2]string) (int, []*schema.PTTest) {
+	rawData, err := ioutil.ReadFile(akl01Paris)
+	if err != nil {
+		t.Fatalf("cannot read testdata.")
+	}
+	for _, p := range patches {
+		if !bytes.Contains(rawData, []byte(p[0])) {
+			t.Fatalf("fixture does not contain %q", p[0])
+		}
+		rawData = bytes.Replace(rawData, []byte(p[0]), []byte(p[1]), 1)
+	}
+	ins := newInMemoryInserter()
+	pt := parser.NewPTParser(ins, "paris1", "")
+	meta := map[string]bigquery.Value{"filename": akl01TaskFile}
+	for i := 0; i < inserts; i++ {
+		if err := pt.ParseAndInsert(meta, akl01Paris, rawData); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffered := pt.NumBufferedTests()
+	if err := pt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]*schema.PTTest, len(ins.data))
+	for i := range ins.data {
+		rows[i] = ins.data[i].(*schema.PTTest)
+	}
+	return buffered, rows
+}
+
+func TestParseAndInsertParis(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func() func() // Changes globals, and returns a function to restore them.
+		patches  [][2]string
+		inserts  int                  // Defaults to 1.
+		counters []prometheus.Counter // Each is expected to increase by 1.
+		buffered int                  // Tests held for the pollution check before the flush.
+		rows     int
+		check    func(t *testing.T, rows []*schema.PTTest)
+	}{
+		{
+			name: "client-ip-transform",
+			setup: func() func() {
+				orig := row.ClientIPTransform
+				row.ClientIPTransform = func(ip string) string {
+					addr := net.ParseIP(ip).To4()
+					addr[3] = 0
+					return addr.String()
+				}
+				return func() { row.ClientIPTransform = orig }
+			},
+			buffered: 1,
+			rows:     1,
+			check: func(t *testing.T, rows []*schema.PTTest) {
+				if rows[0].Destination.IP != "2.80.132.0" {
+					t.Errorf("Destination.IP = %q, want %q", rows[0].Destination.IP, "2.80.132.0")
+				}
+				if rows[0].Source.IP != "91.239.96.102" {
+					t.Errorf("Source.IP = %q, want %q", rows[0].Source.IP, "91.239.96.102")
+				}
+				for _, hop := range rows[0].Hop {
+					for _, link := range hop.Links {
+						if link.HopDstIP == "2.80.132.33" {
+							t.Errorf("hop to %s was not rewritten", link.HopDstIP)
+						}
+					}
+				}
+			},
+		},
+		{
+			// Make the destination the same as the source.  Degenerate tests
+			// are not held for pollution checks.
+			name:    "degenerate",
+			patches: [][2]string{{"(2.80.132.33:33457)", "(91.239.96.102:33457)"}},
+			counters: []prometheus.Counter{
+				metrics.PTDegenerateCount.WithLabelValues("akl"),
+				metrics.PTTestStatusCount.WithLabelValues("akl", "degenerate"),
+			},
+			buffered: 0,
+			rows:     1,
+			check: func(t *testing.T, rows []*schema.PTTest) {
+				if !rows[0].Degenerate {
+					t.Error("row should be marked degenerate")
+				}
+				if rows[0].Source.IP != rows[0].Destination.IP {
+					t.Errorf("source %s != destination %s", rows[0].Source.IP, rows[0].Destination.IP)
+				}
+			},
+		},
+		{
+			name: "forward-hops",
+			setup: func() func() {
+				orig := etl.PTForwardHops
+				etl.PTForwardHops = true
+				return func() { etl.PTForwardHops = orig }
+			},
+			buffered: 1,
+			rows:     1,
+			check: func(t *testing.T, rows []*schema.PTTest) {
+				forward := rows[0].Hop
+				etl.PTForwardHops = false
+				_, reverseRows := parseParis(t, 1)
+				reverse := reverseRows[0].Hop
+				if len(forward) < 2 || len(forward) != len(reverse) {
+					t.Fatalf("got %d forward hops and %d reverse hops", len(forward), len(reverse))
+				}
+				// The first forward hop starts at the server.
+				if got := forward[0].Source.IP; got != "91.239.96.102" {
+					t.Errorf("first hop source = %s, want 91.239.96.102", got)
+				}
+				// Each hop starts where the previous hop ended.
+				for i := 1; i < len(forward); i++ {
+					if forward[i].Source.IP != forward[i-1].Links[0].HopDstIP {
+						t.Errorf("hop %d source %s does not follow hop %d destination %s",
+							i, forward[i].Source.IP, i-1, forward[i-1].Links[0].HopDstIP)
+					}
+				}
+				for i := range forward {
+					if !reflect.DeepEqual(forward[i], reverse[len(reverse)-1-i]) {
+						t.Errorf("forward hop %d does not match reverse hop %d", i, len(reverse)-1-i)
+					}
+				}
+			},
+		},
+		{
+			// Parsing the same test twice produces the same synthetic UUID.
+			name: "synthetic-uuid-collision",
+			setup: func() func() {
+				orig := etl.DisambiguateSyntheticUUIDs
+				etl.DisambiguateSyntheticUUIDs = true
+				return func() { etl.DisambiguateSyntheticUUIDs = orig }
+			},
+			inserts:  2,
+			buffered: 2,
+			rows:     2,
+			check: func(t *testing.T, rows []*schema.PTTest) {
+				if rows[1].UUID != rows[0].UUID+"-1" {
+					t.Errorf("Collision not disambiguated; got %q, want %q", rows[1].UUID, rows[0].UUID+"-1")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				defer tt.setup()()
+			}
+			inserts := tt.inserts
+			if inserts == 0 {
+				inserts = 1
+			}
+			before := make([]float64, len(tt.counters))
+			for i, c := range tt.counters {
+				before[i] = testutil.ToFloat64(c)
+			}
+			buffered, rows := parseParis(t, inserts, tt.patches...)
+			for i, c := range tt.counters {
+				if got := testutil.ToFloat64(c) - before[i]; got != 1 {
+					t.Errorf("counter %d increased by %v, want 1", i, got)
+				}
+			}
+			if buffered != tt.buffered {
+				t.Errorf("NumBufferedTests() = %d, want %d", buffered, tt.buffered)
+			}
+			if len(rows) != tt.rows {
+				t.Fatalf("inserted %d rows, want %d", len(rows), tt.rows)
+			}
+			tt.check(t, rows)
+		})
+	}
+}
+
 func TestProcessLastTests(t *testing.T) {
 	ins := &inMemoryInserter{}
 	pt := parser.NewPTParser(ins, "paris1", "")
 
+	// The test files are not in a valid archive, so have no metro.
+	statuses := []string{"reached", "not_reached", "polluted", "degenerate"}
+	before := map[string]float64{}
+	for _, status := range statuses {
+		before[status] = testutil.ToFloat64(metrics.PTTestStatusCount.WithLabelValues("", status))
+	}
+
 	tests := []struct {
 		fileName             string
 		expectedBufferedTest int
@@ -461,6 +1071,160 @@ func TestProcessLastTests(t *testing.T) {
 	if s.Total() != 4 {
 		t.Fatalf("Number of tests in buffer not correct, expect 0, actually %d.", ins.RowsInBuffer())
 	}
+
+	// Each test is counted once, with its final status.
+	want := map[string]float64{"reached": 3, "not_reached": 1, "polluted": 2, "degenerate": 0}
+	for _, status := range statuses {
+		got := testutil.ToFloat64(metrics.PTTestStatusCount.WithLabelValues("", status)) - before[status]
+		if got != want[status] {
+			t.Errorf("PTTestStatusCount(%q) = %v, want %v", status, got, want[status])
+		}
+	}
+}
+
+func TestPTBufferMaxBytes(t *testing.T) {
+	ins := &inMemoryInserter{}
+	pt := parser.NewPTParser(ins, "paris1", "")
+
+	// Lower the limit so that a single test fills the buffer.
+	defer func(max int) { etl.PTBufferMaxBytes = max }(etl.PTBufferMaxBytes)
+	etl.PTBufferMaxBytes = 1
+
+	files := []string{
+		"testdata/PT/20171208T00:00:14Z-76.227.226.149-37156-173.205.3.37-52156.paris",
+		"testdata/PT/20171208T22:03:54Z-104.198.139.160-60574-163.22.28.37-7999.paris",
+	}
+	for _, fn := range files {
+		rawData, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("cannot read testdata.")
+		}
+		meta := map[string]bigquery.Value{"filename": fn, "parse_time": time.Now()}
+		err = pt.ParseAndInsert(meta, fn, rawData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without the byte limit, both tests would remain buffered.
+		if pt.NumBufferedTests() != 1 {
+			t.Errorf("NumBufferedTests() = %d, want 1", pt.NumBufferedTests())
+		}
+	}
+	if pt.GetStats().Total() != 1 {
+		t.Errorf("Total() = %d, want 1", pt.GetStats().Total())
+	}
+	pt.ProcessLastTests()
+	if pt.GetStats().Total() != 2 {
+		t.Errorf("Total() = %d, want 2", pt.GetStats().Total())
+	}
+}
+
+func TestPTBufferMaxAge(t *testing.T) {
+	ins := &inMemoryInserter{}
+	pt := parser.NewPTParser(ins, "paris1", "")
+	now := time.Date(2017, 12, 8, 0, 0, 0, 0, time.UTC)
+	pt.SetClock(row.ClockFunc(func() time.Time { return now }))
+
+	defer func(age time.Duration) { etl.PTBufferMaxAge = age }(etl.PTBufferMaxAge)
+	etl.PTBufferMaxAge = time.Minute
+
+	files := []string{
+		"testdata/PT/20171208T00:00:14Z-76.227.226.149-37156-173.205.3.37-52156.paris",
+		"testdata/PT/20171208T22:03:54Z-104.198.139.160-60574-163.22.28.37-7999.paris",
+	}
+	before := testutil.ToFloat64(metrics.PTBufferExpiredCount.WithLabelValues(""))
+	for i, fn := range files {
+		rawData, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("cannot read testdata.")
+		}
+		meta := map[string]bigquery.Value{"filename": fn, "parse_time": time.Now()}
+		err = pt.ParseAndInsert(meta, fn, rawData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without the age limit, both tests would remain buffered.
+		if pt.NumBufferedTests() != 1 {
+			t.Errorf("file %d: NumBufferedTests() = %d, want 1", i, pt.NumBufferedTests())
+		}
+		now = now.Add(2 * time.Minute)
+	}
+	if pt.GetStats().Total() != 1 {
+		t.Errorf("Total() = %d, want 1", pt.GetStats().Total())
+	}
+	if n := testutil.ToFloat64(metrics.PTBufferExpiredCount.WithLabelValues("")) - before; n != 1 {
+		t.Errorf("PTBufferExpiredCount = %v, want 1", n)
+	}
+	pt.ProcessLastTests()
+	if pt.GetStats().Total() != 2 {
+		t.Errorf("Total() = %d, want 2", pt.GetStats().Total())
+	}
+}
+
+func TestPTBufferMaxAgeNotExpired(t *testing.T) {
+	ins := &inMemoryInserter{}
+	pt := parser.NewPTParser(ins, "paris1", "")
+	now := time.Date(2017, 12, 8, 0, 0, 0, 0, time.UTC)
+	pt.SetClock(row.ClockFunc(func() time.Time { return now }))
+
+	defer func(age time.Duration) { etl.PTBufferMaxAge = age }(etl.PTBufferMaxAge)
+	etl.PTBufferMaxAge = time.Minute
+
+	files := []string{
+		"testdata/PT/20171208T00:00:14Z-76.227.226.149-37156-173.205.3.37-52156.paris",
+		"testdata/PT/20171208T22:03:54Z-104.198.139.160-60574-163.22.28.37-7999.paris",
+	}
+	for _, fn := range files {
+		rawData, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("cannot read testdata.")
+		}
+		meta := map[string]bigquery.Value{"filename": fn, "parse_time": time.Now()}
+		err = pt.ParseAndInsert(meta, fn, rawData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(30 * time.Second)
+	}
+	if pt.NumBufferedTests() != 2 {
+		t.Errorf("NumBufferedTests() = %d, want 2", pt.NumBufferedTests())
+	}
+	if pt.GetStats().Total() != 0 {
+		t.Errorf("Total() = %d, want 0", pt.GetStats().Total())
+	}
+}
+
+func TestPTParserParsableSuffixes(t *testing.T) {
+	defer etl.SetParsableSuffixes(etl.PT, etl.PT.ParsableSuffixes())
+
+	fn := "testdata/PT/20171208T00:00:14Z-76.227.226.149-37156-173.205.3.37-52156.paris"
+	rawData, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("cannot read testdata.")
+	}
+	renamed := fn + ".txt"
+	pt := parser.NewPTParser(&inMemoryInserter{}, "paris1", "")
+	for _, name := range []string{fn, "a.json", "a.jsonl"} {
+		if _, ok := pt.IsParsable(name, rawData); !ok {
+			t.Errorf("IsParsable(%q) = false, want true", name)
+		}
+	}
+	if _, ok := pt.IsParsable(renamed, rawData); ok {
+		t.Errorf("IsParsable(%q) = true before enabling .paris.txt", renamed)
+	}
+
+	etl.SetParsableSuffixes(etl.PT, append(etl.PT.ParsableSuffixes(), ".paris.txt"))
+	kind, ok := pt.IsParsable(renamed, rawData)
+	if !ok || kind != "paris" {
+		t.Fatalf("IsParsable(%q) = %q, %v, want paris, true", renamed, kind, ok)
+	}
+	meta := map[string]bigquery.Value{"filename": renamed, "parse_time": time.Now()}
+	if err := pt.ParseAndInsert(meta, renamed, rawData); err != nil {
+		t.Fatal(err)
+	}
+	pt.ProcessLastTests()
+	if pt.GetStats().Total() != 1 {
+		t.Errorf("Total() = %d, want 1", pt.GetStats().Total())
+	}
 }
 
 func TestParseEmpty(t *testing.T) {
@@ -475,3 +1239,199 @@ func TestParseEmpty(t *testing.T) {
 		t.Fatal(parseErr)
 	}
 }
+
+func TestProcessOneTuple(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		parts    []string
+		wantIP   string
+		wantRTT  []float64
+		wantErr  bool
+	}{
+		{
+			name:     "tcp",
+			protocol: "tcp",
+			parts:    []string{"172.17.95.252", "(172.17.95.252)", "0.376", "ms"},
+			wantIP:   "172.17.95.252",
+			wantRTT:  []float64{0.376},
+		},
+		{
+			name:     "udp",
+			protocol: "udp",
+			parts:    []string{"host.example.com", "(2001:db8::1)", "12", "ms"},
+			wantIP:   "2001:db8::1",
+			wantRTT:  []float64{12},
+		},
+		{
+			name:     "icmp",
+			protocol: "icmp",
+			parts:    []string{"if-ae-10-3.tcore2.DT8-Dallas.as6453.net", "(66.110.57.41)", "0.298/0.318/0.340/0.016", "ms"},
+			wantIP:   "66.110.57.41",
+			wantRTT:  []float64{0.298, 0.318, 0.340, 0.016},
+		},
+		{
+			name:     "ipv4-mapped",
+			protocol: "tcp",
+			parts:    []string{"172.17.95.252", "(::ffff:172.17.95.252)", "0.376", "ms"},
+			wantIP:   "172.17.95.252",
+			wantRTT:  []float64{0.376},
+		},
+		{
+			// An out of range rtt is malformed, and counted by the caller.
+			name:     "overflow-rtt",
+			protocol: "tcp",
+			parts:    []string{"host", "(66.110.57.41)", "1" + strings.Repeat("0", 400), "ms"},
+			wantErr:  true,
+		},
+		{
+			name:     "malformed-rtt",
+			protocol: "icmp",
+			parts:    []string{"host", "(66.110.57.41)", "0.298/0.318", "ms"},
+			wantErr:  true,
+		},
+		{
+			name:     "malformed-ip",
+			protocol: "tcp",
+			parts:    []string{"host", "66.110.57.41", "0.298", "ms"},
+			wantErr:  true,
+		},
+		{
+			name:     "malformed-units",
+			protocol: "tcp",
+			parts:    []string{"host", "(66.110.57.41)", "0.298", "s"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var allNodes, newLeaves []parser.Node
+			err := parser.ProcessOneTuple(tt.parts, tt.protocol, nil, &allNodes, &newLeaves)
+			if tt.wantErr {
+				if !errors.Is(err, parser.ErrMalformedTuple) {
+					t.Errorf("ProcessOneTuple() error = %v, want ErrMalformedTuple", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessOneTuple() error = %v", err)
+			}
+			if len(allNodes) != 1 {
+				t.Fatalf("ProcessOneTuple() nodes = %d, want 1", len(allNodes))
+			}
+			if got := parser.NodeIP(allNodes[0]); got != tt.wantIP {
+				t.Errorf("ProcessOneTuple() ip = %q, want %q", got, tt.wantIP)
+			}
+			if got := parser.NodeRTTs(allNodes[0]); !reflect.DeepEqual(got, tt.wantRTT) {
+				t.Errorf("ProcessOneTuple() rtts = %v, want %v", got, tt.wantRTT)
+			}
+		})
+	}
+}
+
+func TestProcessAllNodesHostnames(t *testing.T) {
+	var allNodes, leaves []parser.Node
+	tuples := [][]string{
+		{"first.example.com", "(10.0.0.1)", "0.376", "ms"},
+		{"second.example.com", "(10.0.0.2)", "0.407", "ms"},
+	}
+	for _, parts := range tuples {
+		var newLeaves []parser.Node
+		if err := parser.ProcessOneTuple(parts, "tcp", leaves, &allNodes, &newLeaves); err != nil {
+			t.Fatalf("ProcessOneTuple() error = %v", err)
+		}
+		leaves = newLeaves
+	}
+
+	hops := parser.ProcessAllNodes(allNodes, "10.0.0.0", "tcp", "paris1", time.Unix(0, 0), "mlab1-lga01")
+	if len(hops) != 2 {
+		t.Fatalf("ProcessAllNodes() hops = %d, want 2", len(hops))
+	}
+	// Hops are returned in reverse order.
+	if got := hops[0].Source.Hostname; got != "first.example.com" {
+		t.Errorf("ProcessAllNodes() source hostname = %q, want %q", got, "first.example.com")
+	}
+	if got := hops[0].Links[0].HopDstHostname; got != "second.example.com" {
+		t.Errorf("ProcessAllNodes() destination hostname = %q, want %q", got, "second.example.com")
+	}
+	if got := hops[1].Links[0].HopDstHostname; got != "first.example.com" {
+		t.Errorf("ProcessAllNodes() first hop destination hostname = %q, want %q", got, "first.example.com")
+	}
+}
+
+func TestParseMalformedTuple(t *testing.T) {
+	rawData := []byte(`traceroute [(172.17.94.34:33456) -> (74.125.224.100:33457)], protocol tcp, algo exhaustive, duration 3 s
+ 1  P(6, 6) 172.17.95.252 (172.17.95.252)  0.376 ms
+ 2  P(6, 6) corrupt.example.com (172.25.252.172  bogus ms
+ 3  P(6, 6) dest.example.com (74.125.224.100)  0.501 ms
+`)
+	counter := metrics.WarningCount.WithLabelValues("pt-daily", "pt", "malformed tuple")
+	before := testutil.ToFloat64(counter)
+	cachedTest, err := parser.Parse(nil, "testdata/PT/20170320T23:53:10Z-172.17.94.34-33456-74.125.224.100-33457.paris", "", rawData,
+		"pt-daily", etl.DataPath{})
+	if err != nil {
+		t.Fatalf("Parse() error = %v, want nil", err)
+	}
+	if n := testutil.ToFloat64(counter) - before; n != 1 {
+		t.Errorf("malformed tuple count = %v, want 1", n)
+	}
+	if len(cachedTest.Hops) == 0 {
+		t.Fatal("Parse() returned no hops")
+	}
+	// The hop after the malformed line is still attached to the last good hop.
+	found := false
+	for _, hop := range cachedTest.Hops {
+		for _, link := range hop.Links {
+			if link.HopDstIP == "74.125.224.100" {
+				found = true
+				if hop.Source.IP != "172.17.95.252" {
+					t.Errorf("hop to destination has source %q, want 172.17.95.252", hop.Source.IP)
+				}
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Parse() dropped the hop after the malformed line: %+v", cachedTest.Hops)
+	}
+}
+
+func TestParseCapturesRawLines(t *testing.T) {
+	defer func(c int) { etl.PTRawLineCapture = c }(etl.PTRawLineCapture)
+	etl.PTRawLineCapture = 2
+
+	corrupt := " 2  P(6, 6) corrupt.example.com (172.25.252.172  bogus ms"
+	rawData := []byte(`traceroute [(172.17.94.34:33456) -> (74.125.224.100:33457)], protocol tcp, algo exhaustive, duration 3 s
+ 1  P(6, 6) 172.17.95.252 (172.17.95.252)  0.376 ms
+` + corrupt + `
+ 3  P(6, 6) dest.example.com (74.125.224.100)  0.501 ms
+`)
+	testName := "testdata/PT/20170320T23:53:10Z-172.17.94.34-33456-74.125.224.100-33457.paris"
+	if _, err := parser.Parse(nil, testName, "", rawData, "pt-daily", etl.DataPath{}); err != nil {
+		t.Fatalf("Parse() error = %v, want nil", err)
+	}
+	lines := parser.PTRawLines()
+	if len(lines) == 0 {
+		t.Fatal("PTRawLines() returned no lines")
+	}
+	got := lines[len(lines)-1]
+	if got.Line != corrupt || got.TestName != testName {
+		t.Errorf("PTRawLines() last = %q from %q, want %q from %q", got.Line, got.TestName, corrupt, testName)
+	}
+
+	// The buffer is bounded by etl.PTRawLineCapture.
+	firstLine := "traceroute [(172.17.94.34:33456) -> bogus"
+	for i := 0; i < 3; i++ {
+		if _, err := parser.Parse(nil, testName, "", []byte(firstLine+"\n"), "pt-daily", etl.DataPath{}); err == nil {
+			t.Fatal("Parse() error = nil, want error for corrupt first line")
+		}
+	}
+	lines = parser.PTRawLines()
+	if len(lines) != 2 {
+		t.Fatalf("PTRawLines() returned %d lines, want 2", len(lines))
+	}
+	for _, l := range lines {
+		if l.Line != firstLine {
+			t.Errorf("PTRawLines() line = %q, want %q", l.Line, firstLine)
+		}
+	}
+}
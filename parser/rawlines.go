@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"sync"
+
+	"github.com/m-lab/etl/etl"
+)
+
+// maxRawLineLen bounds the length of each captured raw line, so that a
+// corrupt file without newlines cannot exhaust memory.
+const maxRawLineLen = 1024
+
+// RawLine is a line of test content that caused a parse error.
+type RawLine struct {
+	TestName string
+	Line     string
+	Err      string
+}
+
+// rawLineBuffer retains the most recent raw lines that caused parse errors.
+type rawLineBuffer struct {
+	mu    sync.Mutex
+	lines []RawLine
+}
+
+// add appends a line to the buffer, discarding the oldest lines so that at
+// most max are retained.  If max <= 0, nothing is retained.
+func (b *rawLineBuffer) add(max int, testName, line string, err error) {
+	if max <= 0 {
+		return
+	}
+	if len(line) > maxRawLineLen {
+		line = line[:maxRawLineLen]
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines = append(b.lines, RawLine{TestName: testName, Line: line, Err: err.Error()})
+	if len(b.lines) > max {
+		b.lines = append([]RawLine(nil), b.lines[len(b.lines)-max:]...)
+	}
+}
+
+func (b *rawLineBuffer) get() []RawLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]RawLine(nil), b.lines...)
+}
+
+var ptRawLines rawLineBuffer
+
+// capturePTRawLine retains a legacy paris-traceroute line that could not be
+// parsed, if enabled by etl.PTRawLineCapture.
+func capturePTRawLine(testName, line string, err error) {
+	ptRawLines.add(etl.PTRawLineCapture, testName, line, err)
+}
+
+// PTRawLines returns the most recently captured legacy paris-traceroute lines
+// that could not be parsed, oldest first.
+func PTRawLines() []RawLine {
+	return ptRawLines.get()
+}
@@ -3,7 +3,6 @@ package parser
 import (
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
@@ -106,7 +105,7 @@ func (p *Scamper1Parser) ParseAndInsert(meta etl.Metadata, testName string, rawC
 	// BigQuery rows must be under 100MB.
 	if len(rawContent) > maxRowSize {
 		metrics.TestTotal.WithLabelValues(p.TableName(), scamper1, "row too big").Inc()
-		return fmt.Errorf("row size too big")
+		return newContentError(etl.SCAMPER1, "row too big", fmt.Errorf("row size too big"))
 	}
 
 	trcParser, err := parser.New("mda")
@@ -119,13 +118,15 @@ func (p *Scamper1Parser) ParseAndInsert(meta etl.Metadata, testName string, rawC
 	archiveURL := meta.ArchiveURL
 	if err != nil {
 		metrics.TestTotal.WithLabelValues(p.TableName(), scamper1, err.Error()).Inc()
-		return fmt.Errorf("failed to parse scamper1 file: %s, archiveURL: %s, error: %w", testName, archiveURL, err)
+		return newContentError(etl.SCAMPER1, "ParseRawData",
+			fmt.Errorf("failed to parse scamper1 file: %s, archiveURL: %s, error: %w", testName, archiveURL, err))
 	}
 
 	scamperOutput, ok := rawData.(parser.Scamper1)
 	if !ok {
 		metrics.TestTotal.WithLabelValues(p.TableName(), scamper1, "failed to convert ParsedData to Scamper1 object").Inc()
-		return fmt.Errorf("failed to convert ParsedData to Scamper1 object for file: %s", testName)
+		return newContentError(etl.SCAMPER1, "Convert",
+			fmt.Errorf("failed to convert ParsedData to Scamper1 object for file: %s", testName))
 	}
 
 	bqScamperOutput := schema.BQScamperOutput{
@@ -136,13 +137,15 @@ func (p *Scamper1Parser) ParseAndInsert(meta etl.Metadata, testName string, rawC
 	parseTracelb(&bqScamperOutput, scamperOutput.Tracelb)
 
 	parseInfo := schema.ParseInfo{
-		Version:     meta.Version,
-		Time:        time.Now(),
-		ArchiveURL:  meta.ArchiveURL,
-		Filename:    testName,
-		GitCommit:   meta.GitCommit,
-		ArchiveSize: meta.ArchiveSize,
-		FileSize:    int64(len(rawContent)),
+		Version:         meta.Version,
+		Time:            NormalizeTime(p.Now()),
+		ArchiveURL:      meta.ArchiveURL,
+		Filename:        testName,
+		GitCommit:       meta.GitCommit,
+		ArchiveSize:     meta.ArchiveSize,
+		FileSize:        int64(len(rawContent)),
+		ArchiveOffset:   meta.ArchiveOffset,
+		ArchiveFileSize: meta.ArchiveFileSize,
 	}
 
 	row := schema.Scamper1Row{
@@ -0,0 +1,58 @@
+package parser
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/row"
+)
+
+// memorySink is a row.Sink that keeps committed rows in memory.
+type memorySink struct {
+	rows []interface{}
+}
+
+func (ms *memorySink) Commit(rows []interface{}, label string) (int, error) {
+	ms.rows = append(ms.rows, rows...)
+	return len(rows), nil
+}
+
+func (ms *memorySink) Close() error { return nil }
+
+// sinkSetter is implemented by parsers that embed *row.Base.
+type sinkSetter interface {
+	SetSink(sink row.Sink) row.Sink
+}
+
+// ParseSingle parses a single named test file with p, and returns the
+// resulting rows.  While parsing, p writes to an in-memory sink instead of its
+// own, so that a specific test can be reprocessed by tooling and tests without
+// a full task.  Any rows already buffered in p are also returned.
+func ParseSingle(p etl.Parser, testName string, content []byte) ([]interface{}, error) {
+	ss, ok := p.(sinkSetter)
+	if !ok {
+		return nil, fmt.Errorf("parser %T does not support ParseSingle", p)
+	}
+	sink := &memorySink{}
+	defer ss.SetSink(ss.SetSink(sink))
+
+	// Parsers that embed row.Base provide their clock.
+	start := time.Now()
+	if c, ok := p.(row.Clock); ok {
+		start = c.Now()
+	}
+	meta := etl.Metadata{
+		Version:     Version(),
+		GitCommit:   GitCommit(),
+		Start:       start,
+		ArchiveSize: int64(len(content)),
+	}
+	if err := p.ParseAndInsert(meta, testName, content); err != nil {
+		return nil, err
+	}
+	if err := p.Flush(); err != nil {
+		return nil, err
+	}
+	return sink.rows, nil
+}
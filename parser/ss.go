@@ -6,7 +6,6 @@ import (
 	"log"
 	"path/filepath"
 	"reflect"
-	"strconv"
 	"strings"
 	"time"
 
@@ -52,7 +51,7 @@ func ExtractLogtimeFromFilename(fileName string) (time.Time, error) {
 		return time.Time{}, err
 	}
 
-	return t, nil
+	return NormalizeTime(t), nil
 }
 
 // ParseKHeader parses the first line of SS file, in format "K: cid PollTime LocalAddress LocalPort ... other_web100_variables_separated_by_space"
@@ -96,32 +95,25 @@ func (ss *SSParser) TableName() string {
 }
 
 // PackDataIntoSchema packs data into sidestream BigQeury schema and buffers it.
-func PackDataIntoSchema(ssValue map[string]string, logTime time.Time, testName string) (schema.SS, error) {
-	localPort, err := strconv.Atoi(ssValue["LocalPort"])
-	if err != nil {
-		return schema.SS{}, err
-	}
-	remotePort, err := strconv.Atoi(ssValue["RemPort"])
-	if err != nil {
-		return schema.SS{}, err
-	}
-
+func PackDataIntoSchema(ssValue map[string]string, logTime time.Time, testName, tableName string) (schema.SS, error) {
 	ssValue["LocalAddress"] = NormalizeIP(ssValue["LocalAddress"])
 	ssValue["RemAddress"] = NormalizeIP(ssValue["RemAddress"])
-	connSpec := &schema.Web100ConnectionSpecification{
-		Local_ip:    ssValue["LocalAddress"],
-		Local_af:    web100.ParseIPFamily(ssValue["LocalAddress"]),
-		Local_port:  int64(localPort),
-		Remote_ip:   ssValue["RemAddress"],
-		Remote_port: int64(remotePort),
-	}
 
 	// NOTE: Annotation was previously done here, using AddGeoDataSS...(), but it now done
 	// in ss.Annotate, prior to inserter.PutAsync
-	snap, err := PopulateSnap(ssValue)
+	snap, err := PopulateSnap(ssValue, tableName)
 	if err != nil {
 		return schema.SS{}, err
 	}
+	// PopulateSnap parses the ports with parseIntField, so a corrupt port is
+	// counted once, and left zero.
+	connSpec := &schema.Web100ConnectionSpecification{
+		Local_ip:    ssValue["LocalAddress"],
+		Local_af:    web100.ParseIPFamily(ssValue["LocalAddress"]),
+		Local_port:  snap.LocalPort,
+		Remote_ip:   ssValue["RemAddress"],
+		Remote_port: snap.RemPort,
+	}
 	web100Log := &schema.Web100LogEntry{
 		LogTime:         logTime.Unix(), // TODO: Should use timestamp, not integer
 		Version:         "unknown",
@@ -167,18 +159,16 @@ func ParseOneLine(snapshot string, varNames []string) (map[string]string, error)
 	return ssValue, nil
 }
 
-// PopulateSnap fills in the snapshot data.
-func PopulateSnap(ssValue map[string]string) (schema.Web100Snap, error) {
+// PopulateSnap fills in the snapshot data.  Corrupt integer fields are
+// counted against tableName and left zero, rather than discarding the test.
+func PopulateSnap(ssValue map[string]string, tableName string) (schema.Web100Snap, error) {
 	var snap = &schema.Web100Snap{}
 	var startTimeUsec int64
 
 	// First, extract StartTimeUsec value before all others so we can combine
 	// it with StartTimeStamp below.
 	if valueStr, ok := ssValue["StartTimeUsec"]; ok {
-		value, err := strconv.ParseInt(valueStr, 10, 64)
-		if err == nil {
-			startTimeUsec = value
-		}
+		startTimeUsec = parseIntField(tableName, "ss", "StartTimeUsec", valueStr, 0)
 	}
 
 	// Process every other snap key.
@@ -195,11 +185,7 @@ func PopulateSnap(ssValue map[string]string) (schema.Web100Snap, error) {
 
 		switch x.Type().String() {
 		case "int64":
-			value, err := strconv.ParseInt(ssValue[key], 10, 64)
-			if err != nil {
-				return *snap, err
-			}
-			x.SetInt(value)
+			x.SetInt(parseIntField(tableName, "ss", key, ssValue[key], 0))
 		case "string":
 			x.Set(reflect.ValueOf(ssValue[key]))
 		case "bool":
@@ -221,7 +207,7 @@ func PopulateSnap(ssValue map[string]string) (schema.Web100Snap, error) {
 
 // IsParsable returns the canonical test type and whether to parse data.
 func (ss *SSParser) IsParsable(testName string, data []byte) (string, bool) {
-	if strings.HasSuffix(testName, ".web100") {
+	if etl.SS.HasParsableSuffix(testName) {
 		return "web100", true
 	}
 	if strings.HasSuffix(testName, ".tra") {
@@ -277,7 +263,7 @@ func (ss *SSParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 			log.Printf("Invalid client IP address: %s with error: %s", ssValue["RemAddress"], err)
 			continue
 		}
-		ssTest, err := PackDataIntoSchema(ssValue, logTime, testName)
+		ssTest, err := PackDataIntoSchema(ssValue, logTime, testName, ss.TableName())
 		if err != nil {
 			metrics.TestTotal.WithLabelValues(
 				ss.TableName(), "ss", "corrupted data").Inc()
@@ -285,8 +271,9 @@ func (ss *SSParser) ParseAndInsert(meta map[string]bigquery.Value, testName stri
 			continue
 		}
 
-		ssTest.ParseTime = time.Now() // for map, use string(time.Now().MarshalText())
+		ssTest.ParseTime = NormalizeTime(ss.Now())
 		ssTest.ParserVersion = Version()
+		ssTest.ArchiveOffset, ssTest.ArchiveFileSize = archivePosition(meta)
 		if meta["filename"] != nil {
 			ssTest.TaskFileName = meta["filename"].(string)
 		}
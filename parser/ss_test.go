@@ -8,7 +8,10 @@ import (
 
 	"cloud.google.com/go/bigquery"
 	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/parser"
 	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/uuid-annotator/annotator"
@@ -29,7 +32,7 @@ func TestPopulateSnap(t *testing.T) {
 	ss_value["TimeStampRcvd"] = "0"
 	ss_value["StartTimeStamp"] = "2222"
 	ss_value["StartTimeUsec"] = "1111"
-	snap, err := parser.PopulateSnap(ss_value)
+	snap, err := parser.PopulateSnap(ss_value, "sidestream")
 	if err != nil {
 		t.Fatalf("Snap fields not populated correctly.")
 	}
@@ -49,6 +52,51 @@ func TestPopulateSnap(t *testing.T) {
 	}
 }
 
+func TestPopulateSnapCorruptField(t *testing.T) {
+	ss_value := map[string]string{
+		"CERcvd":         "not-a-number",
+		"StartTimeStamp": "2222",
+		"StartTimeUsec":  "bad",
+	}
+	before := testutil.ToFloat64(metrics.WarningCount.WithLabelValues("sidestream", "ss", "corrupt field CERcvd"))
+	snap, err := parser.PopulateSnap(ss_value, "sidestream")
+	if err != nil {
+		t.Fatalf("PopulateSnap() error = %v, want nil", err)
+	}
+	if snap.CERcvd != 0 {
+		t.Errorf("CERcvd; got %d; want 0", snap.CERcvd)
+	}
+	if snap.StartTimeStamp != 2222000000 {
+		t.Errorf("StartTimeStamp; got %d; want 2222000000", snap.StartTimeStamp)
+	}
+	if n := testutil.ToFloat64(metrics.WarningCount.WithLabelValues("sidestream", "ss", "corrupt field CERcvd")) - before; n != 1 {
+		t.Errorf("corrupt CERcvd count = %v, want 1", n)
+	}
+}
+
+func TestPackDataIntoSchemaCorruptPort(t *testing.T) {
+	ss_value := map[string]string{
+		"LocalAddress":   "1.2.3.4",
+		"LocalPort":      "bad",
+		"RemAddress":     "5.6.7.8",
+		"RemPort":        "4321",
+		"StartTimeStamp": "2222",
+	}
+	counter := metrics.WarningCount.WithLabelValues("sidestream", "ss", "corrupt field LocalPort")
+	before := testutil.ToFloat64(counter)
+	ss, err := parser.PackDataIntoSchema(ss_value, time.Unix(2222, 0), "test.web100", "sidestream")
+	if err != nil {
+		t.Fatalf("PackDataIntoSchema() error = %v, want nil", err)
+	}
+	spec := ss.Web100_log_entry.Connection_spec
+	if spec.Local_port != 0 || spec.Remote_port != 4321 {
+		t.Errorf("ports = %d, %d, want 0, 4321", spec.Local_port, spec.Remote_port)
+	}
+	if n := testutil.ToFloat64(counter) - before; n != 1 {
+		t.Errorf("corrupt LocalPort count = %v, want 1", n)
+	}
+}
+
 func TestParseOneLine(t *testing.T) {
 	header := "K: cid PollTime LocalAddress LocalPort RemAddress RemPort State SACKEnabled TimestampsEnabled NagleEnabled ECNEnabled SndWinScale RcvWinScale ActiveOpen MSSRcvd WinScaleRcvd WinScaleSent PktsOut DataPktsOut DataBytesOut PktsIn DataPktsIn DataBytesIn SndUna SndNxt SndMax ThruBytesAcked SndISS RcvNxt ThruBytesReceived RecvISS StartTimeSec StartTimeUsec Duration SndLimTransSender SndLimBytesSender SndLimTimeSender SndLimTransCwnd SndLimBytesCwnd SndLimTimeCwnd SndLimTransRwin SndLimBytesRwin SndLimTimeRwin SlowStart CongAvoid CongestionSignals OtherReductions X_OtherReductionsCV X_OtherReductionsCM CongestionOverCount CurCwnd MaxCwnd CurSsthresh LimCwnd MaxSsthresh MinSsthresh FastRetran Timeouts SubsequentTimeouts CurTimeoutCount AbruptTimeouts PktsRetrans BytesRetrans DupAcksIn SACKsRcvd SACKBlocksRcvd PreCongSumCwnd PreCongSumRTT PostCongSumRTT PostCongCountRTT ECERcvd SendStall QuenchRcvd RetranThresh NonRecovDA AckAfterFR DSACKDups SampleRTT SmoothedRTT RTTVar MaxRTT MinRTT SumRTT CountRTT CurRTO MaxRTO MinRTO CurMSS MaxMSS MinMSS X_Sndbuf X_Rcvbuf CurRetxQueue MaxRetxQueue CurAppWQueue MaxAppWQueue CurRwinSent MaxRwinSent MinRwinSent LimRwin DupAcksOut CurReasmQueue MaxReasmQueue CurAppRQueue MaxAppRQueue X_rcv_ssthresh X_wnd_clamp X_dbg1 X_dbg2 X_dbg3 X_dbg4 CurRwinRcvd MaxRwinRcvd MinRwinRcvd LocalAddressType X_RcvRTT WAD_IFQ WAD_MaxBurst WAD_MaxSsthresh WAD_NoAI WAD_CwndAdjust"
 	var_names, err := parser.ParseKHeader(header)
@@ -65,6 +113,38 @@ func TestParseOneLine(t *testing.T) {
 	}
 }
 
+func TestSSParserParsableSuffixes(t *testing.T) {
+	defer etl.SetParsableSuffixes(etl.SS, etl.SS.ParsableSuffixes())
+
+	filename := "testdata/sidestream/20170203T00:00:00Z_ALL0.web100"
+	rawData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("cannot read testdata.")
+	}
+	renamed := filename + ".txt"
+	ins := &inMemoryInserter{}
+	p := parser.NewSSParser(ins, "sidestream", "")
+	if _, ok := p.IsParsable(renamed, rawData); ok {
+		t.Errorf("IsParsable(%q) = true before enabling .web100.txt", renamed)
+	}
+
+	etl.SetParsableSuffixes(etl.SS, append(etl.SS.ParsableSuffixes(), ".web100.txt"))
+	kind, ok := p.IsParsable(renamed, rawData)
+	if !ok || kind != "web100" {
+		t.Fatalf("IsParsable(%q) = %q, %v, want web100, true", renamed, kind, ok)
+	}
+	meta := map[string]bigquery.Value{"filename": "gs://archive-measurement-lab/sidestream/2019/11/20/20191120T010010Z-mlab1-ord03-sidestream-0000.tgz"}
+	if err := p.ParseAndInsert(meta, renamed, rawData); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if ins.Committed() != 6 {
+		t.Errorf("Committed() = %d, want 6", ins.Committed())
+	}
+}
+
 func TestSSInserter(t *testing.T) {
 	ins := &inMemoryInserter{}
 	p := parser.NewSSParser(ins, "sidestream", "")
@@ -88,7 +88,7 @@ func (p *SwitchParser) ParseAndInsert(meta etl.Metadata, testName string, rawCon
 			metrics.TestTotal.WithLabelValues(
 				p.TableName(), string(etl.SW), "Decode").Inc()
 			// TODO(dev) Should accumulate errors, instead of aborting?
-			return err
+			return newContentError(etl.SW, "Decode", err)
 		}
 
 		// For collectd in the "utilization" experiment, by design, the raw data
@@ -137,13 +137,15 @@ func (p *SwitchParser) ParseAndInsert(meta etl.Metadata, testName string, rawCon
 					ID:   fmt.Sprintf("%s-%s-%d", machine, site, sample.Timestamp),
 					Date: archiveDate,
 					Parser: schema.ParseInfo{
-						Version:     meta.Version,
-						Time:        time.Now(),
-						ArchiveURL:  meta.ArchiveURL,
-						Filename:    testName,
-						GitCommit:   meta.GitCommit,
-						ArchiveSize: meta.ArchiveSize,
-						FileSize:    int64(len(rawContent)),
+						Version:         meta.Version,
+						Time:            NormalizeTime(p.Now()),
+						ArchiveURL:      meta.ArchiveURL,
+						Filename:        testName,
+						GitCommit:       meta.GitCommit,
+						ArchiveSize:     meta.ArchiveSize,
+						FileSize:        int64(len(rawContent)),
+						ArchiveOffset:   meta.ArchiveOffset,
+						ArchiveFileSize: meta.ArchiveFileSize,
 					},
 					A: &schema.SwitchSummary{
 						Machine:        machine,
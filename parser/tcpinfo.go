@@ -18,9 +18,6 @@ import (
 	"io"
 	"log"
 	"strings"
-	"time"
-
-	"github.com/valyala/gozstd"
 
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/snapshot"
@@ -87,7 +84,8 @@ func (p *TCPInfoParser) Flush() error {
 
 // IsParsable returns the canonical test type and whether to parse data.
 func (p *TCPInfoParser) IsParsable(testName string, data []byte) (string, bool) {
-	if strings.HasSuffix(testName, "jsonl.zst") {
+	// The storage layer decompresses .jsonl.zst files, and removes the .zst.
+	if strings.HasSuffix(testName, "jsonl") {
 		return "tcpinfo", true
 	}
 	return "", false
@@ -117,14 +115,6 @@ func (p *TCPInfoParser) ParseAndInsert(meta etl.Metadata, testName string, rawCo
 	defer metrics.WorkerState.WithLabelValues(tableName, "tcpinfo").Dec()
 
 	var err error
-	if strings.HasSuffix(testName, "zst") {
-		rawContent, err = gozstd.Decompress(nil, rawContent)
-		if err != nil {
-			metrics.TestTotal.WithLabelValues(p.TableName(), "tcpinfo", "zstd error").Inc()
-			return err
-		}
-	}
-
 	// This contains metadata and all snapshots from a single connection.
 	rdr := bytes.NewReader(rawContent)
 	ar := netlink.NewArchiveReader(rdr)
@@ -158,7 +148,7 @@ func (p *TCPInfoParser) ParseAndInsert(meta etl.Metadata, testName string, rawCo
 		log.Println(err)
 		metrics.TestTotal.WithLabelValues(p.TableName(), "tcpinfo", "decode error").Inc()
 		metrics.ErrorCount.WithLabelValues(p.TableName(), "tcpinfo", "decode error").Inc()
-		return err
+		return newContentError(etl.TCPINFO, "decode error", err)
 	}
 
 	if len(snaps) < 1 {
@@ -181,13 +171,15 @@ func (p *TCPInfoParser) ParseAndInsert(meta etl.Metadata, testName string, rawCo
 			FinalSnapshot: snaps[len(snaps)-1],
 		},
 		Parser: schema.ParseInfo{
-			Version:     meta.Version,
-			Time:        time.Now(),
-			ArchiveURL:  meta.ArchiveURL,
-			Filename:    testName,
-			GitCommit:   meta.GitCommit,
-			ArchiveSize: meta.ArchiveSize,
-			FileSize:    int64(len(rawContent)),
+			Version:         meta.Version,
+			Time:            NormalizeTime(p.Now()),
+			ArchiveURL:      meta.ArchiveURL,
+			Filename:        testName,
+			GitCommit:       meta.GitCommit,
+			ArchiveSize:     meta.ArchiveSize,
+			FileSize:        int64(len(rawContent)),
+			ArchiveOffset:   meta.ArchiveOffset,
+			ArchiveFileSize: meta.ArchiveFileSize,
 		},
 		Date: meta.Date,
 		Raw: &snapshot.ConnectionLog{
@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/m-lab/go/logx"
 
+	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/metrics"
 )
 
@@ -156,20 +159,127 @@ func (buf *Buffer) Reset() []interface{} {
 	return res
 }
 
+// Results summarizes the outcome of the ParseAndInsert calls for a task.
+// It complements the prometheus metrics with per-task totals, for
+// structured logging.
+type Results struct {
+	Tests   int            // Number of ParseAndInsert calls.
+	Parsed  int            // Calls that returned nil.
+	Errors  int            // Calls that returned an error.
+	Content int            // Errors that the parser classified as a ProcessingError, e.g. corrupt content.
+	Skipped map[string]int // Tests skipped without calling ParseAndInsert, by reason.
+	Rows    int            // Rows Put to the buffer.
+}
+
+// ResultRecorder is implemented by parsers that accumulate Results.  All
+// parsers that embed Base implement it.
+type ResultRecorder interface {
+	RecordStart()
+	RecordTest(err error)
+	RecordSkip(reason string)
+	Results() Results
+}
+
+// IPRewriter is implemented by rows whose client IP fields may be rewritten
+// before the rows are committed.  Every row type that carries a client
+// address implements it.  Annotation and pcap rows carry none.
+type IPRewriter interface {
+	// RewriteClientIPs replaces the value of each client IP field with
+	// f(value).  Empty fields are left unchanged.  Fields derived from the
+	// client address, such as test ids built from file names, are rewritten
+	// too, and client hostnames are removed.
+	RewriteClientIPs(f func(ip string) string)
+}
+
+// ClientIPTransform, if non-nil, is applied by Base.Put to the client IP
+// fields of each row that implements IPRewriter.  It provides a single place
+// to anonymize or truncate client IPs for privacy preserving exports.  It
+// should be set before any parsers are created.
+var ClientIPTransform func(ip string) string
+
+// ReplaceAddress returns s with each occurrence of addr replaced by repl.
+// Occurrences that are part of a longer address or name, e.g. 1.2.3.4 in
+// 11.2.3.45, are left unchanged.  An empty addr leaves s unchanged.
+func ReplaceAddress(s, addr, repl string) string {
+	if addr == "" {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, addr)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(addr)
+		if (i > 0 && isAddressChar(s[i-1])) || (end < len(s) && isAddressChar(s[end])) {
+			b.WriteString(s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(repl)
+		s = s[end:]
+	}
+}
+
+// isAddressChar returns true for the letters, digits and dots that may
+// extend an address or name.  Colons are excluded, as they also separate
+// ports from addresses in file names.
+func isAddressChar(c byte) bool {
+	return c == '.' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// Clock provides the current time.  Parsers get the time from their Base,
+// so that tests can control time dependent behavior, such as parse times.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts an ordinary function to the Clock interface.
+type ClockFunc func() time.Time
+
+// Now returns f().
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
 // Base provides common parser functionality.
 // Base is NOT THREAD-SAFE
 type Base struct {
 	sink  Sink
 	buf   *Buffer
 	label string // Used in metrics and errors.
+	start time.Time // When the current task started, or zero.
+	clock Clock
 
 	stats ActiveStats
+
+	results Results
 }
 
 // NewBase creates a new Base.  This will generally be embedded in a type specific parser.
 func NewBase(label string, sink Sink, bufSize int) *Base {
 	buf := NewBuffer(bufSize)
-	return &Base{sink: sink, buf: buf, label: label}
+	return &Base{sink: sink, buf: buf, label: label, clock: ClockFunc(time.Now)}
+}
+
+// SetClock replaces the clock used by Now.  It is intended for tests.
+func (pb *Base) SetClock(c Clock) {
+	pb.clock = c
+}
+
+// SetSink replaces the sink that committed rows are written to, and returns
+// the previous sink.  It is intended for tests and tooling.
+func (pb *Base) SetSink(sink Sink) Sink {
+	prev := pb.sink
+	pb.sink = sink
+	return prev
+}
+
+// Now returns the current time, according to the parser's clock.
+func (pb *Base) Now() time.Time {
+	return pb.clock.Now()
 }
 
 // GetStats returns the buffer/sink stats.
@@ -177,6 +287,45 @@ func (pb *Base) GetStats() Stats {
 	return pb.stats.GetStats()
 }
 
+// RecordStart records the start of a task, for the TestsPerSecond metric.
+func (pb *Base) RecordStart() {
+	pb.start = pb.Now()
+}
+
+// RecordTest records the result of a ParseAndInsert call.
+func (pb *Base) RecordTest(err error) {
+	pb.results.Tests++
+	if err != nil {
+		pb.results.Errors++
+		var pErr etl.ProcessingError
+		if errors.As(err, &pErr) {
+			pb.results.Content++
+		}
+	} else {
+		pb.results.Parsed++
+	}
+}
+
+// RecordSkip records a test that was skipped without calling ParseAndInsert.
+func (pb *Base) RecordSkip(reason string) {
+	if pb.results.Skipped == nil {
+		pb.results.Skipped = make(map[string]int)
+	}
+	pb.results.Skipped[reason]++
+}
+
+// Results returns a copy of the results accumulated so far.
+func (pb *Base) Results() Results {
+	r := pb.results
+	if pb.results.Skipped != nil {
+		r.Skipped = make(map[string]int, len(pb.results.Skipped))
+		for k, v := range pb.results.Skipped {
+			r.Skipped[k] = v
+		}
+	}
+	return r
+}
+
 // TaskError return the task level error, based on failed rows, or any other criteria.
 func (pb *Base) TaskError() error {
 	return nil
@@ -196,11 +345,21 @@ func (pb *Base) commit(rows []interface{}) error {
 	return err
 }
 
-// Flush synchronously flushes any pending rows.
+// Flush synchronously flushes any pending rows.  The first Flush after
+// RecordStart, i.e. the final flush of the task, also sets the TestsPerSecond
+// throughput metric.
 func (pb *Base) Flush() error {
 	rows := pb.buf.Reset()
 	pb.stats.MoveToPending(len(rows))
-	return pb.commit(rows)
+	err := pb.commit(rows)
+	if !pb.start.IsZero() {
+		if elapsed := pb.Now().Sub(pb.start).Seconds(); elapsed > 0 {
+			metrics.TestsPerSecond.WithLabelValues(pb.label).Set(
+				float64(pb.results.Tests) / elapsed)
+		}
+		pb.start = time.Time{}
+	}
+	return err
 }
 
 // Put adds a row to the buffer. If the buffer is already full, then prior
@@ -209,8 +368,12 @@ func (pb *Base) Flush() error {
 // of rows is "committed", they will be written to the Sink in the same order
 // they were Put.
 func (pb *Base) Put(row interface{}) error {
+	if rw, ok := row.(IPRewriter); ok && ClientIPTransform != nil {
+		rw.RewriteClientIPs(ClientIPTransform)
+	}
 	rows := pb.buf.Append(row)
 	pb.stats.Inc()
+	pb.results.Rows++
 
 	if rows != nil {
 		pb.stats.MoveToPending(len(rows))
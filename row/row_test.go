@@ -2,9 +2,13 @@ package row_test
 
 import (
 	"errors"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/row"
 )
 
@@ -21,6 +25,10 @@ func (row *Row) GetClientIPs() []string {
 	return []string{row.client}
 }
 
+func (row *Row) RewriteClientIPs(f func(ip string) string) {
+	row.client = f(row.client)
+}
+
 func (row *Row) GetServerIP() string {
 	return row.server
 }
@@ -72,6 +80,49 @@ func TestBase(t *testing.T) {
 	}
 }
 
+func TestBaseClock(t *testing.T) {
+	b := row.NewBase("clock", &inMemorySink{}, 10)
+	before := time.Now()
+	if now := b.Now(); now.Before(before) || now.After(time.Now()) {
+		t.Errorf("Now() = %v, want real time", now)
+	}
+
+	fixed := time.Date(2020, 3, 18, 1, 2, 3, 0, time.UTC)
+	b.SetClock(row.ClockFunc(func() time.Time { return fixed }))
+	if now := b.Now(); !now.Equal(fixed) {
+		t.Errorf("Now() = %v, want %v", now, fixed)
+	}
+}
+
+func TestBaseTestsPerSecond(t *testing.T) {
+	metrics.TestsPerSecond.Reset()
+	now := time.Date(2020, 3, 18, 1, 2, 3, 0, time.UTC)
+	b := row.NewBase("throughput", &inMemorySink{}, 2)
+	b.SetClock(row.ClockFunc(func() time.Time { return now }))
+
+	b.RecordStart()
+	for i := 0; i < 5; i++ {
+		b.Put(&Row{"1.2.3.4", "4.3.2.1"})
+		b.RecordTest(nil)
+	}
+	now = now.Add(2 * time.Second)
+	b.Flush()
+
+	// 5 tests in 2 seconds.
+	rate := testutil.ToFloat64(metrics.TestsPerSecond.WithLabelValues("throughput"))
+	if rate != 2.5 {
+		t.Errorf("TestsPerSecond = %f, want 2.5", rate)
+	}
+
+	// The rate is only set by the final flush of a task.
+	now = now.Add(8 * time.Second)
+	b.Flush()
+	rate = testutil.ToFloat64(metrics.TestsPerSecond.WithLabelValues("throughput"))
+	if rate != 2.5 {
+		t.Errorf("TestsPerSecond = %f after a second Flush, want 2.5", rate)
+	}
+}
+
 func TestAsyncPut(t *testing.T) {
 	ins := &inMemorySink{}
 
@@ -117,3 +168,51 @@ func TestErrCommitRow(t *testing.T) {
 		t.Errorf("ErrCommitRow.As() failed to recognize error as ErrCommitRow, expected: true, got: false")
 	}
 }
+
+func zeroLastOctet(ip string) string {
+	addr := net.ParseIP(ip).To4()
+	if addr == nil {
+		return ip
+	}
+	addr[3] = 0
+	return addr.String()
+}
+
+func TestBaseClientIPTransform(t *testing.T) {
+	defer func(f func(string) string) { row.ClientIPTransform = f }(row.ClientIPTransform)
+	row.ClientIPTransform = zeroLastOctet
+
+	ins := &inMemorySink{}
+	b := row.NewBase("test", ins, 10)
+	b.Put(&Row{"1.2.3.4", "4.3.2.1"})
+	b.Put(&BadRow{})
+	b.Flush()
+
+	if len(ins.data) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(ins.data))
+	}
+	r := ins.data[0].(*Row)
+	if r.client != "1.2.3.0" {
+		t.Errorf("client = %q, want %q", r.client, "1.2.3.0")
+	}
+	if r.server != "4.3.2.1" {
+		t.Errorf("server = %q, want %q", r.server, "4.3.2.1")
+	}
+}
+
+func TestReplaceAddress(t *testing.T) {
+	tests := []struct {
+		s, addr, want string
+	}{
+		{"20170501T23:58:07Z-4.3.2.1-40835-1.2.3.4-8080.paris", "1.2.3.4", "20170501T23:58:07Z-4.3.2.1-40835-X-8080.paris"},
+		{"11.2.3.45_1.2.3.4:80", "1.2.3.4", "11.2.3.45_X:80"},
+		{"1.2.3.4", "1.2.3.4", "X"},
+		{"1.2.3.4-1.2.3.4", "1.2.3.4", "X-X"},
+		{"1.2.3.4", "", "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		if got := row.ReplaceAddress(tt.s, tt.addr, "X"); got != tt.want {
+			t.Errorf("ReplaceAddress(%q, %q) = %q, want %q", tt.s, tt.addr, got, tt.want)
+		}
+	}
+}
@@ -31,6 +31,19 @@ type NDT5Summary struct {
 	LossRate           float64
 }
 
+// RewriteClientIPs implements row.IPRewriter.
+func (r *NDT5ResultRowV2) RewriteClientIPs(f func(ip string) string) {
+	if r.Raw.ClientIP != "" {
+		r.Raw.ClientIP = f(r.Raw.ClientIP)
+	}
+	if r.Raw.C2S != nil && r.Raw.C2S.ClientIP != "" {
+		r.Raw.C2S.ClientIP = f(r.Raw.C2S.ClientIP)
+	}
+	if r.Raw.S2C != nil && r.Raw.S2C.ClientIP != "" {
+		r.Raw.S2C.ClientIP = f(r.Raw.S2C.ClientIP)
+	}
+}
+
 // Schema returns the BigQuery schema for NDT5ResultRow.
 func (row *NDT5ResultRowV2) Schema() (bigquery.Schema, error) {
 	sch, err := bigquery.InferSchema(row)
@@ -7,6 +7,8 @@ import (
 	"cloud.google.com/go/bigquery"
 
 	"github.com/m-lab/go/cloud/bqx"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/ndt5/s2c"
 )
 
 func TestNDT5ResultV2_Schema(t *testing.T) {
@@ -51,3 +53,20 @@ func TestNDT5ResultV2_Schema(t *testing.T) {
 		t.Log(descriptions, "!=", fields)
 	}
 }
+
+func TestNDT5ResultV2_RewriteClientIPs(t *testing.T) {
+	row := &NDT5ResultRowV2{
+		Raw: data.NDT5Result{
+			ServerIP: "4.3.2.1",
+			ClientIP: "1.2.3.4",
+			S2C:      &s2c.ArchivalData{ServerIP: "4.3.2.1", ClientIP: "1.2.3.4"},
+		},
+	}
+	row.RewriteClientIPs(func(ip string) string { return "0.0.0.0" })
+	if row.Raw.ClientIP != "0.0.0.0" || row.Raw.S2C.ClientIP != "0.0.0.0" {
+		t.Errorf("RewriteClientIPs() client IPs = %q, %q, want 0.0.0.0", row.Raw.ClientIP, row.Raw.S2C.ClientIP)
+	}
+	if row.Raw.ServerIP != "4.3.2.1" || row.Raw.S2C.ServerIP != "4.3.2.1" {
+		t.Errorf("RewriteClientIPs() changed server IPs = %q, %q", row.Raw.ServerIP, row.Raw.S2C.ServerIP)
+	}
+}
@@ -29,6 +29,24 @@ type NDT7Summary struct {
 	MeanThroughputMbps float64
 	MinRTT             float64
 	LossRate           float64
+
+	// DownloadSamples and UploadSamples are the server application byte
+	// counts over the course of each measurement, sampled to bound row size.
+	DownloadSamples []NDT7ByteSample
+	UploadSamples   []NDT7ByteSample
+}
+
+// NDT7ByteSample is a single application level byte count measurement.
+type NDT7ByteSample struct {
+	ElapsedTime int64 // Microseconds since the start of the measurement.
+	NumBytes    int64
+}
+
+// RewriteClientIPs implements row.IPRewriter.
+func (r *NDT7ResultRow) RewriteClientIPs(f func(ip string) string) {
+	if r.Raw.ClientIP != "" {
+		r.Raw.ClientIP = f(r.Raw.ClientIP)
+	}
 }
 
 // Schema returns the BigQuery schema for NDT7ResultRow.
@@ -6,6 +6,7 @@ import (
 	"cloud.google.com/go/bigquery"
 
 	"github.com/m-lab/go/cloud/bqx"
+	"github.com/m-lab/ndt-server/data"
 )
 
 func TestNDT7Result_Schema(t *testing.T) {
@@ -34,3 +35,14 @@ func TestNDT7Result_Schema(t *testing.T) {
 		t.Errorf("NDT7Result.Schema() missing expected fields; got %d, want 3", count)
 	}
 }
+
+func TestNDT7Result_RewriteClientIPs(t *testing.T) {
+	row := &NDT7ResultRow{Raw: data.NDT7Result{ServerIP: "4.3.2.1", ClientIP: "1.2.3.4"}}
+	row.RewriteClientIPs(func(ip string) string { return "0.0.0.0" })
+	if row.Raw.ClientIP != "0.0.0.0" {
+		t.Errorf("RewriteClientIPs() ClientIP = %q, want 0.0.0.0", row.Raw.ClientIP)
+	}
+	if row.Raw.ServerIP != "4.3.2.1" {
+		t.Errorf("RewriteClientIPs() changed ServerIP = %q", row.Raw.ServerIP)
+	}
+}
@@ -14,16 +14,22 @@ import (
 //
 // TODO: migrate parser/ndt.go to use native struct, then migrate to standard columns.
 type NDTWeb100 struct {
-	ID             string            `bigquery:"id"`
-	TestID         string            `bigquery:"test_id"`
-	TaskFilename   string            `bigquery:"task_filename"`
-	ParseTime      time.Time         `bigquery:"parse_time"`
-	ParserVersion  string            `bigquery:"parser_version"`
-	LogTime        time.Time         `bigquery:"log_time"`
-	BlacklistFlags int64             `bigquery:"blacklist_flags"`
-	Anomalies      ndtAnomalies      `bigquery:"anomalies"`
-	ConnectionSpec ndtConnectionSpec `bigquery:"connection_spec"`
-	Web100LogEntry web100LogEntry    `bigquery:"web100_log_entry"`
+	ID              string            `bigquery:"id"`
+	TestID          string            `bigquery:"test_id"`
+	TaskFilename    string            `bigquery:"task_filename"`
+	ParseTime       time.Time         `bigquery:"parse_time"`
+	ParserVersion   string            `bigquery:"parser_version"`
+	ArchiveOffset   int64             `bigquery:"archive_offset"`
+	ArchiveFileSize int64             `bigquery:"archive_file_size"`
+	LogTime         time.Time         `bigquery:"log_time"`
+	BlacklistFlags  int64             `bigquery:"blacklist_flags"`
+	ClientIP        string            `bigquery:"client_ip"`
+	ClientPort      int64             `bigquery:"client_port"`
+	ServerIP        string            `bigquery:"server_ip"`
+	ServerPort      int64             `bigquery:"server_port"`
+	Anomalies       ndtAnomalies      `bigquery:"anomalies"`
+	ConnectionSpec  ndtConnectionSpec `bigquery:"connection_spec"`
+	Web100LogEntry  web100LogEntry    `bigquery:"web100_log_entry"`
 }
 
 type ndtAnomalies struct {
@@ -31,6 +37,14 @@ type ndtAnomalies struct {
 	SnaplogError   bool  `bigquery:"snaplog_error"`
 	NumSnaps       int64 `bigquery:"num_snaps"`
 	BlacklistFlags int64 `bigquery:"blacklist_flags"`
+	GroupFiles     int64 `bigquery:"group_files"`
+	DeltaStride    int64 `bigquery:"delta_stride"`
+
+	TimestampCollision   bool `bigquery:"timestamp_collision"`
+	TimeMismatch         bool `bigquery:"time_mismatch"`
+	NonMonotonicDuration bool `bigquery:"non_monotonic_duration"`
+	SuspiciousString     bool `bigquery:"suspicious_string"`
+	MissingSnapAddress   bool `bigquery:"missing_snap_address"`
 }
 
 type ndtConnectionSpec struct {
@@ -85,6 +99,20 @@ type web100LogEntry struct {
 	ConnectionSpec web100ConnectionSpec `bigquery:"connection_spec"`
 	Snap           web100Snap           `bigquery:"snap"`
 	Deltas         []web100Deltas       `bigquery:"deltas"`
+
+	// FinalSnapshot is the unmodified final snapshot, only present when
+	// the parser is run with etl.IncludeFinalSnapshot.
+	FinalSnapshot *web100Snap `bigquery:"final_snapshot"`
+
+	// StateTransitions is the sequence of TCP states, with the first
+	// snapshot in each state.  It is only present when the parser is run
+	// with etl.NDTStateTransitions.
+	StateTransitions []web100StateTransition `bigquery:"state_transitions"`
+}
+
+type web100StateTransition struct {
+	State       int64 `bigquery:"state"`
+	SnapshotNum int64 `bigquery:"snapshot_num"`
 }
 
 type web100Snap struct {
@@ -9,6 +9,8 @@ import (
 	"github.com/m-lab/go/cloud/bqx"
 	"github.com/m-lab/traceroute-caller/hopannotation"
 	"github.com/m-lab/uuid-annotator/annotator"
+
+	"github.com/m-lab/etl/row"
 )
 
 type HopIP struct {
@@ -17,18 +19,31 @@ type HopIP struct {
 	CountryCode    string                        `json:"country_code" bigquery:"CountryCode"`
 	Hostname       string                        `json:"hostname" bigquery:"Hostname"`
 	ASN            uint32                        `json:"asn,uint32" bigquery:"ASN"`
+	QTTL           int64                         `json:"q_ttl,int64" bigquery:"q_ttl"` // TTL quoted in ICMP replies.
 	HopAnnotation1 *hopannotation.HopAnnotation1 `json:"hopannotation1" bigquery:"HopAnnotation1"`
 }
 
+// HopReply holds the ICMP details of one reply to a probe.  The ICMP type
+// and code distinguish, e.g., time exceeded from destination unreachable.
+type HopReply struct {
+	ICMPType int64 `json:"icmp_type,int64" bigquery:"icmp_type"`
+	ICMPCode int64 `json:"icmp_code,int64" bigquery:"icmp_code"`
+	ICMPQTOS int64 `json:"icmp_q_tos,int64" bigquery:"icmp_q_tos"` // TOS quoted in the ICMP reply.
+	ICMPQTTL int64 `json:"icmp_q_ttl,int64" bigquery:"icmp_q_ttl"` // TTL quoted in the ICMP reply.
+}
+
 type HopProbe struct {
 	Flowid int64     `json:"flowid,int64"`
 	Rtt    []float64 `json:"rtt"`
+	// Replies parallels Rtt.  It is only populated for scamper traces.
+	Replies []HopReply `json:"replies" bigquery:"replies"`
 }
 
 type HopLink struct {
-	HopDstIP string     `json:"hop_dst_ip"`
-	TTL      int64      `json:"ttl,int64"`
-	Probes   []HopProbe `json:"probes"`
+	HopDstIP       string     `json:"hop_dst_ip"`
+	HopDstHostname string     `json:"hop_dst_hostname"`
+	TTL            int64      `json:"ttl,int64"`
+	Probes         []HopProbe `json:"probes"`
 }
 
 type ScamperHop struct {
@@ -43,6 +58,8 @@ type PTTest struct {
 	Parseinfo      ParseInfoV0  `json:"parseinfo"`
 	StartTime      int64        `json:"start_time,int64" bigquery:"start_time"`
 	StopTime       int64        `json:"stop_time,int64" bigquery:"stop_time"`
+	StopReason     string       `json:"stop_reason" bigquery:"stop_reason"`
+	StopData       int64        `json:"stop_data,int64" bigquery:"stop_data"`
 	ScamperVersion string       `json:"scamper_version" bigquery:"scamper_version"`
 	Source         ServerInfo   `json:"source"`
 	Destination    ClientInfo   `json:"destination"`
@@ -51,12 +68,41 @@ type PTTest struct {
 	Hop            []ScamperHop `json:"hop"`
 	ExpVersion     string       `json:"exp_version" bigquery:"exp_version"`
 	CachedResult   bool         `json:"cached_result,bool" bigquery:"cached_result"`
+	Degenerate     bool         `json:"degenerate,bool" bigquery:"degenerate"`
+	EmptyTrace     bool         `json:"empty_trace,bool" bigquery:"empty_trace"`
+	ListName       string       `json:"list_name" bigquery:"list_name"`
+	UserID         int64        `json:"userid,int64" bigquery:"userid"`
+	CycleID        int64        `json:"cycle_id,int64" bigquery:"cycle_id"`
 
 	// ServerX and ClientX are for the synthetic UUID annotator export process.
 	ServerX annotator.ServerAnnotations
 	ClientX annotator.ClientAnnotations
 }
 
+// RewriteClientIPs implements row.IPRewriter.  The client is the traceroute
+// destination, so hops to or from the destination are also rewritten, and
+// their hostnames removed.  The test file name may also contain the client IP.
+func (r *PTTest) RewriteClientIPs(f func(ip string) string) {
+	client := r.Destination.IP
+	if client == "" {
+		return
+	}
+	r.Destination.IP = f(client)
+	r.Parseinfo.Filename = row.ReplaceAddress(r.Parseinfo.Filename, client, r.Destination.IP)
+	for i := range r.Hop {
+		if r.Hop[i].Source.IP == client {
+			r.Hop[i].Source.IP = r.Destination.IP
+			r.Hop[i].Source.Hostname = ""
+		}
+		for j := range r.Hop[i].Links {
+			if r.Hop[i].Links[j].HopDstIP == client {
+				r.Hop[i].Links[j].HopDstIP = r.Destination.IP
+				r.Hop[i].Links[j].HopDstHostname = ""
+			}
+		}
+	}
+}
+
 // Schema returns the Bigquery schema for PTTest.
 func (row *PTTest) Schema() (bigquery.Schema, error) {
 	sch, err := bigquery.InferSchema(row)
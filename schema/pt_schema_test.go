@@ -9,3 +9,37 @@ TODO:
 * restore standard schema unit tests for v2 schema.
 
 */
+
+import (
+	"testing"
+
+	"github.com/m-lab/etl/schema"
+)
+
+func TestPTTest_RewriteClientIPs(t *testing.T) {
+	row := &schema.PTTest{
+		Parseinfo:   schema.ParseInfoV0{Filename: "20170501T23:58:07Z-4.3.2.1-40835-1.2.3.4-8080.paris"},
+		Source:      schema.ServerInfo{IP: "4.3.2.1"},
+		Destination: schema.ClientInfo{IP: "1.2.3.4"},
+		Hop: []schema.ScamperHop{
+			{
+				Source: schema.HopIP{IP: "1.2.3.4", Hostname: "client.example.com"},
+				Links:  []schema.HopLink{{HopDstIP: "1.2.3.4", HopDstHostname: "client.example.com"}},
+			},
+		},
+	}
+	row.RewriteClientIPs(func(ip string) string { return "0.0.0.0" })
+	if row.Destination.IP != "0.0.0.0" || row.Source.IP != "4.3.2.1" {
+		t.Errorf("RewriteClientIPs() Source, Destination = %q, %q", row.Source.IP, row.Destination.IP)
+	}
+	if want := "20170501T23:58:07Z-4.3.2.1-40835-0.0.0.0-8080.paris"; row.Parseinfo.Filename != want {
+		t.Errorf("RewriteClientIPs() Filename = %q, want %q", row.Parseinfo.Filename, want)
+	}
+	hop := row.Hop[0]
+	if hop.Source.IP != "0.0.0.0" || hop.Source.Hostname != "" {
+		t.Errorf("RewriteClientIPs() hop source = %+v", hop.Source)
+	}
+	if hop.Links[0].HopDstIP != "0.0.0.0" || hop.Links[0].HopDstHostname != "" {
+		t.Errorf("RewriteClientIPs() hop link = %+v", hop.Links[0])
+	}
+}
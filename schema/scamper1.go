@@ -77,6 +77,31 @@ type Scamper1Row struct {
 	Raw    BQScamperOutput `bigquery:"raw"`
 }
 
+// RewriteClientIPs implements row.IPRewriter.  The client is the traceroute
+// destination, so nodes and links at the destination are also rewritten, and
+// their names removed.
+func (r *Scamper1Row) RewriteClientIPs(f func(ip string) string) {
+	client := r.Raw.Tracelb.Dst
+	if client == "" {
+		return
+	}
+	r.Raw.Tracelb.Dst = f(client)
+	for i := range r.Raw.Tracelb.Nodes {
+		node := &r.Raw.Tracelb.Nodes[i]
+		if node.Addr == client {
+			node.Addr = r.Raw.Tracelb.Dst
+			node.Name = ""
+		}
+		for j := range node.Links {
+			for k := range node.Links[j].Links {
+				if node.Links[j].Links[k].Addr == client {
+					node.Links[j].Links[k].Addr = r.Raw.Tracelb.Dst
+				}
+			}
+		}
+	}
+}
+
 // Schema returns the BigQuery schema for Scamper1Row.
 func (row *Scamper1Row) Schema() (bigquery.Schema, error) {
 	sch, err := bigquery.InferSchema(row)
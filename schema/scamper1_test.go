@@ -6,6 +6,7 @@ import (
 
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/go/cloud/bqx"
+	"github.com/m-lab/traceroute-caller/parser"
 )
 
 func TestScamper1Row_Schema(t *testing.T) {
@@ -33,3 +34,24 @@ func TestScamper1Row_Schema(t *testing.T) {
 		t.Errorf("Scamper1.Schema() missing expected fields: got %d, want 4", count)
 	}
 }
+
+func TestScamper1Row_RewriteClientIPs(t *testing.T) {
+	row := &Scamper1Row{}
+	row.Raw.Tracelb.Src = "4.3.2.1"
+	row.Raw.Tracelb.Dst = "1.2.3.4"
+	row.Raw.Tracelb.Nodes = []BQScamperNode{
+		{Addr: "4.3.2.1", Links: []BQScamperLinkArray{{Links: []parser.ScamperLink{{Addr: "1.2.3.4"}}}}},
+		{Addr: "1.2.3.4", Name: "client.example.com"},
+	}
+	row.RewriteClientIPs(func(ip string) string { return "0.0.0.0" })
+	tracelb := row.Raw.Tracelb
+	if tracelb.Dst != "0.0.0.0" || tracelb.Src != "4.3.2.1" {
+		t.Errorf("RewriteClientIPs() Src, Dst = %q, %q, want 4.3.2.1, 0.0.0.0", tracelb.Src, tracelb.Dst)
+	}
+	if tracelb.Nodes[0].Addr != "4.3.2.1" || tracelb.Nodes[0].Links[0].Links[0].Addr != "0.0.0.0" {
+		t.Errorf("RewriteClientIPs() first node = %+v", tracelb.Nodes[0])
+	}
+	if tracelb.Nodes[1].Addr != "0.0.0.0" || tracelb.Nodes[1].Name != "" {
+		t.Errorf("RewriteClientIPs() client node = %+v", tracelb.Nodes[1])
+	}
+}
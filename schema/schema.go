@@ -21,6 +21,11 @@ type ParseInfo struct {
 	GitCommit   string
 	ArchiveSize int64
 	FileSize    int64
+	// ArchiveOffset and ArchiveFileSize locate the file within the archive,
+	// when known, to help find a specific corrupt file.  Both are zero when
+	// the source does not report them.
+	ArchiveOffset   int64
+	ArchiveFileSize int64
 }
 
 // ServerInfo details various kinds of information about the server.
@@ -48,6 +53,10 @@ type ParseInfoV0 struct {
 	ParseTime     time.Time
 	ParserVersion string
 	Filename      string
+	// ArchiveOffset and ArchiveFileSize locate the file within the archive,
+	// like ParseInfo.  Both are zero when the source does not report them.
+	ArchiveOffset   int64
+	ArchiveFileSize int64
 }
 
 /*************************************************************************
@@ -8,6 +8,8 @@ import (
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/go/cloud/bqx"
 	"github.com/m-lab/uuid-annotator/annotator"
+
+	"github.com/m-lab/etl/row"
 )
 
 type Web100ConnectionSpecification struct {
@@ -197,11 +199,27 @@ type SS struct {
 	ParseTime        time.Time      `json:"parse_time" bigquery:"parse_time"`
 	ParserVersion    string         `json:"parser_version" bigquery:"parser_version"`
 	TaskFileName     string         `json:"task_filename" bigquery:"task_filename"`
+	ArchiveOffset    int64          `json:"archive_offset" bigquery:"archive_offset"`
+	ArchiveFileSize  int64          `json:"archive_file_size" bigquery:"archive_file_size"`
 	Type             int64          `json:"type" bigquery:"type"`
 	Anomalies        Anomalies      `json:"anomalies" bigquery:"anomalies"`
 	Web100_log_entry Web100LogEntry `json:"web100_log_entry" bigquery:"web100_log_entry"`
 }
 
+// RewriteClientIPs implements row.IPRewriter.  The client is the remote end
+// of the connection.  The test id may also contain the client IP.
+func (ss *SS) RewriteClientIPs(f func(ip string) string) {
+	client := ss.Web100_log_entry.Connection_spec.Remote_ip
+	if client == "" {
+		return
+	}
+	ss.Web100_log_entry.Connection_spec.Remote_ip = f(client)
+	ss.TestID = row.ReplaceAddress(ss.TestID, client, ss.Web100_log_entry.Connection_spec.Remote_ip)
+	if ss.Web100_log_entry.Snap.RemAddress == client {
+		ss.Web100_log_entry.Snap.RemAddress = ss.Web100_log_entry.Connection_spec.Remote_ip
+	}
+}
+
 func (ss *SS) Schema() (bigquery.Schema, error) {
 	sch, err := bigquery.InferSchema(ss)
 	if err != nil {
@@ -17,3 +17,21 @@ func TestSS_Schema(t *testing.T) {
 		}
 	})
 }
+
+func TestSS_RewriteClientIPs(t *testing.T) {
+	ss := &SS{TestID: "2017/05/16/20170516T22:00:00Z_1.2.3.4_0.web100"}
+	ss.Web100_log_entry.Connection_spec.Local_ip = "4.3.2.1"
+	ss.Web100_log_entry.Connection_spec.Remote_ip = "1.2.3.4"
+	ss.Web100_log_entry.Snap.RemAddress = "1.2.3.4"
+	ss.RewriteClientIPs(func(ip string) string { return "0.0.0.0" })
+	spec := ss.Web100_log_entry.Connection_spec
+	if spec.Remote_ip != "0.0.0.0" || ss.Web100_log_entry.Snap.RemAddress != "0.0.0.0" {
+		t.Errorf("RewriteClientIPs() remote IPs = %q, %q, want 0.0.0.0", spec.Remote_ip, ss.Web100_log_entry.Snap.RemAddress)
+	}
+	if spec.Local_ip != "4.3.2.1" {
+		t.Errorf("RewriteClientIPs() changed Local_ip = %q", spec.Local_ip)
+	}
+	if want := "2017/05/16/20170516T22:00:00Z_0.0.0.0_0.web100"; ss.TestID != want {
+		t.Errorf("RewriteClientIPs() TestID = %q, want %q", ss.TestID, want)
+	}
+}
@@ -0,0 +1,66 @@
+package schema
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl/etl"
+)
+
+type schemaGenerator interface {
+	Schema() (bigquery.Schema, error)
+}
+
+// tableRows maps each data type to an instance of its row type.
+var tableRows = map[etl.DataType]schemaGenerator{
+	etl.ANNOTATION2:    &Annotation2Row{},
+	etl.HOPANNOTATION2: &HopAnnotation2Row{},
+	etl.NDT:            &NDTWeb100{},
+	etl.NDT5:           &NDT5ResultRowV2{},
+	etl.NDT7:           &NDT7ResultRow{},
+	etl.PCAP:           &PCAPRow{},
+	etl.PT:             &PTTest{},
+	etl.SCAMPER1:       &Scamper1Row{},
+	etl.SS:             &SS{},
+	etl.SW:             &SwitchRow{},
+	etl.TCPINFO:        &TCPInfoRow{},
+}
+
+// legacyTypes are the data types that do not use standard columns.  Their
+// tables are partitioned by ingestion time, rather than by the date column.
+var legacyTypes = map[etl.DataType]bool{
+	etl.NDT: true,
+	etl.PT:  true,
+	etl.SS:  true,
+}
+
+// tableClustering holds the recommended clustering fields for data types that
+// benefit from clustering.
+var tableClustering = map[etl.DataType][]string{
+	etl.NDT: {"server_ip", "client_ip"},
+}
+
+// TableSpec returns the schema, and recommended time partitioning and
+// clustering, for the table holding rows of the given data type.  Clustering
+// is nil if none is recommended.  update-schema creates tables from it.
+func TableSpec(dt etl.DataType) (bigquery.Schema, *bigquery.TimePartitioning, *bigquery.Clustering, error) {
+	row, ok := tableRows[dt]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("%w: %s", etl.ErrBadDataType, dt)
+	}
+	sch, err := row.Schema()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	partitioning := &bigquery.TimePartitioning{}
+	if !legacyTypes[dt] {
+		// Standard columns tables are partitioned on the date column.
+		partitioning.Field = "date"
+	}
+	var clustering *bigquery.Clustering
+	if fields, ok := tableClustering[dt]; ok {
+		clustering = &bigquery.Clustering{Fields: fields}
+	}
+	return sch, partitioning, clustering, nil
+}
@@ -0,0 +1,66 @@
+package schema_test
+
+import (
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/schema"
+)
+
+func hasField(sch bigquery.Schema, name string) bool {
+	for _, f := range sch {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTableSpec(t *testing.T) {
+	tests := []struct {
+		dt         etl.DataType
+		field      string // A top level field expected in the schema.
+		partition  string
+		clustering []string
+	}{
+		{dt: etl.NDT, field: "web100_log_entry", clustering: []string{"server_ip", "client_ip"}},
+		{dt: etl.PT, field: "uuid"},
+		{dt: etl.NDT7, field: "date", partition: "date"},
+		{dt: etl.SCAMPER1, field: "date", partition: "date"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.dt), func(t *testing.T) {
+			sch, partitioning, clustering, err := schema.TableSpec(tt.dt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hasField(sch, tt.field) {
+				t.Errorf("schema is missing field %q", tt.field)
+			}
+			if partitioning == nil || partitioning.Field != tt.partition {
+				t.Errorf("partitioning = %+v, want field %q", partitioning, tt.partition)
+			}
+			if tt.clustering == nil {
+				if clustering != nil {
+					t.Errorf("clustering = %v, want nil", clustering.Fields)
+				}
+				return
+			}
+			if clustering == nil {
+				t.Fatalf("clustering = nil, want %v", tt.clustering)
+			}
+			for i, f := range tt.clustering {
+				if clustering.Fields[i] != f || !hasField(sch, f) {
+					t.Errorf("clustering = %v, want %v in schema", clustering.Fields, tt.clustering)
+				}
+			}
+		})
+	}
+
+	if _, _, _, err := schema.TableSpec(etl.INVALID); !errors.Is(err, etl.ErrBadDataType) {
+		t.Errorf("TableSpec(INVALID) error = %v, want ErrBadDataType", err)
+	}
+}
@@ -25,6 +25,15 @@ type TCPInfoRow struct {
 	Raw    *snapshot.ConnectionLog `json:"raw" bigquery:"raw"`
 }
 
+// RewriteClientIPs implements row.IPRewriter.  The socket is the server's, so
+// the client is the destination.  The socket ids in the raw snapshots are not
+// exported.
+func (r *TCPInfoRow) RewriteClientIPs(f func(ip string) string) {
+	if r.A != nil && r.A.SockID.DstIP != "" {
+		r.A.SockID.DstIP = f(r.A.SockID.DstIP)
+	}
+}
+
 // Schema returns the Bigquery schema for TCPInfoRow.
 func (row *TCPInfoRow) Schema() (bigquery.Schema, error) {
 	sch, err := bigquery.InferSchema(row)
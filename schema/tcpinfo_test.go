@@ -6,6 +6,7 @@ import (
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/go/cloud/bqx"
+	"github.com/m-lab/tcp-info/inetdiag"
 )
 
 func TestTCPInfoRow_Schema(t *testing.T) {
@@ -32,3 +33,18 @@ func TestTCPInfoRow_Schema(t *testing.T) {
 		t.Errorf("TCPInfoRow.Schema() missing expected fields: got %d, want 3", count)
 	}
 }
+
+func TestTCPInfoRow_RewriteClientIPs(t *testing.T) {
+	row := &schema.TCPInfoRow{
+		A: &schema.TCPInfoSummary{SockID: inetdiag.SockID{SrcIP: "4.3.2.1", DstIP: "1.2.3.4"}},
+	}
+	row.RewriteClientIPs(func(ip string) string { return "0.0.0.0" })
+	if row.A.SockID.DstIP != "0.0.0.0" {
+		t.Errorf("RewriteClientIPs() DstIP = %q, want 0.0.0.0", row.A.SockID.DstIP)
+	}
+	if row.A.SockID.SrcIP != "4.3.2.1" {
+		t.Errorf("RewriteClientIPs() changed SrcIP = %q", row.A.SockID.SrcIP)
+	}
+	// Rows without a summary are left alone.
+	(&schema.TCPInfoRow{}).RewriteClientIPs(func(ip string) string { return "0.0.0.0" })
+}
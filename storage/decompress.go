@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/valyala/gozstd"
+)
+
+// ErrCorruptContent is returned when compressed content cannot be decoded.
+// Unlike GCS read errors, it is deterministic, so retrying will not help.
+var ErrCorruptContent = errors.New("corrupt compressed content")
+
+// Decompressor returns a reader that decompresses the content of r.
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+// decompressors maps lower case file extensions to the Decompressor
+// for files with that extension.
+var decompressors = map[string]Decompressor{
+	".gz":  gunzip,
+	".tgz": gunzip,
+	".zst": unzstd,
+}
+
+// keptExtensions lists the extensions that DecompressedName leaves in file
+// names.  Parsers and row ids have always used the names of gzipped files as
+// is, e.g. to pair legacy NDT .gz snaplogs with their meta files.
+var keptExtensions = map[string]bool{
+	".gz":  true,
+	".tgz": true,
+}
+
+// RegisterDecompressor adds or replaces the Decompressor used for files
+// with the given extension, e.g. ".xz".
+func RegisterDecompressor(ext string, d Decompressor) {
+	decompressors[strings.ToLower(ext)] = d
+}
+
+// Decompress returns a reader that decompresses r, based on the extension
+// of name.  Files with unknown extensions are assumed to be uncompressed,
+// and r is returned unchanged.
+func Decompress(name string, r io.Reader) (io.Reader, error) {
+	d, ok := decompressors[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return r, nil
+	}
+	return d(r)
+}
+
+// DecompressedName returns the name of a file after Decompress, without the
+// extension of the compression format, so that the name matches the content.
+// Names of gzipped files, and of files Decompress leaves unchanged, are
+// returned as is.
+func DecompressedName(name string) string {
+	ext := path.Ext(name)
+	lower := strings.ToLower(ext)
+	if _, ok := decompressors[lower]; !ok || keptExtensions[lower] {
+		return name
+	}
+	return strings.TrimSuffix(name, ext)
+}
+
+func gunzip(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// unzstd decompresses the entire content, as zstd files in M-Lab archives
+// are small, and this avoids managing the lifetime of a gozstd.Reader.
+func unzstd(r io.Reader) (io.Reader, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gozstd.Decompress(nil, raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptContent, err)
+	}
+	return bytes.NewReader(data), nil
+}
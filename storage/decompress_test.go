@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/valyala/gozstd"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	content := []byte("some test content")
+	tests := []struct {
+		name    string
+		file    string
+		data    []byte
+		wantErr error
+	}{
+		{name: "gz", file: "foo.json.gz", data: gzipped(t, content)},
+		{name: "gz-upper", file: "foo.json.GZ", data: gzipped(t, content)},
+		{name: "tgz", file: "foo.tgz", data: gzipped(t, content)},
+		{name: "zst", file: "foo.jsonl.zst", data: gozstd.Compress(nil, content)},
+		{name: "uncompressed", file: "foo.json", data: content},
+		{name: "no-extension", file: "foo", data: content},
+		{name: "corrupt-zst", file: "foo.zst", data: content, wantErr: ErrCorruptContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := Decompress(tt.file, bytes.NewReader(tt.data))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Decompress() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decompress() error = %v", err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("Decompress() = %q, want %q", got, content)
+			}
+		})
+	}
+}
+
+func TestDecompressBadGzip(t *testing.T) {
+	if _, err := Decompress("foo.gz", strings.NewReader("not gzip")); err == nil {
+		t.Error("Decompress() should fail for invalid gzip content")
+	}
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	defer delete(decompressors, ".upper")
+	RegisterDecompressor(".UPPER", func(r io.Reader) (io.Reader, error) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(bytes.ToUpper(data)), nil
+	})
+	r, err := Decompress("foo.upper", strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ABC" {
+		t.Errorf("Decompress() = %q, want ABC", got)
+	}
+}
+
+func TestDecompressedName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "foo.jsonl.zst", want: "foo.jsonl"},
+		{name: "foo.jsonl.ZST", want: "foo.jsonl"},
+		{name: "foo.json.gz", want: "foo.json.gz"},
+		{name: "foo.tgz", want: "foo.tgz"},
+		{name: "foo.json", want: "foo.json"},
+	}
+	for _, tt := range tests {
+		if got := DecompressedName(tt.name); got != tt.want {
+			t.Errorf("DecompressedName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
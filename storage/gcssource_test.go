@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/civil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/valyala/gozstd"
+
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/metrics"
+)
+
+// flakyTarReader fails Next() with err for the first failures calls.
+type flakyTarReader struct {
+	failures int
+	err      error
+	data     []byte
+	done     bool
+}
+
+func (f *flakyTarReader) Next() (*tar.Header, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, f.err
+	}
+	if f.done {
+		return nil, io.EOF
+	}
+	f.done = true
+	return &tar.Header{Name: "foo", Typeflag: tar.TypeReg, Size: int64(len(f.data))}, nil
+}
+
+func (f *flakyTarReader) Read(b []byte) (int, error) {
+	n := copy(b, f.data)
+	f.data = f.data[n:]
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func TestNextTestRetries(t *testing.T) {
+	src := &GCSSource{
+		TarReader:     &flakyTarReader{failures: 2, err: errors.New("stream error"), data: []byte("data")},
+		RetryBaseTime: time.Millisecond,
+		TableBase:     "retry-test",
+	}
+	name, data, err := src.NextTest(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "foo" || string(data) != "data" {
+		t.Errorf("NextTest() = %q, %q; want %q, %q", name, data, "foo", "data")
+	}
+	for _, trial := range []string{"1", "2"} {
+		c := testutil.ToFloat64(metrics.GCSRetryCount.WithLabelValues("retry-test", "nextHeader", trial, "other"))
+		if c != 1 {
+			t.Errorf("GCSRetryCount for trial %s = %f, want 1", trial, c)
+		}
+	}
+
+	// Truncated archives are not retried.
+	src = &GCSSource{
+		TarReader:     &flakyTarReader{failures: 2, err: io.ErrUnexpectedEOF},
+		RetryBaseTime: time.Millisecond,
+		TableBase:     "fatal-test",
+	}
+	_, _, err = src.NextTest(100)
+	if !errors.Is(err, ErrTruncatedArchive) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("NextTest() error = %v, want %v wrapping %v", err, ErrTruncatedArchive, io.ErrUnexpectedEOF)
+	}
+	for _, trial := range []string{"1", "2"} {
+		c := testutil.ToFloat64(metrics.GCSRetryCount.WithLabelValues("fatal-test", "nextHeader", trial, "unexpected EOF"))
+		if c != 0 {
+			t.Errorf("GCSRetryCount for fatal error trial %s = %f, want 0", trial, c)
+		}
+	}
+	if c := testutil.ToFloat64(metrics.TruncatedArchiveCount.WithLabelValues("fatal-test", "nextHeader")); c != 1 {
+		t.Errorf("TruncatedArchiveCount = %f, want 1", c)
+	}
+}
+
+func tarred(t *testing.T, files map[string][]byte) []byte {
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for name, data := range files {
+		h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestNextTestTruncatedArchive(t *testing.T) {
+	// Random content, so that the gzipped file spans several tar blocks.
+	content := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(content)
+	tests := []struct {
+		name  string
+		file  string
+		data  []byte
+		trunc int // Number of bytes to keep.
+		phase string
+	}{
+		{name: "data", file: "foo.json", data: content, trunc: 1024, phase: "nextData"},
+		{name: "gz-data", file: "foo.json.gz", data: gzipped(t, content), trunc: 1024, phase: "nextData"},
+		{name: "header", file: "foo.json", data: content, trunc: 100, phase: "nextHeader"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := tarred(t, map[string][]byte{tt.file: tt.data})
+			src := &GCSSource{
+				TarReader: tar.NewReader(bytes.NewReader(archive[:tt.trunc])),
+				TableBase: "test",
+			}
+			counter := metrics.TruncatedArchiveCount.WithLabelValues("test", tt.phase)
+			before := testutil.ToFloat64(counter)
+			_, _, err := src.NextTest(1 << 20)
+			if !errors.Is(err, ErrTruncatedArchive) {
+				t.Fatalf("NextTest() error = %v, want ErrTruncatedArchive", err)
+			}
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("TruncatedArchiveCount{%s} delta = %v, want 1", tt.phase, got)
+			}
+		})
+	}
+}
+
+func TestNextTestTruncatedContent(t *testing.T) {
+	// A truncated gz file in a complete archive is a content problem, not a
+	// truncated archive.
+	gz := gzipped(t, bytes.Repeat([]byte("some test content "), 100))
+	archive := tarred(t, map[string][]byte{"foo.json.gz": gz[:len(gz)/2]})
+	src := &GCSSource{
+		TarReader: tar.NewReader(bytes.NewReader(archive)),
+		TableBase: "test",
+	}
+	if _, _, err := src.NextTest(1 << 20); err != nil {
+		t.Fatalf("NextTest() error = %v, want nil", err)
+	}
+	if _, _, err := src.NextTest(1 << 20); err != io.EOF {
+		t.Errorf("NextTest() error = %v, want io.EOF", err)
+	}
+}
+
+func TestNextTestCorruptContent(t *testing.T) {
+	// Corrupt zstd content is returned as an error for that file only.
+	archive := tarred(t, map[string][]byte{"foo.jsonl.zst": []byte("not zstd content")})
+	src := &GCSSource{
+		TarReader: tar.NewReader(bytes.NewReader(archive)),
+		TableBase: "test",
+	}
+	name, data, err := src.NextTest(1 << 20)
+	if !errors.Is(err, ErrCorruptContent) {
+		t.Fatalf("NextTest() error = %v, want %v", err, ErrCorruptContent)
+	}
+	if name != "foo.jsonl.zst" || data != nil {
+		t.Errorf("NextTest() = %q, %q, want foo.jsonl.zst, nil", name, data)
+	}
+	if _, _, err := src.NextTest(1 << 20); err != io.EOF {
+		t.Errorf("NextTest() error = %v, want io.EOF", err)
+	}
+}
+
+func TestNextTestZstd(t *testing.T) {
+	// zstd content is decompressed, and the name no longer has the .zst.
+	archive := tarred(t, map[string][]byte{"foo.jsonl.zst": gozstd.Compress(nil, []byte("content"))})
+	src := &GCSSource{
+		TarReader: tar.NewReader(bytes.NewReader(archive)),
+		TableBase: "test",
+	}
+	name, data, err := src.NextTest(1 << 20)
+	if err != nil {
+		t.Fatalf("NextTest() error = %v", err)
+	}
+	if name != "foo.jsonl" || string(data) != "content" {
+		t.Errorf("NextTest() = %q, %q, want foo.jsonl, content", name, data)
+	}
+}
+
+func TestNewTestSourceLocalFile(t *testing.T) {
+	// Stage a tgz with a single test file, using the GCS directory layout.
+	dir := filepath.Join(t.TempDir(), "ndt", "ndt7", "2020", "03", "18")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "20200318T003853.425987Z-ndt7-mlab3-syd03-ndt.tgz")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	content := []byte(`{"GitShortCommit":"abc"}`)
+	tw.WriteHeader(&tar.Header{Name: "ndt7-download.json", Mode: 0666, Typeflag: tar.TypeReg, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+	zw.Close()
+	f.Close()
+
+	dp, err := etl.ValidateTestPath("file://" + fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewTestSource(nil, dp, "ndt7")
+	if err != nil {
+		t.Fatalf("NewTestSource() error = %v", err)
+	}
+	defer src.Close()
+	if src.Date() != (civil.Date{Year: 2020, Month: 3, Day: 18}) {
+		t.Errorf("Date() = %v, want 2020-03-18", src.Date())
+	}
+	name, data, err := src.NextTest(1000)
+	if err != nil {
+		t.Fatalf("NextTest() error = %v", err)
+	}
+	if name != "ndt7-download.json" || string(data) != string(content) {
+		t.Errorf("NextTest() = %q, %q", name, data)
+	}
+	if _, _, err := src.NextTest(1000); err != io.EOF {
+		t.Errorf("NextTest() error = %v, want io.EOF", err)
+	}
+}
+
+func TestNextTestPosition(t *testing.T) {
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"a.json", []byte(`{"first":1}`)},
+		{"b.json", bytes.Repeat([]byte("x"), 700)},
+		{"c.json", []byte(`{"third":3}`)},
+	}
+	for _, f := range files {
+		w.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg})
+		w.Write(f.data)
+	}
+	w.Close()
+	archive := b.Bytes()
+
+	counter := &countingReader{r: bytes.NewReader(archive)}
+	src := &GCSSource{
+		TarReader: tar.NewReader(counter),
+		TableBase: "position-test",
+		counter:   counter,
+	}
+	for i, f := range files {
+		name, _, err := src.NextTest(1 << 20)
+		if err != nil {
+			t.Fatalf("NextTest() error = %v", err)
+		}
+		offset, size := src.Position()
+		if size != int64(len(f.data)) {
+			t.Errorf("%s: Position() size = %d, want %d", name, size, len(f.data))
+		}
+		if i == 0 && offset != 512 {
+			t.Errorf("%s: Position() offset = %d, want 512", name, offset)
+		}
+		if !bytes.Equal(archive[offset:offset+size], f.data) {
+			t.Errorf("%s: archive[%d:%d] does not match file data", name, offset, offset+size)
+		}
+	}
+}
+
+func TestNextTestDecompressionRatio(t *testing.T) {
+	content := bytes.Repeat([]byte("some test content "), 100)
+	gz := gzipped(t, content)
+	archive := tarred(t, map[string][]byte{"foo.json.gz": gz, "bar.json": content})
+	src := &GCSSource{
+		TarReader: tar.NewReader(bytes.NewReader(archive)),
+		TableBase: "ratio-test",
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := src.NextTest(1 << 20); err != nil {
+			t.Fatalf("NextTest() error = %v", err)
+		}
+	}
+
+	// Only the compressed file is observed.
+	m := &dto.Metric{}
+	err := metrics.DecompressionRatioHistogram.WithLabelValues("ratio-test").(prometheus.Histogram).Write(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := float64(len(content)) / float64(len(gz))
+	if m.GetHistogram().GetSampleCount() != 1 || m.GetHistogram().GetSampleSum() != want {
+		t.Errorf("DecompressionRatioHistogram = %d samples, sum %v; want 1, sum %v",
+			m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum(), want)
+	}
+}
+
+func TestGetStorageClientContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client, err := GetStorageClientContext(ctx, false)
+	if err != context.Canceled {
+		t.Errorf("GetStorageClientContext() error = %v, want %v", err, context.Canceled)
+	}
+	if client != nil {
+		t.Error("GetStorageClientContext() returned non-nil client")
+	}
+}
@@ -58,7 +58,9 @@ func NewRowWriter(ctx context.Context, client stiface.Client, bucket string, pat
 // Acquire the encoding token.
 // TODO can we allow two encoders, and still sequence the writing?
 func (rw *RowWriter) acquireEncodingToken() {
+	start := time.Now()
 	<-rw.encoding
+	metrics.TokenWaitHistogram.WithLabelValues("encoding").Observe(time.Since(start).Seconds())
 }
 
 func (rw *RowWriter) releaseEncodingToken() {
@@ -72,7 +74,9 @@ func (rw *RowWriter) releaseEncodingToken() {
 // Swap the encoding token for the write token.
 // MUST already hold the write token.
 func (rw *RowWriter) swapForWritingToken() {
+	start := time.Now()
 	<-rw.writing
+	metrics.TokenWaitHistogram.WithLabelValues("writing").Observe(time.Since(start).Seconds())
 	rw.releaseEncodingToken()
 }
 
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/m-lab/etl/metrics"
+)
+
+func tokenWaitSum(t *testing.T, token string) float64 {
+	m := &dto.Metric{}
+	err := metrics.TokenWaitHistogram.WithLabelValues(token).(prometheus.Histogram).Write(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleSum()
+}
+
+func TestAcquireEncodingTokenWait(t *testing.T) {
+	encoding := make(chan struct{}, 1)
+	rw := &RowWriter{encoding: encoding}
+	before := tokenWaitSum(t, "encoding")
+
+	// The token is held elsewhere, so acquire must wait until it is released.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		encoding <- struct{}{}
+	}()
+	rw.acquireEncodingToken()
+
+	if wait := tokenWaitSum(t, "encoding") - before; wait <= 0 {
+		t.Errorf("TokenWaitHistogram observed %f seconds, want > 0", wait)
+	}
+}
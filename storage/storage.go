@@ -8,7 +8,6 @@ package storage
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -16,6 +15,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -25,6 +25,7 @@ import (
 	"google.golang.org/api/option"
 
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/etl/backoff"
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/factory"
 	"github.com/m-lab/etl/metrics"
@@ -33,6 +34,11 @@ import (
 // ErrOversizeFile is returned when exceptionally large files are skipped.
 var ErrOversizeFile = errors.New("Oversize file")
 
+// ErrTruncatedArchive is returned when the archive ends in the middle of a
+// header or file.  Retrying the read will not help, but fetching the archive
+// again may, so the task should be retried.
+var ErrTruncatedArchive = errors.New("truncated archive")
+
 // TarReader provides Next and Read functions.
 type TarReader interface {
 	Next() (*tar.Header, error)
@@ -48,20 +54,41 @@ type GCSSource struct {
 	RetryBaseTime time.Duration // The base time for backoff and retry.
 	TableBase     string        // TableBase is BQ table associated with this source, or "invalid".
 	PathDate      civil.Date    // Date associated with YYYY/MM/DD in FilePath.
+
+	counter  *countingReader // Counts bytes consumed by the TarReader, if non-nil.
+	offset   int64           // Offset of the current test data in the uncompressed archive.
+	fileSize int64           // Size of the current test in the archive.
+}
+
+// countingReader counts the bytes read through it. archive/tar does not read
+// ahead, so after Next() the count is the offset of the member data.
+type countingReader struct {
+	r io.Reader
+	n int64
 }
 
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// maxTrials bounds the number of attempts to read each header or file.
+const maxTrials = 10
+
 // Retrieve next file header.
 // Lots of error handling because of common faults in underlying GCS.
+// Returns header, whether the error is retriable, and error.
 func (src *GCSSource) nextHeader(trial int) (*tar.Header, bool, error) {
 	h, err := src.Next()
 	if err != nil {
 		if err == io.EOF {
 			return nil, false, err
 		} else if strings.Contains(err.Error(), "unexpected EOF") {
-			metrics.GCSRetryCount.WithLabelValues(
-				src.TableBase, "nextHeader", strconv.Itoa(trial), "unexpected EOF").Inc()
-			// TODO: These are likely unrecoverable, so we should
-			// probably return false.
+			metrics.TruncatedArchiveCount.WithLabelValues(src.TableBase, "nextHeader").Inc()
+			// The archive is truncated, so retrying will not help.
+			log.Printf("ERROR: nextHeader: %v\n", err)
+			return h, false, fmt.Errorf("%w: %w", ErrTruncatedArchive, err)
 		} else {
 			// Quite a few of these now, and they seem to be
 			// unrecoverable.
@@ -80,26 +107,31 @@ func (src *GCSSource) nextData(h *tar.Header, trial int) ([]byte, bool, error) {
 	var data []byte
 	var err error
 	var phase string
-	if strings.HasSuffix(strings.ToLower(h.Name), "gz") {
-		// TODO add unit test
-		var zipReader *gzip.Reader
-		zipReader, err = gzip.NewReader(src)
-		if err != nil {
-			if err == io.EOF {
-				return nil, false, err
-			}
-			metrics.GCSRetryCount.WithLabelValues(
-				src.TableBase, "open zip", strconv.Itoa(trial), "zipReaderError").Inc()
+	var rdr io.Reader
+	rdr, err = Decompress(h.Name, src)
+	if err != nil {
+		if err == io.EOF || errors.Is(err, ErrCorruptContent) {
+			return nil, false, err
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) && src.memberTruncated() {
+			metrics.TruncatedArchiveCount.WithLabelValues(src.TableBase, "nextData").Inc()
 			log.Printf("ERROR: zipReader(%d): %v in file %s\n", trial, err, h.Name)
-			return nil, true, err
+			return nil, false, fmt.Errorf("%w: %w", ErrTruncatedArchive, err)
+		}
+		metrics.GCSRetryCount.WithLabelValues(
+			src.TableBase, "open zip", strconv.Itoa(trial), "zipReaderError").Inc()
+		log.Printf("ERROR: zipReader(%d): %v in file %s\n", trial, err, h.Name)
+		return nil, true, err
+	}
+	if rdr != io.Reader(src) {
+		if c, ok := rdr.(io.Closer); ok {
+			defer c.Close()
 		}
-		defer zipReader.Close()
 		phase = "nextData zip"
-		data, err = ioutil.ReadAll(zipReader)
 	} else {
 		phase = "nextData"
-		data, err = ioutil.ReadAll(src)
 	}
+	data, err = ioutil.ReadAll(rdr)
 	if err != nil {
 		// These errors seem to be recoverable, at least with zip files.
 		if strings.Contains(err.Error(), "stream error") {
@@ -115,6 +147,13 @@ func (src *GCSSource) nextData(h *tar.Header, trial int) ([]byte, bool, error) {
 			//   (10 bytes) from gs://archive-measurement-lab/ndt/ndt7/2020/04/20/20200420T060456.005849Z-ndt7-mlab3-lhr03-ndt.tgz
 			metrics.GCSRetryCount.WithLabelValues(
 				src.TableBase, phase, strconv.Itoa(trial), "unexpected EOF").Inc()
+			// Since the file is truncated, retrying will not help.
+			log.Printf("ERROR: nextData:%d [%s] %s (%d bytes) from %s\n", trial, err, h.Name, h.Size, src.FilePath)
+			if src.memberTruncated() {
+				metrics.TruncatedArchiveCount.WithLabelValues(src.TableBase, "nextData").Inc()
+				return nil, false, fmt.Errorf("%w: %w", ErrTruncatedArchive, err)
+			}
+			return nil, false, err
 		} else {
 			metrics.GCSRetryCount.WithLabelValues(
 				src.TableBase, phase, strconv.Itoa(trial), "other error").Inc()
@@ -123,9 +162,22 @@ func (src *GCSSource) nextData(h *tar.Header, trial int) ([]byte, bool, error) {
 		return nil, true, err
 	}
 
+	if rdr != io.Reader(src) && h.Size > 0 {
+		metrics.DecompressionRatioHistogram.WithLabelValues(src.TableBase).Observe(
+			float64(len(data)) / float64(h.Size))
+	}
 	return data, false, nil
 }
 
+// memberTruncated reports whether the archive ended in the middle of the
+// current file, as opposed to the file itself holding truncated compressed
+// content.  tar.Reader errors are sticky, so if the archive is truncated,
+// draining the rest of the file returns the error again.
+func (src *GCSSource) memberTruncated() bool {
+	_, err := io.Copy(ioutil.Discard, src)
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 // Type returns a string for use in metrics and logs.
 func (src *GCSSource) Type() string {
 	return src.TableBase
@@ -146,9 +198,19 @@ func (src *GCSSource) GetSize() int64 {
 	return src.Size
 }
 
+// retryBackoff returns the retry delays for reading from the source, which double
+// for each trial, starting from twice the RetryBaseTime.
+func (src *GCSSource) retryBackoff() *backoff.Backoff {
+	return &backoff.Backoff{Base: 2 * src.RetryBaseTime}
+}
+
 // NextTest reads the next test object from the tar file.
 // Skips reading contents of any file larger than maxSize, returning empty data
 // and storage.ErrOversizeFile.
+// Compressed files are decompressed, and their names are returned as given by
+// DecompressedName.
+// Returns the file name and storage.ErrCorruptContent for a file whose
+// compressed content cannot be decoded.
 // Returns io.EOF when there are no more tests.
 func (src *GCSSource) NextTest(maxSize int64) (string, []byte, error) {
 	metrics.WorkerState.WithLabelValues(src.TableBase, "read").Inc()
@@ -161,10 +223,10 @@ func (src *GCSSource) NextTest(maxSize int64) (string, []byte, error) {
 	var h *tar.Header
 
 	// With default RetryBaseTime, the last trial will be after total delay of
-	// 16ms + 32ms + ... + 8192ms, or about 15 seconds.
+	// 32ms + 64ms + ... + 8192ms, or about 16 seconds.
 	// TODO - should add a random element to the backoff?
 	trial := 0
-	delay := src.RetryBaseTime
+	delay := src.retryBackoff()
 	for {
 		trial++
 		var retry bool
@@ -172,13 +234,17 @@ func (src *GCSSource) NextTest(maxSize int64) (string, []byte, error) {
 		if err == nil {
 			break
 		}
-		if !retry || trial >= 10 {
+		if !retry || trial >= maxTrials {
 			return "", nil, err
 		}
-		// For each trial, increase backoff delay by 2x.
-		delay *= 2
-		time.Sleep(delay)
+		time.Sleep(delay.Next())
+	}
+
+	src.offset = 0
+	if src.counter != nil {
+		src.offset = src.counter.n
 	}
+	src.fileSize = h.Size
 
 	if h.Size > maxSize {
 		return h.Name, data, ErrOversizeFile
@@ -190,7 +256,7 @@ func (src *GCSSource) NextTest(maxSize int64) (string, []byte, error) {
 	}
 
 	trial = 0
-	delay = src.RetryBaseTime
+	delay.Reset()
 	for {
 		trial++
 		var retry bool
@@ -198,18 +264,25 @@ func (src *GCSSource) NextTest(maxSize int64) (string, []byte, error) {
 		if err == nil {
 			break
 		}
-		if !retry || trial >= 10 {
+		if errors.Is(err, ErrTruncatedArchive) || errors.Is(err, ErrCorruptContent) {
+			return h.Name, nil, err
+		}
+		if !retry || trial >= maxTrials {
 			// FYI, it appears that stream errors start in the
 			// nextData phase of reading, but then persist on
 			// the next call to nextHeader.
 			break
 		}
-		// For each trial, increase backoff delay by 2x.
-		delay *= 2
-		time.Sleep(delay)
+		time.Sleep(delay.Next())
 	}
 
-	return h.Name, data, nil
+	return DecompressedName(h.Name), data, nil
+}
+
+// Position returns the offset of the most recent test's data within the
+// uncompressed archive, and its size. The offset is zero if unknown.
+func (src *GCSSource) Position() (int64, int64) {
+	return src.offset, src.fileSize
 }
 
 // Closer handles gzip files.
@@ -237,16 +310,17 @@ var errNoClient = errors.New("client should be non-null")
 // NewTestSource creates an TestSource suitable for injecting into Task.
 // Caller is responsible for calling Close on the returned object.
 //
-// uri should be of form gs://bucket/filename.tar or gs://bucket/filename.tgz
+// uri should be of form gs://bucket/filename.tar or gs://bucket/filename.tgz,
+// or a local file URL, like file:///root/filename.tgz
 // FYI Using a persistent client saves about 80 msec, and 220 allocs, totalling 70kB.
 func NewTestSource(client stiface.Client, dp etl.DataPath, label string) (etl.TestSource, error) {
-	if client == nil {
-		return nil, errNoClient
-	}
-	// For now only handle gcs paths.
-	if !strings.HasPrefix(dp.URI, "gs://") {
+	// Handle gcs paths, and local file URLs.  Local files do not need a client.
+	if !strings.HasPrefix(dp.URI, "gs://") && !dp.IsLocal() {
 		return nil, errors.New("invalid file path: " + dp.URI)
 	}
+	if client == nil && !dp.IsLocal() {
+		return nil, errNoClient
+	}
 	bucket := dp.Bucket
 	fn := dp.Path
 
@@ -266,7 +340,13 @@ func NewTestSource(client stiface.Client, dp etl.DataPath, label string) (etl.Te
 	// TODO - appengine requests time out after 60 minutes, so more than that doesn't help.
 	// SS processing sometimes times out with 1 hour.
 	// Is there a limit on http requests from task queue, or into flex instance?
-	rdr, size, err := getReader(ctx, client, bucket, fn, 300*time.Minute)
+	var rdr io.ReadCloser
+	var size int64
+	if dp.IsLocal() {
+		rdr, size, err = getLocalReader(dp.LocalPath())
+	} else {
+		rdr, size, err = getReader(ctx, client, bucket, fn, 300*time.Minute)
+	}
 	if err != nil {
 		cancel()
 		log.Println(err)
@@ -275,20 +355,18 @@ func NewTestSource(client stiface.Client, dp etl.DataPath, label string) (etl.Te
 
 	closer := &Closer{nil, rdr, cancel}
 	// Handle .tar.gz, .tgz files.
-	if strings.HasSuffix(strings.ToLower(fn), "gz") {
-		// TODO add unit test
-		// NB: This must not be :=, or it creates local rdr.
-		// TODO - add retries with backoff.
-		gzRdr, err := gzip.NewReader(rdr)
-		if err != nil {
-			closer.Close()
-			log.Println(err)
-			return nil, err
-		}
-		closer.zipper = gzRdr
-		rdr = gzRdr
+	// TODO - add retries with backoff.
+	dr, err := Decompress(fn, rdr)
+	if err != nil {
+		closer.Close()
+		log.Println(err)
+		return nil, err
 	}
-	tarReader := tar.NewReader(rdr)
+	if c, ok := dr.(io.Closer); ok && dr != io.Reader(rdr) {
+		closer.zipper = c
+	}
+	counter := &countingReader{r: dr}
+	tarReader := tar.NewReader(counter)
 
 	baseTimeout := 16 * time.Millisecond
 	gcs := &GCSSource{
@@ -299,6 +377,7 @@ func NewTestSource(client stiface.Client, dp etl.DataPath, label string) (etl.Te
 		RetryBaseTime: baseTimeout,
 		TableBase:     label,
 		PathDate:      civil.DateOf(archiveDate),
+		counter:       counter,
 	}
 	return gcs, nil
 }
@@ -306,20 +385,50 @@ func NewTestSource(client stiface.Client, dp etl.DataPath, label string) (etl.Te
 // GetStorageClient provides a storage reader client.
 // This contacts the backend server, so should be used infrequently.
 func GetStorageClient(writeAccess bool) (stiface.Client, error) {
+	return GetStorageClientContext(context.Background(), writeAccess)
+}
+
+// GetStorageClientContext provides a storage reader client, returning early
+// with ctx.Err() if ctx is cancelled or expires before the client is created.
+// This allows callers to fail fast, e.g. on misconfigured credentials.
+func GetStorageClientContext(ctx context.Context, writeAccess bool) (stiface.Client, error) {
 	var scope string
 	if writeAccess {
 		scope = gcs.ScopeReadWrite
 	} else {
 		scope = gcs.ScopeReadOnly
 	}
-
-	// This cannot include a defer cancel, as the client then doesn't work after
-	// the cancel.
-	client, err := gcs.NewClient(context.Background(), option.WithScopes(scope))
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	return stiface.AdaptClient(client), nil
+
+	type result struct {
+		client *gcs.Client
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// This cannot use ctx, as the client then doesn't work after ctx is
+		// cancelled.
+		client, err := gcs.NewClient(context.Background(), option.WithScopes(scope))
+		done <- result{client, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// Release the client once creation completes.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.client.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return stiface.AdaptClient(r.client), nil
+	}
 }
 
 type gcsSourceFactory struct {
@@ -357,6 +466,20 @@ func GCSSourceFactory(c stiface.Client) factory.SourceFactory {
 //          Local functions
 //---------------------------------------------------------------------------------
 
+// getLocalReader opens a local file.  Caller is responsible for closing it.
+func getLocalReader(fn string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
 // Caller is responsible for closing response body.
 func getReader(ctx context.Context, client stiface.Client, bucket string, fn string, timeout time.Duration) (io.ReadCloser, int64, error) {
 	// Lightweight - only setting up the local object.
@@ -7,9 +7,11 @@ package task
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/m-lab/etl/parser"
@@ -21,6 +23,10 @@ import (
 	"github.com/m-lab/go/logx"
 )
 
+// ErrTaskStopped is returned by ProcessAllTests when Stop was called before
+// all tests were processed.
+var ErrTaskStopped = errors.New("task stopped before completion")
+
 // Factory provides Get() which always returns a new, complete Task.
 // TODO for the defs that stay in factory package, remove ...Factory.
 type Factory interface {
@@ -46,6 +52,32 @@ type Task struct {
 	maxFileSize int64 // Max file size to avoid OOM.
 
 	closer io.Closer // So we can call Close()
+
+	stop     chan struct{} // Closed by Stop().
+	stopOnce sync.Once
+
+	skipped    []SkippedFile  // Files skipped without parsing, if etl.SkippedFileManifest.
+	skipCounts map[string]int // Count of skipped files by reason, if etl.SkippedFileManifest.
+}
+
+// MaxManifestFiles bounds the number of skipped files listed in a task
+// Manifest, so that a task with many unparsable files does not hold an
+// unbounded list.  Files beyond the limit are only counted.
+var MaxManifestFiles = 100
+
+// SkippedFile identifies an archive file that was not parsed.
+type SkippedFile struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	Kind   string `json:"kind,omitempty"` // The kind reported by IsParsable, for unparsable files.
+}
+
+// Manifest lists the files in a task archive that were skipped without
+// parsing, to help debug collection issues.
+type Manifest struct {
+	ArchiveURL string         `json:"archive_url"`
+	Skipped    []SkippedFile  `json:"skipped"` // The first MaxManifestFiles skipped files.
+	Counts     map[string]int `json:"counts"`  // The number of skipped files, by reason.
 }
 
 // NewTask constructs a task, injecting the source and the parser.
@@ -64,6 +96,7 @@ func NewTask(archive string, src etl.TestSource, prsr etl.Parser, closer io.Clos
 		},
 		maxFileSize: DefaultMaxFileSize,
 		closer:      closer,
+		stop:        make(chan struct{}),
 	}
 	return &t
 }
@@ -74,18 +107,58 @@ func (tt *Task) Close() {
 	tt.closer.Close()
 }
 
+// Stop requests that ProcessAllTests stop reading new tests.  Tests that
+// were already parsed are still flushed.  Stop is safe to call concurrently
+// with ProcessAllTests, and more than once.
+func (tt *Task) Stop() {
+	tt.stopOnce.Do(func() { close(tt.stop) })
+}
+
 // SetMaxFileSize overrides the default maxFileSize.
 func (tt *Task) SetMaxFileSize(max int64) {
 	tt.maxFileSize = max
 }
 
+// Manifest returns the files skipped so far.  It is only populated if
+// etl.SkippedFileManifest is set.
+func (tt *Task) Manifest() Manifest {
+	m := Manifest{
+		ArchiveURL: tt.meta.ArchiveURL,
+		Skipped:    append([]SkippedFile(nil), tt.skipped...),
+	}
+	if len(tt.skipCounts) > 0 {
+		m.Counts = make(map[string]int, len(tt.skipCounts))
+		for reason, n := range tt.skipCounts {
+			m.Counts[reason] = n
+		}
+	}
+	return m
+}
+
+// skip records a file that is skipped without parsing.
+func (tt *Task) skip(rec row.ResultRecorder, name, reason, kind string) {
+	if rec != nil {
+		rec.RecordSkip(reason)
+	}
+	if etl.SkippedFileManifest {
+		if tt.skipCounts == nil {
+			tt.skipCounts = make(map[string]int)
+		}
+		tt.skipCounts[reason]++
+		if len(tt.skipped) < MaxManifestFiles {
+			tt.skipped = append(tt.skipped, SkippedFile{Name: name, Reason: reason, Kind: kind})
+		}
+	}
+}
+
 // This is used for logging empty test warnings.
 // TODO - consider just removing the log.
 var emptyTest = logx.NewLogEvery(nil, time.Second)
 
 // ProcessAllTests loops through all the tests in a tar file, calls the
 // injected parser to parse them, and inserts them into bigquery. Returns the
-// number of files processed.
+// number of files processed.  Tests the parser rejects with a ProcessingError,
+// e.g. for corrupt content, are counted and skipped, and do not fail the task.
 // TODO pass in the datatype label.
 func (tt *Task) ProcessAllTests(failfast bool) (int, error) {
 	if tt.Parser == nil {
@@ -95,13 +168,26 @@ func (tt *Task) ProcessAllTests(failfast bool) (int, error) {
 	defer metrics.WorkerState.WithLabelValues(tt.Type(), "task").Dec()
 	files := 0
 	nilData := 0
+	totalBytes := 0
 	var testname string
 	var data []byte
 	var loopErr error
+	// Parsers that embed row.Base accumulate per-task results.
+	rec, _ := tt.Parser.(row.ResultRecorder)
+	if rec != nil {
+		rec.RecordStart()
+	}
 	// Read each file from the tar
 
 OUTER:
 	for testname, data, loopErr = tt.NextTest(tt.maxFileSize); loopErr != io.EOF; testname, data, loopErr = tt.NextTest(tt.maxFileSize) {
+		select {
+		case <-tt.stop:
+			log.Printf("Stopping %s after %d files", tt.meta.ArchiveURL, files)
+			loopErr = ErrTaskStopped
+			break OUTER
+		default:
+		}
 		files++
 		if loopErr != nil {
 			switch {
@@ -113,6 +199,16 @@ OUTER:
 					time.Since(tt.meta.Start), loopErr)
 				metrics.TestTotal.WithLabelValues(
 					tt.Type(), "unknown", "oversize file").Inc()
+				tt.skip(rec, testname, "oversize file", "")
+				continue OUTER
+			case errors.Is(loopErr, storage.ErrCorruptContent):
+				// The archive is intact, so skip just this file.
+				log.Printf("ERROR filename:%s testname:%s files:%d, duration:%v err:%v",
+					tt.meta.ArchiveURL, testname, files,
+					time.Since(tt.meta.Start), loopErr)
+				metrics.TestTotal.WithLabelValues(
+					tt.Type(), "unknown", "corrupt content").Inc()
+				tt.skip(rec, testname, "corrupt content", "")
 				continue OUTER
 			default:
 				// We are seeing several of these per hour, a little more than
@@ -136,10 +232,12 @@ OUTER:
 				break OUTER
 			}
 		}
+		totalBytes += len(data)
 		if data == nil {
 			// TODO(dev) Handle directories (expected) and other
 			// things separately.
 			nilData++
+			tt.skip(rec, testname, "nil data", "")
 			// If verbose, log the filename that is skipped.
 			continue
 		}
@@ -154,17 +252,28 @@ OUTER:
 		if !parsable {
 			metrics.FileSizeHistogram.WithLabelValues(
 				tt.Type(), kind, "ignored").Observe(float64(len(data)))
+			tt.skip(rec, testname, "unparsable", kind)
 			// Don't bother calling ParseAndInsert since this is unparsable.
 			continue
 		} else {
 			metrics.FileSizeHistogram.WithLabelValues(
 				tt.Type(), kind, "parsed").Observe(float64(len(data)))
 		}
+		if pos, ok := tt.TestSource.(etl.TestPositioner); ok {
+			tt.meta.ArchiveOffset, tt.meta.ArchiveFileSize = pos.Position()
+		}
 		loopErr = tt.Parser.ParseAndInsert(tt.meta, testname, data)
+		if rec != nil {
+			rec.RecordTest(loopErr)
+		}
 		// Shouldn't have any of these, as they should be handled in ParseAndInsert.
 		if loopErr != nil {
 			log.Printf("ERROR %v", loopErr)
-			// TODO(dev) Handle this error properly!
+			var pErr etl.ProcessingError
+			if errors.As(loopErr, &pErr) {
+				metrics.ErrorCount.WithLabelValues(
+					tt.Type(), "unknown", pErr.Detail()).Inc()
+			}
 			commitRowErr := row.ErrCommitRow{}
 			if failfast && errors.As(loopErr, &commitRowErr) {
 				break OUTER
@@ -180,10 +289,21 @@ OUTER:
 		log.Printf("%v", flushErr)
 	}
 
+	metrics.TaskFileCountHistogram.WithLabelValues(tt.Type()).Observe(float64(files))
+	metrics.TaskBytesHistogram.WithLabelValues(tt.Type()).Observe(float64(totalBytes))
+
 	// TODO - make this debug or remove
 	log.Printf("Processed %d files, %d nil data, %d rows committed, %d failed, from %s into %s",
 		files, nilData, tt.Parser.Committed(), tt.Parser.Failed(),
 		tt.meta.ArchiveURL, tt.Parser.FullTableName())
+	if rec != nil {
+		log.Printf("Results for %s: %+v", tt.meta.ArchiveURL, rec.Results())
+	}
+	if etl.SkippedFileManifest && len(tt.skipped) > 0 {
+		if b, err := json.Marshal(tt.Manifest()); err == nil {
+			log.Printf("Skipped files for %s: %s", tt.meta.ArchiveURL, b)
+		}
+	}
 
 	// We expect the loopErr to be io.EOF.  If it is something else, then
 	// it is an actual error, and we want to return that error.
@@ -4,15 +4,29 @@ package task_test
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
 	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/factory"
+	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/row"
+	"github.com/m-lab/etl/schema"
 	"github.com/m-lab/etl/storage" // TODO - would be better not to have this.
 	"github.com/m-lab/etl/task"
 )
@@ -185,3 +199,315 @@ func TestTarFileInput(t *testing.T) {
 	}
 
 }
+
+// histogram returns the sample count and sum of an observed histogram.
+func histogram(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestTaskFileObservations(t *testing.T) {
+	rdr := MakeTestSource(t).(*storage.GCSSource)
+	rdr.TableBase = "task-observations"
+	tp := &TestParser{}
+
+	tt := task.NewTask("filename", rdr, tp, &NullCloser{})
+	tt.SetMaxFileSize(100)
+	if _, err := tt.ProcessAllTests(false); err != nil {
+		t.Fatal(err)
+	}
+
+	count, files := histogram(t, metrics.TaskFileCountHistogram.WithLabelValues("task-observations"))
+	if count != 1 || files != 3 {
+		t.Errorf("file count observations = %d, sum %v, want 1, sum 3", count, files)
+	}
+	// The oversize file is not read, so only foo and bar are counted.
+	count, size := histogram(t, metrics.TaskBytesHistogram.WithLabelValues("task-observations"))
+	if count != 1 || size != float64(len("biscuits")+len("butter milk")) {
+		t.Errorf("bytes observations = %d, sum %v, want 1, sum %d",
+			count, size, len("biscuits")+len("butter milk"))
+	}
+}
+
+// resultsParser embeds row.Base, so that it accumulates row.Results.  It
+// skips .txt files, and fails to parse files named "bad".
+type resultsParser struct {
+	*row.Base
+}
+
+func (rp *resultsParser) IsParsable(testName string, test []byte) (string, bool) {
+	return "ext", !strings.HasSuffix(testName, ".txt")
+}
+
+func (rp *resultsParser) ParseAndInsert(meta etl.Metadata, testName string, test []byte) error {
+	if testName == "bad" {
+		return errors.New("bad test")
+	}
+	if testName == "invalid" {
+		return factory.NewError("test", "Decode", http.StatusBadRequest, errors.New("invalid test"))
+	}
+	return rp.Put(testName)
+}
+
+func (rp *resultsParser) TableName() string     { return "test-table" }
+func (rp *resultsParser) FullTableName() string { return "test-table" }
+func (rp *resultsParser) RowsInBuffer() int     { return rp.GetStats().Buffered }
+func (rp *resultsParser) Committed() int        { return rp.GetStats().Committed }
+func (rp *resultsParser) Accepted() int         { return rp.GetStats().Total() }
+func (rp *resultsParser) Failed() int           { return rp.GetStats().Failed }
+
+type nullSink struct{}
+
+func (ns *nullSink) Commit(rows []interface{}, label string) (int, error) { return len(rows), nil }
+func (ns *nullSink) Close() error                                         { return nil }
+
+func TestProcessAllTestsResults(t *testing.T) {
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, f := range []struct {
+		name string
+		size int
+	}{
+		{"foo", 8}, {"notes.txt", 8}, {"big_file", 101}, {"bad", 8}, {"bar", 8},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0666, Typeflag: tar.TypeReg, Size: int64(f.size)})
+		tw.Write(make([]byte, f.size))
+	}
+	tw.WriteHeader(&tar.Header{Name: "dir/", Mode: 0777, Typeflag: tar.TypeDir})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rdr := &storage.GCSSource{TarReader: tar.NewReader(b), Closer: NullCloser{}, RetryBaseTime: time.Millisecond}
+
+	rp := &resultsParser{Base: row.NewBase("test-table", &nullSink{}, 10)}
+	tt := task.NewTask("filename", rdr, rp, &NullCloser{})
+	tt.SetMaxFileSize(100)
+	if _, err := tt.ProcessAllTests(false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := row.Results{
+		Tests:   3,
+		Parsed:  2,
+		Errors:  1,
+		Skipped: map[string]int{"unparsable": 1, "oversize file": 1, "nil data": 1},
+		Rows:    2,
+	}
+	if got := rp.Results(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Results() = %+v, want %+v", got, want)
+	}
+}
+
+func TestProcessAllTestsCorruptContent(t *testing.T) {
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"foo", make([]byte, 8)}, {"corrupt.zst", []byte("not zstd content")}, {"bar", make([]byte, 8)},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0666, Typeflag: tar.TypeReg, Size: int64(len(f.data))})
+		tw.Write(f.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rdr := &storage.GCSSource{TarReader: tar.NewReader(b), Closer: NullCloser{}, RetryBaseTime: time.Millisecond}
+
+	rp := &resultsParser{Base: row.NewBase("test-table", &nullSink{}, 10)}
+	tt := task.NewTask("filename", rdr, rp, &NullCloser{})
+	if _, err := tt.ProcessAllTests(false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := row.Results{
+		Tests:   2,
+		Parsed:  2,
+		Skipped: map[string]int{"corrupt content": 1},
+		Rows:    2,
+	}
+	if got := rp.Results(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Results() = %+v, want %+v", got, want)
+	}
+}
+
+func TestProcessAllTestsContentError(t *testing.T) {
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, name := range []string{"foo", "invalid", "bad", "bar"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0666, Typeflag: tar.TypeReg, Size: 8})
+		tw.Write(make([]byte, 8))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rdr := &storage.GCSSource{TarReader: tar.NewReader(b), Closer: NullCloser{}, RetryBaseTime: time.Millisecond}
+
+	rp := &resultsParser{Base: row.NewBase("test-table", &nullSink{}, 10)}
+	tt := task.NewTask("filename", rdr, rp, &NullCloser{})
+	// Content errors are counted, but do not fail the task.
+	_, err := tt.ProcessAllTests(true)
+	if err != nil {
+		t.Fatalf("ProcessAllTests() = %v, want nil", err)
+	}
+	r := rp.Results()
+	if r.Parsed != 2 || r.Errors != 2 || r.Content != 1 {
+		t.Errorf("Results() = %+v, want 2 parsed, 2 errors, 1 content error", r)
+	}
+}
+
+func TestProcessAllTestsManifest(t *testing.T) {
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, f := range []struct {
+		name string
+		size int
+	}{
+		{"foo", 8}, {"cputime.txt", 8}, {"big_file", 101}, {"ndttrace.txt", 8}, {"bar", 8},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0666, Typeflag: tar.TypeReg, Size: int64(f.size)})
+		tw.Write(make([]byte, f.size))
+	}
+	tw.WriteHeader(&tar.Header{Name: "dir/", Mode: 0777, Typeflag: tar.TypeDir})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	process := func() *task.Task {
+		rdr := &storage.GCSSource{TarReader: tar.NewReader(bytes.NewReader(archive)), Closer: NullCloser{}, RetryBaseTime: time.Millisecond}
+		rp := &resultsParser{Base: row.NewBase("test-table", &nullSink{}, 10)}
+		tt := task.NewTask("gs://fake/archive.tgz", rdr, rp, &NullCloser{})
+		tt.SetMaxFileSize(100)
+		if _, err := tt.ProcessAllTests(false); err != nil {
+			t.Fatal(err)
+		}
+		return tt
+	}
+
+	defer func(enabled bool) { etl.SkippedFileManifest = enabled }(etl.SkippedFileManifest)
+	etl.SkippedFileManifest = false
+	if got := process().Manifest(); len(got.Skipped) != 0 {
+		t.Errorf("Manifest() with option disabled = %+v, want no skipped files", got)
+	}
+
+	etl.SkippedFileManifest = true
+	want := task.Manifest{
+		ArchiveURL: "gs://fake/archive.tgz",
+		Skipped: []task.SkippedFile{
+			{Name: "cputime.txt", Reason: "unparsable", Kind: "ext"},
+			{Name: "big_file", Reason: "oversize file"},
+			{Name: "ndttrace.txt", Reason: "unparsable", Kind: "ext"},
+			{Name: "dir/", Reason: "nil data"},
+		},
+		Counts: map[string]int{"unparsable": 2, "oversize file": 1, "nil data": 1},
+	}
+	if got := process().Manifest(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Manifest() = %+v, want %+v", got, want)
+	}
+
+	// Files beyond the limit are counted, but not listed.
+	defer func(max int) { task.MaxManifestFiles = max }(task.MaxManifestFiles)
+	task.MaxManifestFiles = 2
+	want.Skipped = want.Skipped[:2]
+	if got := process().Manifest(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Manifest() = %+v, want %+v", got, want)
+	}
+}
+
+type memorySink struct {
+	rows []interface{}
+}
+
+func (ms *memorySink) Commit(rows []interface{}, label string) (int, error) {
+	ms.rows = append(ms.rows, rows...)
+	return len(rows), nil
+}
+func (ms *memorySink) Close() error { return nil }
+
+func TestProcessAllTestsArchivePosition(t *testing.T) {
+	// Copy the paris traceroute test files into a new archive.
+	f, err := os.Open("../parser/testdata/pt-files.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	files := map[string][]byte{}
+	for tr := tar.NewReader(f); ; {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(h.Name, ".paris") {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(h.Name)
+		files[name] = data
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0666, Typeflag: tar.TypeReg, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	dir := filepath.Join(t.TempDir(), "paris-traceroute", "2017", "12", "08")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "20171208T000000Z-mlab1-lax05-paris-traceroute-0000.tar")
+	if err := ioutil.WriteFile(fn, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dp, err := etl.ValidateTestPath("file://" + fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := storage.NewTestSource(nil, dp, "traceroute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memorySink{}
+	p, pErr := parser.NewParserFactory().Get(context.Background(), dp, sink, dp.TableBase())
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	tt := task.NewTask(dp.URI, src, p, src)
+	if _, err := tt.ProcessAllTests(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.rows) == 0 || len(sink.rows) > len(files) {
+		t.Fatalf("got %d rows, want 1 to %d", len(sink.rows), len(files))
+	}
+	for _, r := range sink.rows {
+		info := r.(*schema.PTTest).Parseinfo
+		name := strings.TrimSuffix(filepath.Base(info.Filename), ".gz")
+		want, ok := files[name]
+		if !ok {
+			t.Errorf("unexpected row for %s", info.Filename)
+			continue
+		}
+		if info.ArchiveFileSize != int64(len(want)) {
+			t.Errorf("%s: ArchiveFileSize = %d, want %d", name, info.ArchiveFileSize, len(want))
+			continue
+		}
+		if info.ArchiveOffset <= 0 || info.ArchiveOffset+info.ArchiveFileSize > int64(len(archive)) ||
+			!bytes.Equal(archive[info.ArchiveOffset:info.ArchiveOffset+info.ArchiveFileSize], want) {
+			t.Errorf("%s: ArchiveOffset = %d does not locate the file", name, info.ArchiveOffset)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package web100
+
+// This file contains wrappers to enable blackbox tests to reach package
+// internals.
+// See https://golang.org/src/net/http/export_test.go.
+
+// AddReadFieldForTest appends a field to the "/read" fieldset without
+// changing the record length, so the field may overrun each snapshot record.
+func (sl *SnapLog) AddReadFieldForTest(v Variable) {
+	sl.read.FieldMap[v.Name] = len(sl.read.Fields)
+	sl.read.Fields = append(sl.read.Fields, v)
+}
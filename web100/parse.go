@@ -53,6 +53,29 @@ func ParseIPFamily(ipStr string) int64 {
 	return -1
 }
 
+const (
+	// These are all caps to reflect the linux constant names.
+	WC_ADDRTYPE_IPV4 = 1
+	WC_ADDRTYPE_IPV6 = 2
+	LOCAL_AF_IPV4    = 0
+	LOCAL_AF_IPV6    = 1
+)
+
+// LocalAF translates a web100 LocalAddressType value of WC_ADDRTYPE_IPV4 (1)
+// or WC_ADDRTYPE_IPV6 (2) to the legacy tables local_af value (LOCAL_AF_IPV*).
+// Returns false for any other address type, in which case local_af should be
+// left empty.
+func LocalAF(addrType int64) (int64, bool) {
+	switch addrType {
+	case WC_ADDRTYPE_IPV4:
+		return LOCAL_AF_IPV4, true
+	case WC_ADDRTYPE_IPV6:
+		return LOCAL_AF_IPV6, true
+	default:
+		return 0, false
+	}
+}
+
 // IP validation errors.
 var (
 	ErrIPIsUnparseable   = errors.New("IP not parsable")
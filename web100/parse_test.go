@@ -84,6 +84,25 @@ func TestParseIPFamily(t *testing.T) {
 	}
 }
 
+func TestLocalAF(t *testing.T) {
+	tests := []struct {
+		addrType int64
+		want     int64
+		wantOK   bool
+	}{
+		{addrType: web100.WC_ADDRTYPE_IPV4, want: web100.LOCAL_AF_IPV4, wantOK: true},
+		{addrType: web100.WC_ADDRTYPE_IPV6, want: web100.LOCAL_AF_IPV6, wantOK: true},
+		{addrType: 0, want: 0, wantOK: false},
+		{addrType: 16, want: 0, wantOK: false},
+	}
+	for _, tt := range tests {
+		got, ok := web100.LocalAF(tt.addrType)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("LocalAF(%d) = %d, %t; want %d, %t", tt.addrType, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
 func TestValidateIP(t *testing.T) {
 	if web100.ValidateIP("1.2.3.4") != nil {
 		fmt.Println(web100.ValidateIP("1.2.3.4"))
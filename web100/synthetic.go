@@ -0,0 +1,149 @@
+package web100
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// This file provides a builder for synthetic snaplogs, so that tests can
+// generate edge cases (truncation, unusual fields, etc.) that are hard to
+// find in real archives.
+
+// FieldSpec describes a single field in a synthetic snaplog header.  The
+// offset and size are derived from the field order and type.
+type FieldSpec struct {
+	Name string
+	Type varType
+}
+
+// SnapLogSpec describes the content of a synthetic snaplog.
+type SnapLogSpec struct {
+	Version string // Defaults to "2.5.27 201001301335 net100".
+	LogTime uint32 // Unix seconds.
+
+	Spec []FieldSpec // The "/spec" fields.
+	Read []FieldSpec // The "/read" fields, which make up each snapshot.
+	Tune []FieldSpec // The "/tune" fields.
+
+	// The binary connection spec.  Only IPv4 addresses can be represented.
+	LocalIP    net.IP
+	LocalPort  uint16
+	RemoteIP   net.IP
+	RemotePort uint16
+
+	// Snapshots holds the values for each snapshot, keyed by field name.
+	// Integer types take int64 values, address types take net.IP values, and
+	// STR32 takes string values.  Missing fields are zero.
+	Snapshots []map[string]interface{}
+}
+
+// BuildSnapLog returns the raw bytes of a snaplog with the given content,
+// suitable for passing to NewSnapLog.
+func BuildSnapLog(spec SnapLogSpec) ([]byte, error) {
+	var buf bytes.Buffer
+	version := spec.Version
+	if version == "" {
+		version = "2.5.27 201001301335 net100"
+	}
+	buf.WriteString(version + "\n\n")
+
+	writeFields(&buf, "/spec\n", spec.Spec)
+	buf.WriteString("\n")
+	read := writeFields(&buf, "/read\n", spec.Read)
+	buf.WriteString("\n")
+	writeFields(&buf, "/tune\n", spec.Tune)
+	buf.WriteString(END_OF_HEADER)
+
+	binary.Write(&buf, binary.LittleEndian, spec.LogTime)
+	group := make([]byte, GROUPNAME_LEN_MAX)
+	copy(group, "read")
+	buf.Write(group)
+
+	connSpec := make([]byte, 16)
+	binary.LittleEndian.PutUint16(connSpec[0:2], spec.RemotePort)
+	if ip := spec.RemoteIP.To4(); ip != nil {
+		copy(connSpec[4:8], ip)
+	}
+	binary.LittleEndian.PutUint16(connSpec[8:10], spec.LocalPort)
+	if ip := spec.LocalIP.To4(); ip != nil {
+		copy(connSpec[12:16], ip)
+	}
+	buf.Write(connSpec)
+
+	for i, values := range spec.Snapshots {
+		buf.WriteString(BEGIN_SNAP_DATA)
+		for _, v := range read {
+			data := make([]byte, v.Size)
+			if err := encodeValue(data, v, values[v.Name]); err != nil {
+				return nil, fmt.Errorf("snapshot %d: %v", i, err)
+			}
+			buf.Write(data)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFields writes the header section for fields, and returns the
+// corresponding variables.
+func writeFields(buf *bytes.Buffer, preamble string, fields []FieldSpec) []Variable {
+	buf.WriteString(preamble)
+	vars := make([]Variable, 0, len(fields))
+	offset := 0
+	for _, f := range fields {
+		size := web100Sizes[f.Type]
+		fmt.Fprintf(buf, "%s %d %d %d\n", f.Name, offset, f.Type, size)
+		vars = append(vars, Variable{Name: f.Name, Offset: offset, Type: f.Type, Size: size})
+		offset += size
+	}
+	return vars
+}
+
+// encodeValue encodes value into data, according to the type of v.
+func encodeValue(data []byte, v Variable, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	switch v.Type {
+	case WEB100_TYPE_INET_ADDRESS_IPV4, WEB100_TYPE_INET_ADDRESS, WEB100_TYPE_INET_ADDRESS_IPV6:
+		ip, ok := value.(net.IP)
+		if !ok {
+			return fmt.Errorf("field %s requires a net.IP value", v.Name)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(data, ip4)
+			if v.Size == 17 {
+				data[16] = byte(WEB100_ADDRTYPE_IPV4)
+			}
+			return nil
+		}
+		if v.Size != 17 {
+			return fmt.Errorf("field %s cannot hold IPv6 address %s", v.Name, ip)
+		}
+		copy(data, ip.To16())
+		data[16] = byte(WEB100_ADDRTYPE_IPV6)
+	case WEB100_TYPE_STR32:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("field %s requires a string value", v.Name)
+		}
+		copy(data, s)
+	default:
+		n, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("field %s requires an int64 value", v.Name)
+		}
+		switch v.Size {
+		case 1:
+			data[0] = byte(n)
+		case 2:
+			binary.LittleEndian.PutUint16(data, uint16(n))
+		case 4:
+			binary.LittleEndian.PutUint32(data, uint32(n))
+		case 8:
+			binary.LittleEndian.PutUint64(data, uint64(n))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package web100_test
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/etl/web100"
+)
+
+func TestBuildSnapLog(t *testing.T) {
+	spec := web100.SnapLogSpec{
+		LogTime: 1494337516,
+		Spec: []web100.FieldSpec{
+			{Name: "RemPort", Type: web100.WEB100_TYPE_INET_PORT_NUMBER},
+			{Name: "RemAddress", Type: web100.WEB100_TYPE_INET_ADDRESS},
+		},
+		Read: []web100.FieldSpec{
+			{Name: "Duration", Type: web100.WEB100_TYPE_COUNTER32},
+			{Name: "RemAddress", Type: web100.WEB100_TYPE_INET_ADDRESS},
+			{Name: "HCThruOctetsAcked", Type: web100.WEB100_TYPE_COUNTER64},
+			{Name: "CurMSS", Type: web100.WEB100_TYPE_GAUGE32},
+			{Name: "State", Type: web100.WEB100_TYPE_INTEGER},
+		},
+		Tune: []web100.FieldSpec{
+			{Name: "LimCwnd", Type: web100.WEB100_TYPE_GAUGE32},
+		},
+		LocalIP:    net.ParseIP("192.168.0.1"),
+		LocalPort:  3010,
+		RemoteIP:   net.ParseIP("10.1.2.3"),
+		RemotePort: 43210,
+		Snapshots: []map[string]interface{}{
+			{"Duration": int64(5000), "RemAddress": net.ParseIP("2001:db8::1"),
+				"HCThruOctetsAcked": int64(1 << 40), "CurMSS": int64(1448), "State": int64(5)},
+			{"Duration": int64(10000), "RemAddress": net.ParseIP("2001:db8::1"),
+				"HCThruOctetsAcked": int64(1<<40 + 1448), "CurMSS": int64(1448), "State": int64(1)},
+		},
+	}
+	raw, err := web100.BuildSnapLog(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog, err := web100.NewSnapLog(raw)
+	if err != nil {
+		t.Fatalf("NewSnapLog() error = %v", err)
+	}
+	if slog.Version != "2.5.27 201001301335 net100" || slog.LogTime != spec.LogTime {
+		t.Errorf("NewSnapLog() version %q, log time %d", slog.Version, slog.LogTime)
+	}
+	if len(slog.SpecFields()) != 2 || slog.SnapshotNumFields() != 5 {
+		t.Errorf("NewSnapLog() got %d spec and %d read fields, want 2 and 5",
+			len(slog.SpecFields()), slog.SnapshotNumFields())
+	}
+	if err := slog.ValidateSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	if slog.SnapCount() != 2 {
+		t.Fatalf("SnapCount() = %d, want 2", slog.SnapCount())
+	}
+
+	connSpec := mapSaver{}
+	slog.ConnectionSpecValues(connSpec)
+	wantConnSpec := mapSaver{"local_af": int64(0), "local_ip": "192.168.0.1", "local_port": int64(3010),
+		"remote_ip": "10.1.2.3", "remote_port": int64(43210)}
+	if !reflect.DeepEqual(connSpec, wantConnSpec) {
+		t.Errorf("ConnectionSpecValues() = %v, want %v", connSpec, wantConnSpec)
+	}
+
+	for i, want := range []mapSaver{
+		{"Duration": int64(5000), "RemAddress": "2001:db8::1",
+			"HCThruOctetsAcked": int64(1 << 40), "CurMSS": int64(1448), "State": int64(5)},
+		{"Duration": int64(10000), "RemAddress": "2001:db8::1",
+			"HCThruOctetsAcked": int64(1<<40 + 1448), "CurMSS": int64(1448), "State": int64(1)},
+	} {
+		snap, err := slog.Snapshot(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := mapSaver{}
+		if err := snap.SnapshotValues(got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Snapshot(%d) = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestBuildSnapLogBadValue(t *testing.T) {
+	spec := web100.SnapLogSpec{
+		Read:      []web100.FieldSpec{{Name: "CurMSS", Type: web100.WEB100_TYPE_GAUGE32}},
+		Snapshots: []map[string]interface{}{{"CurMSS": "not an int"}},
+	}
+	if _, err := web100.BuildSnapLog(spec); err == nil {
+		t.Error("BuildSnapLog() should fail for a value of the wrong type")
+	}
+}
+
+func TestSnapshotValuesSuspiciousString(t *testing.T) {
+	raw, err := web100.BuildSnapLog(web100.SnapLogSpec{
+		Read: []web100.FieldSpec{
+			{Name: "Name", Type: web100.WEB100_TYPE_STR32},
+			{Name: "CurMSS", Type: web100.WEB100_TYPE_GAUGE32},
+		},
+		Snapshots: []map[string]interface{}{{"Name": "re\001no", "CurMSS": int64(1448)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog, err := web100.NewSnapLog(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := slog.Snapshot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, save := range map[string]func(web100.Saver) error{
+		"SnapshotValues": snap.SnapshotValues,
+		"SnapshotDeltas": func(s web100.Saver) error { return snap.SnapshotDeltas(&web100.Snapshot{}, s) },
+		"SnapshotFieldDeltas": func(s web100.Saver) error {
+			return snap.SnapshotFieldDeltas(&web100.Snapshot{}, slog.FieldsExcept(), s)
+		},
+	} {
+		got := mapSaver{}
+		if err := save(got); !errors.Is(err, web100.ErrSuspiciousString) {
+			t.Errorf("%s() error = %v, want %v", name, err, web100.ErrSuspiciousString)
+		}
+		// The other fields are still saved.
+		if got["CurMSS"] != int64(1448) {
+			t.Errorf("%s() = %v, want CurMSS saved", name, got)
+		}
+	}
+}
+
+func TestSnapshotFieldOverrun(t *testing.T) {
+	raw, err := web100.BuildSnapLog(web100.SnapLogSpec{
+		Read: []web100.FieldSpec{{Name: "CurMSS", Type: web100.WEB100_TYPE_GAUGE32}},
+		Snapshots: []map[string]interface{}{
+			{"CurMSS": int64(1448)},
+			{"CurMSS": int64(1460)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog, err := web100.NewSnapLog(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last field starts at the end of each record, and ends past it.
+	overrun, err := web100.NewVariable("Duration 4 7 8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.AddReadFieldForTest(*overrun)
+
+	first, err := slog.Snapshot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := slog.Snapshot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, read := range map[string]func() error{
+		"SnapshotValues": func() error { return second.SnapshotValues(mapSaver{}) },
+		"SnapshotDeltas": func() error { return second.SnapshotDeltas(&first, mapSaver{}) },
+		"SnapshotFieldDeltas": func() error {
+			return second.SnapshotFieldDeltas(&first, slog.FieldsExcept(), mapSaver{})
+		},
+		"SnapshotIntervals": func() error {
+			_, err := slog.SnapshotIntervals()
+			return err
+		},
+		"SliceIntField": func() error {
+			_, err := slog.SliceIntField("Duration", []int{0, 1})
+			return err
+		},
+		"ChangeIndices": func() error {
+			_, err := slog.ChangeIndices("Duration")
+			return err
+		},
+	} {
+		if err := read(); !errors.Is(err, web100.ErrRecordLengthMismatch) {
+			t.Errorf("%s() error = %v, want %v", name, err, web100.ErrRecordLengthMismatch)
+		}
+	}
+}
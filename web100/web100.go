@@ -7,8 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // NOTES:
@@ -211,6 +215,29 @@ func IPFromBytes(data []byte) (net.IP, error) {
 	}
 }
 
+// ErrSuspiciousString is returned by Save when a STR32 field contains
+// invalid UTF-8 or non-printable characters.  The value is still saved.
+var ErrSuspiciousString = errors.New("non-printable characters in string field")
+
+// str32 returns the null terminated string in data.  Invalid UTF-8 is
+// replaced by U+FFFD, as it cannot be stored, but other characters are kept
+// as is.  It returns false if the string has invalid UTF-8 or non-printable
+// characters.
+func str32(data []byte) (string, bool) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	ok := utf8.Valid(data)
+	str := strings.ToValidUTF8(string(data), string(utf8.RuneError))
+	for _, r := range str {
+		if !unicode.IsPrint(r) {
+			ok = false
+			break
+		}
+	}
+	return str, ok
+}
+
 // Save interprets data according to the receiver type, and saves the result to snapValues.
 // Most of the types are unused, but included here for completeness.
 // This does a single alloc per int64 save???
@@ -220,6 +247,10 @@ func (v *Variable) Save(data []byte, snapValues Saver) error {
 	if v.Name[0] == '_' {
 		return nil
 	}
+	if len(data) < v.Size {
+		return fmt.Errorf("%w: %s has %d bytes, want %d",
+			ErrRecordLengthMismatch, v.Name, len(data), v.Size)
+	}
 	// Use the canonical variable name. The variable name known to the web100
 	// kernel at run time lagged behind the official web100 spec. So, some
 	// variable names need to be translated from their legacy form (read from
@@ -265,8 +296,13 @@ func (v *Variable) Save(data []byte, snapValues Saver) error {
 		}
 		snapValues.SetString(canonicalName, ip.String())
 	case WEB100_TYPE_STR32:
-		// TODO - is there a better way?
-		snapValues.SetString(canonicalName, strings.SplitN(string(data), "\000", 2)[0])
+		// STR32 fields are null terminated C strings in a fixed 32 byte
+		// field, so anything after the first null is padding or garbage.
+		str, ok := str32(data)
+		snapValues.SetString(canonicalName, str)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrSuspiciousString, v.Name)
+		}
 	case WEB100_TYPE_OCTET:
 		// TODO - use byte array?
 		snapValues.SetInt64(canonicalName, int64(data[0]))
@@ -309,15 +345,31 @@ type connectionSpec struct {
 
 //=================================================================================
 
+// MaxSnapLogSize is the size in bytes of the largest snaplog that NewSnapLog
+// accepts.  The whole snaplog is held in a single slice, and snapshot offsets
+// are computed with int arithmetic, so this keeps every offset within range
+// even where int is 32 bits.
+var MaxSnapLogSize int64 = math.MaxInt32
+
+// ErrSnapLogTooLarge is returned by NewSnapLog for snaplogs larger than
+// MaxSnapLogSize.
+var ErrSnapLogTooLarge = errors.New("snaplog too large")
+
+// ErrRecordLengthMismatch is returned when snapshot records do not match the
+// "/read" fieldset from the header, e.g. due to a kernel/version mismatch.
+var ErrRecordLengthMismatch = errors.New("snapshot record length does not match fieldset")
+
 // SnapLog encapsulates the raw data and all elements of the header.
 type SnapLog struct {
-	// The entire raw contents of the file.  Generally 1.5MB, but may be much larger
+	// The entire raw contents of the file.  Generally 1.5MB, but may be much
+	// larger, up to MaxSnapLogSize.
 	raw []byte
 
 	Version   string
 	LogTime   uint32
 	GroupName string
 
+	// Offsets are bounded by MaxSnapLogSize, so they fit in an int.
 	connSpecOffset int // Offset in bytes of the ConnSpec
 	bodyOffset     int // Offset in bytes of the first snapshot
 	spec           fieldSet
@@ -331,6 +383,9 @@ type SnapLog struct {
 	connSpec connectionSpec
 }
 
+// ConnectionSpecValues saves the 4-tuple from the binary connection spec.
+// The binary spec only holds ipv4 addresses, so for ipv6 tests the saved
+// addresses are truncated, and callers must use the snapshot addresses.
 func (sl *SnapLog) ConnectionSpecValues(saver Saver) {
 	saver.SetInt64("local_af", int64(0))
 	src := sl.connSpec.SrcAddr
@@ -353,6 +408,15 @@ func (sl *SnapLog) SnapshotNumFields() int {
 	return len(sl.read.Fields)
 }
 
+// SpecFields returns a copy of the "/spec" variable definitions from the
+// snaplog header, in header order.  These describe the connection spec
+// fields, and may be used to generate field documentation.
+func (sl *SnapLog) SpecFields() []Variable {
+	fields := make([]Variable, len(sl.spec.Fields))
+	copy(fields, sl.spec.Fields)
+	return fields
+}
+
 // parseFields parses the newline separated web100 variable types from the header.
 func parseFields(buf *bytes.Buffer, preamble string, terminator string) (*fieldSet, error) {
 	fields := new(fieldSet)
@@ -415,8 +479,26 @@ func parseConnectionSpec(buf *bytes.Buffer) (connectionSpec, error) {
 		DestAddr: dstAddr, SrcAddr: srcAddr}, nil
 }
 
+// KnownVersions contains the web100 versions, from the first field of the
+// snaplog version line, whose snaplog layout has been verified.
+var KnownVersions = map[string]bool{
+	"2.5.17": true, // e.g. "2.5.17 200710051837 net100"
+	"2.5.27": true, // e.g. "2.5.27 201001301335 net100"
+}
+
+// KnownVersion returns true if the snaplog was written by a web100 version
+// in KnownVersions.
+func (sl *SnapLog) KnownVersion() bool {
+	fields := strings.Fields(sl.Version)
+	return len(fields) > 0 && KnownVersions[fields[0]]
+}
+
 // NewSnapLog creates a SnapLog from a byte array.  Returns error if there are problems.
 func NewSnapLog(raw []byte) (*SnapLog, error) {
+	if int64(len(raw)) > MaxSnapLogSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds limit of %d bytes",
+			ErrSnapLogTooLarge, len(raw), MaxSnapLogSize)
+	}
 	buf := bytes.NewBuffer(raw)
 
 	// First, the version, etc.
@@ -493,9 +575,36 @@ func NewSnapLog(raw []byte) (*SnapLog, error) {
 		connSpecOffset: connSpecOffset, bodyOffset: bodyOffset,
 		spec: *spec, read: *read, tune: *tune, connSpec: connSpec}
 
+	if err := slog.checkRecordLength(); err != nil {
+		return nil, err
+	}
 	return &slog, nil
 }
 
+// strideCheckRecords is the number of leading snapshot records checked by
+// checkRecordLength.
+const strideCheckRecords = 3
+
+// checkRecordLength verifies that the first few snapshot records begin at the
+// stride implied by the "/read" header.  If the declared record length does
+// not match the data, e.g. due to a kernel/version mismatch, every snapshot
+// offset would be silently wrong.
+func (sl *SnapLog) checkRecordLength() error {
+	for i := 0; i < strideCheckRecords; i++ {
+		offset := sl.bodyOffset + i*sl.read.Length
+		if offset+len(BEGIN_SNAP_DATA) > len(sl.raw) {
+			// Fewer records than we want to check.
+			break
+		}
+		if string(sl.raw[offset:offset+len(BEGIN_SNAP_DATA)]) != BEGIN_SNAP_DATA {
+			return fmt.Errorf(
+				"%w: snapshot %d does not start at offset %d; header record length %d does not match data",
+				ErrRecordLengthMismatch, i, offset, sl.read.Length)
+		}
+	}
+	return nil
+}
+
 // SnapCount returns the number of valid snapshots.
 func (sl *SnapLog) SnapCount() int {
 	total := len(sl.raw) - sl.bodyOffset
@@ -553,20 +662,40 @@ func (snap *Snapshot) reset(data []byte, fields *fieldSet) {
 	snap.raw = data
 }
 
-// SnapshotValues writes all values into the provided Saver.
+// fieldData returns the bytes of field within the snapshot record, or
+// ErrRecordLengthMismatch if the field does not lie within the record.
+func (snap *Snapshot) fieldData(field *Variable) ([]byte, error) {
+	if field.Offset < 0 || field.Size < 0 || field.Offset+field.Size > len(snap.raw) {
+		return nil, fmt.Errorf("%w: record has %d bytes, field %s needs %d",
+			ErrRecordLengthMismatch, len(snap.raw), field.Name, field.Offset+field.Size)
+	}
+	return snap.raw[field.Offset : field.Offset+field.Size], nil
+}
+
+// SnapshotValues writes all values into the provided Saver.  If a field
+// cannot be saved cleanly, e.g. ErrSuspiciousString, the remaining fields are
+// still saved, and the first such error is returned.
 func (snap *Snapshot) SnapshotValues(snapValues Saver) error {
 	if snap.raw == nil {
 		return errors.New("Empty/Invalid Snaplog")
 	}
+	var saveErr error
 	var field Variable
 	for _, field = range snap.fields.Fields {
+		data, err := snap.fieldData(&field)
+		if err != nil {
+			return err
+		}
 		// Interpret and save the web100 field value.
-		field.Save(snap.raw[field.Offset:field.Offset+field.Size], snapValues)
+		if err := field.Save(data, snapValues); err != nil && saveErr == nil {
+			saveErr = err
+		}
 	}
-	return nil
+	return saveErr
 }
 
-// SnapshotDeltas writes changed values into the provided Saver.
+// SnapshotDeltas writes changed values into the provided Saver.  Like
+// SnapshotValues, it returns the first error from saving a field.
 func (snap *Snapshot) SnapshotDeltas(other *Snapshot, snapValues Saver) error {
 	if snap.raw == nil {
 		return errors.New("Empty/Invalid Snaplog")
@@ -575,16 +704,83 @@ func (snap *Snapshot) SnapshotDeltas(other *Snapshot, snapValues Saver) error {
 		// If other is empty, return full snapshot
 		return snap.SnapshotValues(snapValues)
 	}
+	var saveErr error
 	var field Variable
 	for _, field = range snap.fields.Fields {
-		a := other.raw[field.Offset : field.Offset+field.Size]
-		b := snap.raw[field.Offset : field.Offset+field.Size]
+		a, err := other.fieldData(&field)
+		if err != nil {
+			return err
+		}
+		b, err := snap.fieldData(&field)
+		if err != nil {
+			return err
+		}
 		if bytes.Compare(a, b) != 0 {
 			// Interpret and save the web100 field value.
-			field.Save(b, snapValues)
+			if err := field.Save(b, snapValues); err != nil && saveErr == nil {
+				saveErr = err
+			}
 		}
 	}
-	return nil
+	return saveErr
+}
+
+// FieldsExcept returns the "/read" snapshot fields, omitting deprecated fields
+// and any field whose canonical name is in exclude.  The result may be passed
+// to SnapshotFieldDeltas.
+func (sl *SnapLog) FieldsExcept(exclude ...string) []Variable {
+	skip := make(map[string]bool, len(exclude))
+	for _, name := range exclude {
+		skip[name] = true
+	}
+	fields := make([]Variable, 0, len(sl.read.Fields))
+	for _, field := range sl.read.Fields {
+		// Deprecated fields are never saved, so don't bother comparing them.
+		if field.Name[0] == '_' {
+			continue
+		}
+		name := field.Name
+		if canonical, ok := CanonicalNames[name]; ok {
+			name = canonical
+		}
+		if !skip[name] {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// SnapshotFieldDeltas writes changed values into the provided Saver, like
+// SnapshotDeltas, but only compares the provided fields.  Callers that discard
+// some fields (e.g. the constant ones) avoid comparing and saving them.
+// The fields must come from the SnapLog that produced both snapshots.
+func (snap *Snapshot) SnapshotFieldDeltas(other *Snapshot, fields []Variable, snapValues Saver) error {
+	if snap.raw == nil {
+		return errors.New("Empty/Invalid Snaplog")
+	}
+	var saveErr error
+	var field Variable
+	for _, field = range fields {
+		b, err := snap.fieldData(&field)
+		if err != nil {
+			return err
+		}
+		changed := other.raw == nil // If other is empty, save all requested fields.
+		if !changed {
+			a, err := other.fieldData(&field)
+			if err != nil {
+				return err
+			}
+			changed = !bytes.Equal(a, b)
+		}
+		if changed {
+			// Interpret and save the web100 field value.
+			if err := field.Save(b, snapValues); err != nil && saveErr == nil {
+				saveErr = err
+			}
+		}
+	}
+	return saveErr
 }
 
 // ChangeIndices finds all snapshot indices where the specified field
@@ -606,7 +802,10 @@ func (sl *SnapLog) ChangeIndices(fieldName string) ([]int, error) {
 		}
 		s.reset(sl.raw[offset+len(BEGIN_SNAP_DATA):offset+sl.read.Length], &sl.read)
 
-		data := s.raw[field.Offset : field.Offset+field.Size]
+		data, err := s.fieldData(field)
+		if err != nil {
+			return nil, err
+		}
 		if bytes.Compare(data, last) != 0 {
 			result = append(result, i)
 		}
@@ -615,6 +814,44 @@ func (sl *SnapLog) ChangeIndices(fieldName string) ([]int, error) {
 	return result, nil
 }
 
+// SnapshotIntervals returns the time between each pair of consecutive
+// snapshots, from the snapshot Duration field, which is the microseconds
+// since the connection started.  Snapshots are nominally taken every 5 msec,
+// so irregular intervals indicate dropped or delayed snapshots.
+func (sl *SnapLog) SnapshotIntervals() ([]time.Duration, error) {
+	field := sl.read.find("Duration")
+	if field == nil {
+		return nil, errors.New("Duration field not found")
+	}
+	if sl.SnapCount() < 2 {
+		return nil, nil
+	}
+	result := make([]time.Duration, 0, sl.SnapCount()-1)
+	durations := NewIntArraySaver(1)
+	var s Snapshot
+	for i := 0; i < sl.SnapCount(); i++ {
+		offset := sl.bodyOffset + i*sl.read.Length
+		begin := string(sl.raw[offset : offset+len(BEGIN_SNAP_DATA)])
+		if begin != BEGIN_SNAP_DATA {
+			return nil, fmt.Errorf("missing BEGIN_SNAP_DATA in snapshot %d", i)
+		}
+		s.reset(sl.raw[offset+len(BEGIN_SNAP_DATA):offset+sl.read.Length], &sl.read)
+		data, err := s.fieldData(field)
+		if err != nil {
+			return nil, err
+		}
+		if err := field.Save(data, &durations); err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			n := len(durations.Integers)
+			delta := durations.Integers[n-1] - durations.Integers[n-2]
+			result = append(result, time.Duration(delta)*time.Microsecond)
+		}
+	}
+	return result, nil
+}
+
 type IntArraySaver struct {
 	Integers []int64
 }
@@ -629,19 +866,61 @@ func (s *IntArraySaver) SetInt64(name string, val int64) {
 func (s *IntArraySaver) SetBool(name string, val bool)     {}
 func (s *IntArraySaver) SetString(name string, val string) {}
 
+// NamedValue is a single field saved to an OrderedSaver.
+type NamedValue struct {
+	Name  string
+	Value interface{}
+}
+
+// OrderedSaver is a Saver that records field names and values in the order
+// they are saved.  Useful for deterministic comparison of snapshots.
+type OrderedSaver struct {
+	Fields []NamedValue
+}
+
+func (s *OrderedSaver) SetInt64(name string, val int64) {
+	s.Fields = append(s.Fields, NamedValue{name, val})
+}
+func (s *OrderedSaver) SetBool(name string, val bool) {
+	s.Fields = append(s.Fields, NamedValue{name, val})
+}
+func (s *OrderedSaver) SetString(name string, val string) {
+	s.Fields = append(s.Fields, NamedValue{name, val})
+}
+
+// Names returns the saved field names, in order.
+func (s *OrderedSaver) Names() []string {
+	names := make([]string, len(s.Fields))
+	for i := range s.Fields {
+		names[i] = s.Fields[i].Name
+	}
+	return names
+}
+
+// SliceIntField returns the values of an integer field in the snapshots at
+// the given indices.
 // about 40 nsec per field.
-func (sl *SnapLog) SliceIntField(fieldName string, indices []int) []int64 {
+func (sl *SnapLog) SliceIntField(fieldName string, indices []int) ([]int64, error) {
 	var s Snapshot // This saves about 2 usec, compared with creating new Snapshot for each row.
 	field := sl.read.find(fieldName)
+	if field == nil {
+		return nil, errors.New("Field not found")
+	}
 	result := NewIntArraySaver(len(indices))
 	for i := 0; i < len(indices); i++ {
 		// Safe to skip the validation, because it was done when getting the indices.
 		offset := sl.bodyOffset + indices[i]*sl.read.Length
 		s.reset(sl.raw[offset+len(BEGIN_SNAP_DATA):offset+sl.read.Length], &sl.read)
 
-		field.Save(s.raw[field.Offset:field.Offset+field.Size], &result)
+		data, err := s.fieldData(field)
+		if err != nil {
+			return nil, err
+		}
+		if err := field.Save(data, &result); err != nil {
+			return nil, err
+		}
 	}
-	return result.Integers
+	return result.Integers, nil
 }
 
 // For each increment in CongSignal, we want to add values of snapCount, SRTT
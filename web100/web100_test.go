@@ -1,13 +1,17 @@
 package web100_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/m-lab/etl/web100"
 	pipe "gopkg.in/m-lab/pipe.v3"
@@ -46,6 +50,95 @@ func TestHeaderParsing(t *testing.T) {
 	}
 }
 
+func TestSpecFields(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData, err := ioutil.ReadFile(`testdata/web100/` + c2sName)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := []web100.Variable{
+		{Name: "_RemotePort", Offset: 0, Type: web100.WEB100_TYPE_INET_PORT_NUMBER, Size: 2},
+		{Name: "_RemoteAddress", Offset: 2, Type: web100.WEB100_TYPE_INET_ADDRESS, Size: 17},
+		{Name: "RemPort", Offset: 19, Type: web100.WEB100_TYPE_INET_PORT_NUMBER, Size: 2},
+		{Name: "RemAddress", Offset: 21, Type: web100.WEB100_TYPE_INET_ADDRESS, Size: 17},
+		{Name: "LocalPort", Offset: 38, Type: web100.WEB100_TYPE_INET_PORT_NUMBER, Size: 2},
+		{Name: "LocalAddress", Offset: 40, Type: web100.WEB100_TYPE_INET_ADDRESS, Size: 17},
+		{Name: "LocalAddressType", Offset: 57, Type: web100.WEB100_TYPE_INTEGER, Size: 4},
+	}
+	got := slog.SpecFields()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SpecFields() = %v, want %v", got, want)
+	}
+
+	// The result is a copy, so changes should not affect the snaplog.
+	got[0].Name = "changed"
+	if slog.SpecFields()[0].Name != "_RemotePort" {
+		t.Error("SpecFields() should return a copy")
+	}
+}
+
+func TestKnownVersion(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData, err := ioutil.ReadFile(`testdata/web100/` + c2sName)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slog.KnownVersion() {
+		t.Errorf("KnownVersion() = false for %q", slog.Version)
+	}
+
+	unknown := bytes.Replace(c2sData, []byte("2.5.27 201001301335"), []byte("9.9.99 202001301335"), 1)
+	slog, err = web100.NewSnapLog(unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slog.KnownVersion() {
+		t.Errorf("KnownVersion() = true for %q", slog.Version)
+	}
+}
+
+func TestSnapshotIntervals(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	c2sData, err := ioutil.ReadFile(`testdata/web100/` + c2sName)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	slog, err := web100.NewSnapLog(c2sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intervals, err := slog.SnapshotIntervals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intervals) != slog.SnapCount()-1 {
+		t.Fatalf("SnapshotIntervals() returned %d intervals, want %d", len(intervals), slog.SnapCount()-1)
+	}
+	// This snaplog has a regular 5 msec cadence, with a single dropped
+	// snapshot, and a single repeated snapshot.
+	counts := map[time.Duration]int{}
+	for _, d := range intervals {
+		counts[d.Round(time.Millisecond)]++
+	}
+	want := map[time.Duration]int{
+		0:                     1,
+		5 * time.Millisecond:  2121,
+		10 * time.Millisecond: 1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("SnapshotIntervals() cadence = %v, want %v", counts, want)
+	}
+}
+
 type SimpleSaver struct {
 	Integers map[string]int64
 	Strings  map[string]string
@@ -200,6 +293,128 @@ func TestNewVar(t *testing.T) {
 	//	8 /*COUNTER64*/, 2 /*PORT_NUM*/, 17, 17, 32 /*STR32*/, 1 /*OCTET*/, 0}
 }
 
+func TestSaveStr32(t *testing.T) {
+	v, err := web100.NewVariable("foo 0 11 32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := func(s string) []byte {
+		b := make([]byte, 32)
+		copy(b, s)
+		return b
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "normal", data: field("cubic"), want: "cubic"},
+		{name: "full-width", data: []byte(strings.Repeat("a", 32)), want: strings.Repeat("a", 32)},
+		{name: "empty", data: field(""), want: ""},
+		{name: "garbage-after-null", data: field("reno\000\001\002junk"), want: "reno"},
+		{name: "control-before-null", data: field("re\001no"), want: "re\001no", wantErr: true},
+		{name: "invalid-utf8", data: field("re\xffno"), want: "re\ufffdno", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saver := NewSimpleSaver()
+			err := v.Save(tt.data, saver)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Save() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, web100.ErrSuspiciousString) {
+				t.Errorf("Save() error = %v, want ErrSuspiciousString", err)
+			}
+			if got := saver.Strings["foo"]; got != tt.want {
+				t.Errorf("Save() saved %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSnapLogRecordLengthMismatch(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	data, err := ioutil.ReadFile(`testdata/web100/` + c2sName)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := web100.NewSnapLog(data); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Drop 4 bytes from the first record, so that it is shorter than the
+	// record length declared in the header.
+	body := bytes.Index(data, []byte(web100.BEGIN_SNAP_DATA))
+	if body < 0 {
+		t.Fatal("no snapshots in test data")
+	}
+	cut := body + len(web100.BEGIN_SNAP_DATA) + 8
+	bad := append(append([]byte{}, data[:cut]...), data[cut+4:]...)
+	_, err = web100.NewSnapLog(bad)
+	if err == nil || !strings.Contains(err.Error(), "record length") {
+		t.Errorf("NewSnapLog() error = %v, want record length mismatch", err)
+	}
+	if !errors.Is(err, web100.ErrRecordLengthMismatch) {
+		t.Errorf("NewSnapLog() error = %v, want ErrRecordLengthMismatch", err)
+	}
+
+	// Add 4 trailing bytes to the first record, beyond the known fields.
+	next := body + len(web100.BEGIN_SNAP_DATA)
+	if n := bytes.Index(data[next:], []byte(web100.BEGIN_SNAP_DATA)); n >= 0 {
+		next += n
+	} else {
+		t.Fatal("only one snapshot in test data")
+	}
+	long := append(append(append([]byte{}, data[:next]...), 0, 0, 0, 0), data[next:]...)
+	if _, err := web100.NewSnapLog(long); !errors.Is(err, web100.ErrRecordLengthMismatch) {
+		t.Errorf("NewSnapLog() error = %v, want ErrRecordLengthMismatch", err)
+	}
+}
+
+func TestSaveShortData(t *testing.T) {
+	// COUNTER64 fields are 8 bytes.
+	v, err := web100.NewVariable("foo 0 7 8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver := NewSimpleSaver()
+	if err := v.Save(make([]byte, 4), saver); !errors.Is(err, web100.ErrRecordLengthMismatch) {
+		t.Errorf("Save() error = %v, want ErrRecordLengthMismatch", err)
+	}
+	if _, ok := saver.Integers["foo"]; ok {
+		t.Error("Save() saved a value from short data")
+	}
+	if err := v.Save([]byte{1, 0, 0, 0, 0, 0, 0, 0}, saver); err != nil {
+		t.Errorf("Save() error = %v", err)
+	}
+	if saver.Integers["foo"] != 1 {
+		t.Errorf("Save() saved %d, want 1", saver.Integers["foo"])
+	}
+}
+
+func TestNewSnapLogTooLarge(t *testing.T) {
+	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
+	data, err := ioutil.ReadFile(`testdata/web100/` + c2sName)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func(max int64) { web100.MaxSnapLogSize = max }(web100.MaxSnapLogSize)
+
+	// A snaplog at the limit is accepted.
+	web100.MaxSnapLogSize = int64(len(data))
+	if _, err := web100.NewSnapLog(data); err != nil {
+		t.Fatalf("NewSnapLog() error = %v, want nil at the size limit", err)
+	}
+
+	// One byte smaller, and it is rejected.
+	web100.MaxSnapLogSize = int64(len(data)) - 1
+	_, err = web100.NewSnapLog(data)
+	if !errors.Is(err, web100.ErrSnapLogTooLarge) {
+		t.Errorf("NewSnapLog() error = %v, want ErrSnapLogTooLarge", err)
+	}
+}
+
 func TestChangeIndices(t *testing.T) {
 	c2sName := `20170509T13:45:13.590210000Z_eb.measurementlab.net:48716.c2s_snaplog`
 	c2sData, err := ioutil.ReadFile(`testdata/web100/` + c2sName)
@@ -259,7 +474,7 @@ func BenchmarkSliceInt(b *testing.B) {
 
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		slog.SliceIntField("SmoothedRTT", indices)
+		_, err = slog.SliceIntField("SmoothedRTT", indices)
 		if err != nil {
 			b.Fatalf(err.Error())
 		}
@@ -282,6 +497,153 @@ func BenchmarkSaver(b *testing.B) {
 	}
 }
 
+type mapSaver map[string]interface{}
+
+func (s mapSaver) SetString(name string, val string) { s[name] = val }
+func (s mapSaver) SetInt64(name string, val int64)   { s[name] = val }
+func (s mapSaver) SetBool(name string, val bool)     { s[name] = val }
+
+var constantFields = []string{"TimeStamps", "StartTimeStamp", "StartTimeUsec",
+	"LocalAddress", "LocalAddressType", "LocalPort", "RemAddress", "RemPort", "SACK"}
+
+func TestSnapshotFieldDeltas(t *testing.T) {
+	s2cName := `20090601T22:19:19.325928000Z-75.133.69.98:60631.s2c_snaplog`
+	data, err := ioutil.ReadFile(`testdata/web100/` + s2cName)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	slog, err := web100.NewSnapLog(data)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	fields := slog.FieldsExcept(constantFields...)
+	if len(fields) >= slog.SnapshotNumFields()-len(constantFields) {
+		t.Errorf("FieldsExcept() got %d fields, want fewer than %d",
+			len(fields), slog.SnapshotNumFields()-len(constantFields))
+	}
+
+	last := &web100.Snapshot{}
+	for i := 0; i < slog.SnapCount(); i++ {
+		snap, err := slog.Snapshot(i)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		want := mapSaver{}
+		if err := snap.SnapshotDeltas(last, want); err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, name := range constantFields {
+			delete(want, name)
+		}
+		got := mapSaver{}
+		if err := snap.SnapshotFieldDeltas(last, fields, got); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("SnapshotFieldDeltas() snapshot %d = %v, want %v", i, got, want)
+		}
+		last = &snap
+	}
+}
+
+func TestOrderedSaver(t *testing.T) {
+	s2cName := `20090601T22:19:19.325928000Z-75.133.69.98:60631.s2c_snaplog`
+	data, err := ioutil.ReadFile(`testdata/web100/` + s2cName)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	slog, err := web100.NewSnapLog(data)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	snap, err := slog.Snapshot(slog.SnapCount() - 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	saver := web100.OrderedSaver{}
+	if err := snap.SnapshotValues(&saver); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Values are saved in header order, using canonical names.
+	want := []string{}
+	for _, field := range slog.FieldsExcept() {
+		name := field.Name
+		if canonical, ok := web100.CanonicalNames[name]; ok {
+			name = canonical
+		}
+		want = append(want, name)
+	}
+	if !reflect.DeepEqual(saver.Names(), want) {
+		t.Errorf("Names() = %v, want %v", saver.Names(), want)
+	}
+
+	// Saving the same snapshot again produces an identical record.
+	again := web100.OrderedSaver{}
+	snap.SnapshotValues(&again)
+	if !reflect.DeepEqual(saver, again) {
+		t.Error("OrderedSaver records differ for the same snapshot")
+	}
+	values := mapSaver{}
+	snap.SnapshotValues(values)
+	for _, f := range saver.Fields {
+		if values[f.Name] != f.Value {
+			t.Errorf("%s = %v, want %v", f.Name, f.Value, values[f.Name])
+		}
+	}
+}
+
+func loadSnapshots(b *testing.B) (*web100.SnapLog, []web100.Snapshot) {
+	s2cName := `20090601T22:19:19.325928000Z-75.133.69.98:60631.s2c_snaplog`
+	data, err := ioutil.ReadFile(`testdata/web100/` + s2cName)
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+	slog, err := web100.NewSnapLog(data)
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+	snaps := make([]web100.Snapshot, slog.SnapCount())
+	for i := range snaps {
+		snaps[i], err = slog.Snapshot(i)
+		if err != nil {
+			b.Fatalf(err.Error())
+		}
+	}
+	return slog, snaps
+}
+
+// Compares all fields, including those NDT later deletes.
+func BenchmarkSnapshotDeltas(b *testing.B) {
+	b.StopTimer()
+	_, snaps := loadSnapshots(b)
+	ns := NullSaver{}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		last := &web100.Snapshot{}
+		for j := range snaps {
+			snaps[j].SnapshotDeltas(last, &ns)
+			last = &snaps[j]
+		}
+	}
+}
+
+// Compares only the fields NDT keeps.
+func BenchmarkSnapshotFieldDeltas(b *testing.B) {
+	b.StopTimer()
+	slog, snaps := loadSnapshots(b)
+	fields := slog.FieldsExcept(constantFields...)
+	ns := NullSaver{}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		last := &web100.Snapshot{}
+		for j := range snaps {
+			snaps[j].SnapshotFieldDeltas(last, fields, &ns)
+			last = &snaps[j]
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	p := pipe.Script(
 		"unpacking testdata files",
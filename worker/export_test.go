@@ -0,0 +1,23 @@
+package worker
+
+// This file contains wrappers to enable blackbox tests to access package
+// internals.
+// See https://golang.org/src/net/http/export_test.go.
+
+// TaskError allows testing the mapping of task errors to HTTP status codes.
+var TaskError = taskError
+
+// ResetShutdownForTest allows tests to process tasks after calling Shutdown.
+func ResetShutdownForTest() {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	inFlight.stopping = false
+}
+
+// ResetProcessedForTest clears the processed task cache.
+func ResetProcessedForTest() {
+	processedTasks.Lock()
+	defer processedTasks.Unlock()
+	processedTasks.keys = make(map[string]struct{})
+	processedTasks.order = nil
+}
@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"sync"
+
+	"github.com/m-lab/etl/etl"
+	"github.com/m-lab/etl/parser"
+)
+
+// processedTasks records the tasks that this worker has processed
+// successfully, so that tasks redelivered by the task queue can be skipped.
+// It holds at most etl.ProcessedTaskCacheSize entries, evicting the oldest.
+var processedTasks = struct {
+	sync.Mutex
+	keys  map[string]struct{}
+	order []string // Oldest first.
+}{keys: make(map[string]struct{})}
+
+// processedKey returns the cache key for a task.  It includes the parser
+// version, so that tasks are reprocessed after the parser is upgraded.
+func processedKey(dp etl.DataPath) string {
+	return dp.URI + " " + parser.Version()
+}
+
+// alreadyProcessed returns true if the task was previously processed
+// successfully by this worker.
+func alreadyProcessed(dp etl.DataPath) bool {
+	if etl.ProcessedTaskCacheSize <= 0 {
+		return false
+	}
+	processedTasks.Lock()
+	defer processedTasks.Unlock()
+	_, ok := processedTasks.keys[processedKey(dp)]
+	return ok
+}
+
+// markProcessed records that the task was processed successfully.
+func markProcessed(dp etl.DataPath) {
+	if etl.ProcessedTaskCacheSize <= 0 {
+		return
+	}
+	key := processedKey(dp)
+	processedTasks.Lock()
+	defer processedTasks.Unlock()
+	if _, ok := processedTasks.keys[key]; ok {
+		return
+	}
+	processedTasks.keys[key] = struct{}{}
+	processedTasks.order = append(processedTasks.order, key)
+	for len(processedTasks.order) > etl.ProcessedTaskCacheSize {
+		delete(processedTasks.keys, processedTasks.order[0])
+		processedTasks.order = processedTasks.order[1:]
+	}
+}
@@ -2,15 +2,19 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/factory"
 	"github.com/m-lab/etl/metrics"
 	"github.com/m-lab/etl/parser"
+	"github.com/m-lab/etl/row"
+	"github.com/m-lab/etl/storage"
 	"github.com/m-lab/etl/task"
 )
 
@@ -18,6 +22,7 @@ import (
 type StandardTaskFactory struct {
 	Sink   factory.SinkFactory
 	Source factory.SourceFactory
+	Parser factory.ParserFactory // If nil, parser.NewParserFactory() is used.
 }
 
 // Get implements task.Factory.Get
@@ -36,8 +41,12 @@ func (tf *StandardTaskFactory) Get(ctx context.Context, dp etl.DataPath) (*task.
 		return nil, err
 	}
 
-	p := parser.NewSinkParser(dp.GetDataType(), sink, src.Type())
-	if p == nil {
+	pf := tf.Parser
+	if pf == nil {
+		pf = parser.NewParserFactory()
+	}
+	p, err := pf.Get(ctx, dp, sink, src.Type())
+	if err != nil {
 		e := fmt.Errorf("%v creating parser for %s", err, dp.GetDataType())
 		log.Println(e, dp.URI)
 		return nil, err
@@ -47,6 +56,71 @@ func (tf *StandardTaskFactory) Get(ctx context.Context, dp etl.DataPath) (*task.
 	return tsk, nil
 }
 
+// ErrShuttingDown is returned for tasks that arrive after Shutdown was called.
+var ErrShuttingDown = errors.New("worker is shutting down")
+
+// inFlight tracks the tasks currently being processed, so that Shutdown can
+// stop them.
+var inFlight = struct {
+	sync.Mutex
+	stopping bool
+	tasks    map[*task.Task]struct{}
+	wg       sync.WaitGroup
+}{tasks: make(map[*task.Task]struct{})}
+
+// track adds tsk to the in-flight tasks.  Returns false if the worker is
+// shutting down, in which case tsk should not be processed.
+func track(tsk *task.Task) bool {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if inFlight.stopping {
+		return false
+	}
+	inFlight.tasks[tsk] = struct{}{}
+	inFlight.wg.Add(1)
+	return true
+}
+
+// untrack removes tsk from the in-flight tasks.
+func untrack(tsk *task.Task) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	delete(inFlight.tasks, tsk)
+	inFlight.wg.Done()
+}
+
+// ShuttingDown returns true once Shutdown has been called.
+func ShuttingDown() bool {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	return inFlight.stopping
+}
+
+// Shutdown stops accepting new tasks, and stops all in-flight tasks after the
+// test each is currently parsing.  Stopped tasks flush their buffered rows to
+// the sink before returning.  Shutdown blocks until all in-flight tasks are
+// done, or the context expires.
+func Shutdown(ctx context.Context) error {
+	inFlight.Lock()
+	inFlight.stopping = true
+	for tsk := range inFlight.tasks {
+		tsk.Stop()
+	}
+	inFlight.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		inFlight.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // ProcessGKETask interprets a filename to create a Task, Parser, and Inserter,
 // and processes the file content.
 // Used default BQ Sink, and GCS Source.
@@ -61,6 +135,13 @@ func ProcessGKETask(ctx context.Context, path etl.DataPath, tf task.Factory) etl
 	metrics.WorkerState.WithLabelValues(path.DataType, "worker").Inc()
 	defer metrics.WorkerState.WithLabelValues(path.DataType, "worker").Dec()
 
+	if alreadyProcessed(path) {
+		// The task queue redelivered a task that was already processed.
+		log.Println("Skipping already processed task", path.URI)
+		metrics.TaskTotal.WithLabelValues(path.DataType, "AlreadyProcessed").Inc()
+		return nil
+	}
+
 	tsk, err := tf.Get(ctx, path)
 	if err != nil {
 		metrics.TaskTotal.WithLabelValues(err.DataType(), err.Detail()).Inc()
@@ -69,7 +150,46 @@ func ProcessGKETask(ctx context.Context, path etl.DataPath, tf task.Factory) etl
 	}
 
 	defer tsk.Close()
-	return DoGKETask(tsk, path)
+	if !track(tsk) {
+		metrics.TaskTotal.WithLabelValues(path.DataType, "ShuttingDown").Inc()
+		return factory.NewError(
+			path.DataType, "ShuttingDown", http.StatusServiceUnavailable, ErrShuttingDown)
+	}
+	defer untrack(tsk)
+	pErr := DoGKETask(tsk, path)
+	if pErr == nil {
+		markProcessed(path)
+	}
+	return pErr
+}
+
+// taskError converts an error returned by ProcessAllTests into a
+// ProcessingError.  Per-test content errors are counted by the task and never
+// reach here, so these are failures that abort the whole task.  Errors that
+// are already typed keep their status.  Tasks stopped by Shutdown, failures
+// committing rows to the sink, and truncated archives are reported as
+// retriable.  Anything else, e.g. an unrecovered GCS read error, is an
+// internal error.
+func taskError(dataType string, err error) etl.ProcessingError {
+	var pErr etl.ProcessingError
+	if errors.As(err, &pErr) {
+		return pErr
+	}
+	if errors.Is(err, task.ErrTaskStopped) {
+		return factory.NewError(
+			dataType, "TaskStopped", http.StatusServiceUnavailable, err)
+	}
+	commitRowErr := row.ErrCommitRow{}
+	if errors.As(err, &commitRowErr) {
+		return factory.NewError(
+			dataType, "CommitRow", http.StatusServiceUnavailable, err)
+	}
+	if errors.Is(err, storage.ErrTruncatedArchive) {
+		return factory.NewError(
+			dataType, "TruncatedArchive", http.StatusServiceUnavailable, err)
+	}
+	return factory.NewError(
+		dataType, "TaskError", http.StatusInternalServerError, err)
 }
 
 // DoGKETask creates task, processes all tests and handle metrics
@@ -92,11 +212,10 @@ func DoGKETask(tsk *task.Task, path etl.DataPath) etl.ProcessingError {
 		date.Weekday().String()).Add(float64(files))
 
 	if err != nil {
-		metrics.TaskTotal.WithLabelValues(path.DataType, "TaskError").Inc()
+		pErr := taskError(path.DataType, err)
+		metrics.TaskTotal.WithLabelValues(path.DataType, pErr.Detail()).Inc()
 		log.Printf("Error Processing Tests:  %v", err)
-		return factory.NewError(
-			path.DataType, "TaskError", http.StatusInternalServerError, err)
-		// TODO - anything better we could do here?
+		return pErr
 	}
 
 	// NOTE: In the k8s parsers, there are huge spikes in the task rate.
@@ -3,6 +3,7 @@ package worker_test
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,10 +12,13 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 
 	"github.com/m-lab/go/rtx"
@@ -22,7 +26,9 @@ import (
 	"github.com/m-lab/etl/etl"
 	"github.com/m-lab/etl/factory"
 	"github.com/m-lab/etl/metrics"
+	"github.com/m-lab/etl/row"
 	etlstorage "github.com/m-lab/etl/storage"
+	"github.com/m-lab/etl/task"
 	"github.com/m-lab/etl/worker"
 
 	"github.com/fsouza/fake-gcs-server/fakestorage"
@@ -155,3 +161,272 @@ func TestProcessGKETask(t *testing.T) {
 	metrics.TaskTotal.Reset()
 	metrics.TestTotal.Reset()
 }
+
+func TestTaskError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{
+			name: "typed",
+			err:  factory.NewError("ndt7", "Sink", http.StatusBadGateway, io.ErrUnexpectedEOF),
+			want: http.StatusBadGateway,
+		},
+		{
+			name: "stopped",
+			err:  task.ErrTaskStopped,
+			want: http.StatusServiceUnavailable,
+		},
+		{
+			name: "commit",
+			err:  fmt.Errorf("wrapped: %w", row.ErrCommitRow{Err: io.ErrClosedPipe}),
+			want: http.StatusServiceUnavailable,
+		},
+		{
+			name: "truncated",
+			err:  fmt.Errorf("%w: %v", etlstorage.ErrTruncatedArchive, io.ErrUnexpectedEOF),
+			want: http.StatusServiceUnavailable,
+		},
+		{
+			name: "gcs",
+			err:  errors.New("stream error: stream ID 801; INTERNAL_ERROR"),
+			want: http.StatusInternalServerError,
+		},
+		{
+			name: "unknown",
+			err:  io.ErrShortBuffer,
+			want: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := worker.TaskError("ndt7", tt.err)
+			if got.Code() != tt.want {
+				t.Errorf("TaskError() code = %d, want %d", got.Code(), tt.want)
+			}
+		})
+	}
+}
+
+// blockingParser buffers one row per test, and blocks in the first call to
+// ParseAndInsert until released.
+type blockingParser struct {
+	*row.Base
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (p *blockingParser) IsParsable(testName string, test []byte) (string, bool) {
+	return "test", true
+}
+
+func (p *blockingParser) ParseAndInsert(meta etl.Metadata, testName string, test []byte) error {
+	err := p.Put(testName)
+	p.once.Do(func() {
+		close(p.started)
+		<-p.release
+	})
+	return err
+}
+
+func (p *blockingParser) TableName() string     { return "test" }
+func (p *blockingParser) FullTableName() string { return "test" }
+func (p *blockingParser) RowsInBuffer() int     { return p.GetStats().Buffered }
+func (p *blockingParser) Committed() int        { return p.GetStats().Committed }
+func (p *blockingParser) Accepted() int         { return p.GetStats().Total() }
+func (p *blockingParser) Failed() int           { return p.GetStats().Failed }
+
+type blockingParserFactory struct {
+	p *blockingParser
+}
+
+func (pf *blockingParserFactory) Get(ctx context.Context, dp etl.DataPath, sink row.Sink, table string) (etl.Parser, etl.ProcessingError) {
+	pf.p.Base = row.NewBase(table, sink, 100)
+	return pf.p, nil
+}
+
+type countingSink struct {
+	committed int
+}
+
+func (s *countingSink) Commit(rows []interface{}, label string) (int, error) {
+	s.committed += len(rows)
+	return len(rows), nil
+}
+
+func (s *countingSink) Close() error { return nil }
+
+type countingSinkFactory struct {
+	sink *countingSink
+}
+
+func (sf *countingSinkFactory) Get(ctx context.Context, dp etl.DataPath) (row.Sink, etl.ProcessingError) {
+	return sf.sink, nil
+}
+
+func TestShutdown(t *testing.T) {
+	defer worker.ResetShutdownForTest()
+
+	sink := &countingSink{}
+	p := &blockingParser{started: make(chan struct{}), release: make(chan struct{})}
+	tf := worker.StandardTaskFactory{
+		Sink:   &countingSinkFactory{sink},
+		Source: NewSourceFactory("test-bucket"),
+		Parser: &blockingParserFactory{p},
+	}
+	filename := "gs://test-bucket/ndt/ndt5/2019/12/01/20191201T020011.395772Z-ndt5-mlab1-bcn01-ndt.tgz"
+	path, err := etl.ValidateTestPath(filename)
+	rtx.Must(err, "bad path")
+
+	taskErr := make(chan etl.ProcessingError)
+	go func() {
+		taskErr <- worker.ProcessGKETask(context.Background(), path, &tf)
+	}()
+	<-p.started
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- worker.Shutdown(context.Background())
+	}()
+	for !worker.ShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	close(p.release)
+
+	// The stopped task should flush the buffered row, and report a retriable error.
+	pErr := <-taskErr
+	if pErr == nil || pErr.Code() != http.StatusServiceUnavailable {
+		t.Errorf("ProcessGKETask() = %v, want %d", pErr, http.StatusServiceUnavailable)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+	if sink.committed != 1 {
+		t.Errorf("committed = %d, want 1", sink.committed)
+	}
+
+	// New tasks are rejected after shutdown.
+	pErr = worker.ProcessGKETask(context.Background(), path, &tf)
+	if pErr == nil || pErr.Code() != http.StatusServiceUnavailable {
+		t.Errorf("ProcessGKETask() after Shutdown = %v, want %d", pErr, http.StatusServiceUnavailable)
+	}
+}
+
+// countingTaskFactory counts the tasks created by the wrapped factory.
+type countingTaskFactory struct {
+	worker.StandardTaskFactory
+	tasks int
+}
+
+func (tf *countingTaskFactory) Get(ctx context.Context, dp etl.DataPath) (*task.Task, etl.ProcessingError) {
+	tf.tasks++
+	return tf.StandardTaskFactory.Get(ctx, dp)
+}
+
+func TestProcessGKETaskSkipsProcessed(t *testing.T) {
+	defer func(n int) { etl.ProcessedTaskCacheSize = n }(etl.ProcessedTaskCacheSize)
+	etl.ProcessedTaskCacheSize = 10
+	defer worker.ResetProcessedForTest()
+
+	sink := &countingSink{}
+	tf := &countingTaskFactory{
+		StandardTaskFactory: worker.StandardTaskFactory{
+			Sink:   &countingSinkFactory{sink},
+			Source: NewSourceFactory("test-bucket"),
+		},
+	}
+	filename := "gs://test-bucket/ndt/ndt5/2019/12/01/20191201T020011.395772Z-ndt5-mlab1-bcn01-ndt.tgz"
+	path, err := etl.ValidateTestPath(filename)
+	rtx.Must(err, "bad path")
+
+	if pErr := worker.ProcessGKETask(context.Background(), path, tf); pErr != nil {
+		t.Fatalf("ProcessGKETask() = %v", pErr)
+	}
+	committed := sink.committed
+	if committed == 0 {
+		t.Fatal("ProcessGKETask() committed no rows")
+	}
+
+	// The redelivered task should be skipped.
+	if pErr := worker.ProcessGKETask(context.Background(), path, tf); pErr != nil {
+		t.Fatalf("ProcessGKETask() second time = %v", pErr)
+	}
+	if tf.tasks != 1 {
+		t.Errorf("tasks created = %d, want 1", tf.tasks)
+	}
+	if sink.committed != committed {
+		t.Errorf("committed = %d after redelivery, want %d", sink.committed, committed)
+	}
+	metrics.FileCount.Reset()
+	metrics.TaskTotal.Reset()
+	metrics.TestTotal.Reset()
+}
+
+// contentErrorParser rejects the first test as corrupt content, and buffers
+// one row for each other test.
+type contentErrorParser struct {
+	blockingParser
+	tests int
+}
+
+func (p *contentErrorParser) ParseAndInsert(meta etl.Metadata, testName string, test []byte) error {
+	p.tests++
+	if p.tests == 1 {
+		return factory.NewError("ndt5", "Decode", http.StatusBadRequest, io.ErrUnexpectedEOF)
+	}
+	return p.Put(testName)
+}
+
+type contentErrorParserFactory struct {
+	p *contentErrorParser
+}
+
+func (pf *contentErrorParserFactory) Get(ctx context.Context, dp etl.DataPath, sink row.Sink, table string) (etl.Parser, etl.ProcessingError) {
+	pf.p.Base = row.NewBase(table, sink, 100)
+	return pf.p, nil
+}
+
+func TestProcessGKETaskContentError(t *testing.T) {
+	defer func(n int) { etl.ProcessedTaskCacheSize = n }(etl.ProcessedTaskCacheSize)
+	etl.ProcessedTaskCacheSize = 10
+	defer worker.ResetProcessedForTest()
+	metrics.TaskTotal.Reset()
+
+	sink := &countingSink{}
+	p := &contentErrorParser{}
+	tf := &countingTaskFactory{
+		StandardTaskFactory: worker.StandardTaskFactory{
+			Sink:   &countingSinkFactory{sink},
+			Source: NewSourceFactory("test-bucket"),
+			Parser: &contentErrorParserFactory{p},
+		},
+	}
+	filename := "gs://test-bucket/ndt/ndt5/2019/12/01/20191201T020011.395772Z-ndt5-mlab1-bcn01-ndt.tgz"
+	path, err := etl.ValidateTestPath(filename)
+	rtx.Must(err, "bad path")
+
+	// A single corrupt test should not fail the task.
+	if pErr := worker.ProcessGKETask(context.Background(), path, tf); pErr != nil {
+		t.Fatalf("ProcessGKETask() = %v, want nil", pErr)
+	}
+	if r := p.Results(); r.Content != 1 || sink.committed != r.Rows {
+		t.Errorf("Results() = %+v, committed = %d, want 1 content error and all rows committed", r, sink.committed)
+	}
+	if got := testutil.ToFloat64(metrics.TaskTotal.WithLabelValues("ndt5", "OK")); got != 1 {
+		t.Errorf("TaskTotal OK = %v, want 1", got)
+	}
+
+	// The task should be cached, so a redelivery does not insert rows again.
+	committed := sink.committed
+	if pErr := worker.ProcessGKETask(context.Background(), path, tf); pErr != nil {
+		t.Fatalf("ProcessGKETask() second time = %v", pErr)
+	}
+	if tf.tasks != 1 || sink.committed != committed {
+		t.Errorf("tasks created = %d, committed = %d after redelivery, want 1, %d", tf.tasks, sink.committed, committed)
+	}
+	metrics.FileCount.Reset()
+	metrics.TaskTotal.Reset()
+	metrics.TestTotal.Reset()
+}